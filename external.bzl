@@ -520,8 +520,8 @@ def _go_dependencies():
         patches = [
             "@io_kythe//third_party/go:add_export_license.patch",
         ],
-        sum = "h1:X2ev0eStA3AbceY54o37/0PQ/UWqKEiiO2dKL5OPaFM=",
-        version = "v0.5.2",
+        sum = "h1:BKbKCqvP6I+rmFHt06ZmyQtvB8xAkWdhFyr0ZUNZcxQ=",
+        version = "v0.5.6",
     )
 
     go_repository(
@@ -925,6 +925,24 @@ def _go_dependencies():
         sum = "h1:dntmOdLpSpHlVqbW5Eay97DelsZHe+55D+xC6i0dDS0=",
         version = "v0.22.5",
     )
+    go_repository(
+        name = "io_opentelemetry_go_otel",
+        importpath = "go.opentelemetry.io/otel",
+        sum = "h1:qTTn6x71GVBvoafHK/yaRUmFzI4LcONZD0/kXxl5PHI=",
+        version = "v1.0.0",
+    )
+    go_repository(
+        name = "io_opentelemetry_go_otel_sdk",
+        importpath = "go.opentelemetry.io/otel/sdk",
+        sum = "h1:BNPMYUONPNbLneMttKSjQhOTlFLOD9U22HNG1KrIN2Y=",
+        version = "v1.0.0",
+    )
+    go_repository(
+        name = "io_opentelemetry_go_otel_trace",
+        importpath = "go.opentelemetry.io/otel/trace",
+        sum = "h1:TSBr8GTEtKevYMG/2d21M989r5WJYVimhTHBKVEZuh4=",
+        version = "v1.0.0",
+    )
 
     go_repository(
         name = "io_rsc_binaryregexp",
@@ -1070,8 +1088,8 @@ def _go_dependencies():
         patches = [
             "@io_kythe//third_party/go:add_export_license.patch",
         ],
-        sum = "h1:2+jF2APAgFgXJnYOQGDGGiRvvEo6OhqZGQf46n9xgEw=",
-        version = "v0.0.0-20201027140754-0fcbb8f4928c",
+        sum = "h1:iGu644GcxtEcrInvDsQRCwJjtCIOlT2V7IRt6ah2Whw=",
+        version = "v0.0.0-20210423185535-09eb48e85fd7",
     )
     go_repository(
         name = "org_golang_x_text",
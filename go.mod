@@ -15,7 +15,7 @@ require (
 	github.com/golang/snappy v0.0.2
 	github.com/google/brotli v1.0.9
 	github.com/google/brotli/go/cbrotli v0.0.0-20201008125033-fcda9db7fd55
-	github.com/google/go-cmp v0.5.2
+	github.com/google/go-cmp v0.5.6
 	github.com/google/orderedcode v0.0.1
 	github.com/google/subcommands v1.2.0
 	github.com/google/uuid v1.1.2
@@ -34,11 +34,15 @@ require (
 	github.com/syndtr/goleveldb v1.0.0
 	github.com/ulikunitz/xz v0.5.8 // indirect
 	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8 // indirect
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
 	golang.org/x/net v0.0.0-20201027133719-8eef5233e2a1
 	golang.org/x/oauth2 v0.0.0-20200902213428-5d25da1a8d43
 	golang.org/x/sync v0.0.0-20201020160332-67f06af15bc9
-	golang.org/x/sys v0.0.0-20201027140754-0fcbb8f4928c
+	golang.org/x/sys v0.0.0-20210423185535-09eb48e85fd7
 	golang.org/x/text v0.3.4
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	golang.org/x/tools v0.0.0-20201027213030-631220838841
 	google.golang.org/api v0.34.0
 	google.golang.org/appengine v1.6.7 // indirect
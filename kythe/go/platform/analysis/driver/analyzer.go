@@ -0,0 +1,78 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// An Identifier is a CompilationAnalyzer that can describe itself, for
+// example by name and version.  The driver records the identity of the
+// analyzer used for each compilation, for provenance.
+type Identifier interface {
+	analysis.CompilationAnalyzer
+
+	// Identity returns a description of the analyzer, such as "go/v1.2".
+	Identity() string
+}
+
+// analyzerIdentity returns the identity of a, or "" if it is not an
+// Identifier.
+func analyzerIdentity(a analysis.CompilationAnalyzer) string {
+	if id, ok := a.(Identifier); ok {
+		return id.Identity()
+	}
+	return ""
+}
+
+// An AnalyzerMiddleware wraps a CompilationAnalyzer with additional behavior,
+// such as logging or caching, returning the wrapped analyzer.
+type AnalyzerMiddleware func(analysis.CompilationAnalyzer) analysis.CompilationAnalyzer
+
+// Chain returns base wrapped by each of mw, with the first middleware
+// outermost: Chain(a, m1, m2) is m1(m2(a)), so a request passes through m1,
+// then m2, before reaching a.
+func Chain(base analysis.CompilationAnalyzer, mw ...AnalyzerMiddleware) analysis.CompilationAnalyzer {
+	for i := len(mw) - 1; i >= 0; i-- {
+		base = mw[i](base)
+	}
+	return base
+}
+
+// TeeAnalyzer returns a CompilationAnalyzer that sends each request to each of
+// analyzers in turn, passing all of their outputs to the same OutputFunc.  If
+// any analyzer reports an error, the remaining analyzers are not called and
+// the error is returned unchanged, so a retry runs every analyzer again.
+func TeeAnalyzer(analyzers ...analysis.CompilationAnalyzer) analysis.CompilationAnalyzer {
+	return teeAnalyzer(analyzers)
+}
+
+type teeAnalyzer []analysis.CompilationAnalyzer
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (t teeAnalyzer) Analyze(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc) error {
+	for _, a := range t {
+		if err := a.Analyze(ctx, req, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestTeeAnalyzer(t *testing.T) {
+	a1 := &fakeAnalyzer{outputs: outs("a", "b")}
+	a2 := &fakeAnalyzer{outputs: outs("c")}
+	var written []string
+	d := &Driver{
+		Analyzer: TeeAnalyzer(a1, a2),
+		WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+			written = append(written, string(out.Value))
+			return nil
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), NewSliceQueue(comps("t1", "t2")...)))
+
+	if want := []string{"a", "b", "c", "a", "b", "c"}; !equalStrings(written, want) {
+		t.Errorf("Written outputs: got %q, want %q", written, want)
+	}
+	if len(a1.requests) != 2 || len(a2.requests) != 2 || a1.requests[0] != a2.requests[0] {
+		t.Errorf("Analyzers did not receive the same requests: %v, %v", a1.requests, a2.requests)
+	}
+}
+
+func TestTeeAnalyzerError(t *testing.T) {
+	a1 := &fakeAnalyzer{outputs: outs("a"), fail: map[string]error{"t1": errFromAnalysis}}
+	a2 := analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+		t.Error("Second analyzer called after an error from the first")
+		return nil
+	})
+	var written []string
+	err := TeeAnalyzer(a1, a2).Analyze(context.Background(),
+		&apb.AnalysisRequest{Compilation: comps("t1")[0].Unit},
+		func(_ context.Context, out *apb.AnalysisOutput) error {
+			written = append(written, string(out.Value))
+			return nil
+		})
+	if err != errFromAnalysis {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
+	}
+	if want := []string{"a"}; !equalStrings(written, want) {
+		t.Errorf("Written outputs: got %q, want %q", written, want)
+	}
+}
+
+func TestDriverAnalyzerFor(t *testing.T) {
+	cus := comps("go1", "java1", "go2", "c1")
+	for _, cu := range cus {
+		cu.Unit.VName.Language = strings.TrimRight(cu.Unit.GetVName().GetSignature(), "0123456789")
+	}
+	goAnalyzer, javaAnalyzer, fallback := new(fakeAnalyzer), new(fakeAnalyzer), new(fakeAnalyzer)
+	byLanguage := map[string]analysis.CompilationAnalyzer{"go": goAnalyzer, "java": javaAnalyzer}
+	analyzerFor := func(cu Compilation) analysis.CompilationAnalyzer {
+		return byLanguage[cu.Unit.GetVName().GetLanguage()] // nil for unknown languages
+	}
+
+	d := &Driver{Analyzer: fallback, AnalyzerFor: analyzerFor}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), NewSliceQueue(cus...)))
+	for _, test := range []struct {
+		name string
+		a    *fakeAnalyzer
+		want []string
+	}{
+		{"go", goAnalyzer, []string{"go1", "go2"}},
+		{"java", javaAnalyzer, []string{"java1"}},
+		{"fallback", fallback, []string{"c1"}},
+	} {
+		if got := analyzed(test.a); !equalStrings(got, test.want) {
+			t.Errorf("%s analyzer: got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// Without a fallback, a compilation with no analyzer fails, but the
+	// driver may still be run.
+	d = &Driver{AnalyzerFor: analyzerFor}
+	if err := d.Run(context.Background(), NewSliceQueue(cus...)); err == nil || !strings.Contains(err.Error(), `no analyzer for "c1"`) {
+		t.Errorf("Expected an error for a compilation with no analyzer; found %v", err)
+	}
+	if err := new(Driver).Run(context.Background(), NewSliceQueue(cus...)); err == nil {
+		t.Error("Expected an error from a driver with no analyzer")
+	}
+}
+
+// identifiedAnalyzer is a fakeAnalyzer that implements Identifier.
+type identifiedAnalyzer struct {
+	fakeAnalyzer
+	identity string
+}
+
+// Identity implements the Identifier interface.
+func (a *identifiedAnalyzer) Identity() string { return a.identity }
+
+func TestDriverAnalyzerIdentity(t *testing.T) {
+	goIndexer := &identifiedAnalyzer{identity: "go/v1"}
+	cxxIndexer := &identifiedAnalyzer{identity: "cxx/v2"}
+	anonymous := new(fakeAnalyzer)
+	d := &Driver{
+		Analyzer: anonymous,
+		AnalyzerFor: func(cu Compilation) analysis.CompilationAnalyzer {
+			switch sig := cu.Unit.GetVName().GetSignature(); {
+			case strings.HasPrefix(sig, "go"):
+				return goIndexer
+			case strings.HasPrefix(sig, "cxx"):
+				return cxxIndexer
+			}
+			return nil
+		},
+	}
+	report, err := d.RunReport(context.Background(), NewSliceQueue(comps("go1", "cxx1", "other", "go2")...))
+	testutil.FatalOnErrT(t, "RunReport error: %v", err)
+
+	var got []string
+	for _, rec := range report.Records {
+		got = append(got, rec.Signature+"="+rec.Analyzer)
+	}
+	if want := []string{"go1=go/v1", "cxx1=cxx/v2", "other=", "go2=go/v1"}; !equalStrings(got, want) {
+		t.Errorf("Recorded analyzers: got %q, want %q", got, want)
+	}
+	want := map[string]int{"go/v1": 2, "cxx/v2": 1}
+	if got := report.Totals.CompilationsByAnalyzer; !reflect.DeepEqual(got, want) {
+		t.Errorf("CompilationsByAnalyzer: got %v, want %v", got, want)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	tracing := func(name string) AnalyzerMiddleware {
+		return func(next analysis.CompilationAnalyzer) analysis.CompilationAnalyzer {
+			return analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+				calls = append(calls, name+" before")
+				err := next.Analyze(ctx, req, out)
+				calls = append(calls, name+" after")
+				return err
+			})
+		}
+	}
+	base := analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+		calls = append(calls, "base")
+		return nil
+	})
+
+	d, err := New(base, func(context.Context, *apb.AnalysisOutput) error { return nil },
+		WithMiddleware(tracing("outer"), tracing("inner")))
+	testutil.FatalOnErrT(t, "New error: %v", err)
+	testutil.FatalOnErrT(t, "Run error: %v", d.Run(context.Background(), NewSliceQueue(comps("t1")...)))
+
+	want := []string{"outer before", "inner before", "base", "inner after", "outer after"}
+	if !equalStrings(calls, want) {
+		t.Errorf("Calls: got %q, want %q", calls, want)
+	}
+
+	if Chain(base) == nil {
+		t.Error("Chain with no middleware returned nil")
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/platform/delimited"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A CachingAnalyzer is a CompilationAnalyzer that stores the outputs of
+// another analyzer in a local directory, and replays them in place of calling
+// the analyzer when the same request is seen again.  Requests are identified by
+// a digest of their contents, including the revision, and the outputs for each
+// revision are stored together so that they can be discarded by Invalidate.
+//
+// Outputs are only stored for analyses that succeed.  An error reading or
+// writing the cache is reported as an analysis error.
+type CachingAnalyzer struct {
+	inner analysis.CompilationAnalyzer
+	dir   string
+}
+
+// NewCachingAnalyzer returns a CachingAnalyzer that caches the outputs of inner
+// in cacheDir, which is created if necessary.
+func NewCachingAnalyzer(inner analysis.CompilationAnalyzer, cacheDir string) *CachingAnalyzer {
+	return &CachingAnalyzer{inner: inner, dir: cacheDir}
+}
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (c *CachingAnalyzer) Analyze(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc) error {
+	path, err := c.path(req)
+	if err != nil {
+		return err
+	}
+	if err := c.replay(ctx, path, f); !os.IsNotExist(err) {
+		return err
+	}
+
+	// Cache miss: record the outputs as they are passed along.
+	var outs []*apb.AnalysisOutput
+	if err := c.inner.Analyze(ctx, req, func(ctx context.Context, out *apb.AnalysisOutput) error {
+		outs = append(outs, out)
+		return f(ctx, out)
+	}); err != nil {
+		return err
+	}
+	return c.store(path, outs)
+}
+
+// Invalidate discards the cached outputs of every request for the given
+// revision.
+func (c *CachingAnalyzer) Invalidate(revision string) error {
+	return os.RemoveAll(c.revisionDir(revision))
+}
+
+// revisionDir returns the directory holding the outputs for revision.
+func (c *CachingAnalyzer) revisionDir(revision string) string {
+	return filepath.Join(c.dir, "rev-"+url.PathEscape(revision))
+}
+
+// path returns the path of the cache file for req.
+func (c *CachingAnalyzer) path(req *apb.AnalysisRequest) (string, error) {
+	rec, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return "", errors.WithMessage(err, "driver: computing cache key")
+	}
+	key := sha256.Sum256(rec)
+	return filepath.Join(c.revisionDir(req.Revision), hex.EncodeToString(key[:])), nil
+}
+
+// replay passes each output stored at path to f.  It returns an error
+// satisfying os.IsNotExist if there is no such entry.
+func (c *CachingAnalyzer) replay(ctx context.Context, path string, f analysis.OutputFunc) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return err
+	} else if err != nil {
+		return errors.WithMessage(err, "driver: reading cache")
+	}
+	defer file.Close()
+
+	// Read every output before replaying any, so that a damaged entry is not
+	// partially replayed.
+	var outs []*apb.AnalysisOutput
+	rd := delimited.NewReader(file)
+	for {
+		out := new(apb.AnalysisOutput)
+		if err := rd.NextProto(out); err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.WithMessagef(err, "driver: reading cache entry %q", path)
+		}
+		outs = append(outs, out)
+	}
+	for _, out := range outs {
+		if err := f(ctx, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// store writes outs to path.  The entry is written to a temporary file and
+// renamed into place, so a concurrent reader never sees a partial entry.
+func (c *CachingAnalyzer) store(path string, outs []*apb.AnalysisOutput) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.WithMessage(err, "driver: creating cache directory")
+	}
+	tmp, err := ioutil.TempFile(dir, "tmp-")
+	if err != nil {
+		return errors.WithMessage(err, "driver: writing cache")
+	}
+	w := delimited.NewWriter(tmp)
+	for _, out := range outs {
+		if err = w.PutProto(out); err != nil {
+			break
+		}
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithMessage(err, "driver: writing cache")
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	"google.golang.org/protobuf/proto"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestCachingAnalyzer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachinganalyzer")
+	testutil.FatalOnErrT(t, "Creating temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	inner := &fakeAnalyzer{outputs: outs("a", "b", "c")}
+	c := NewCachingAnalyzer(inner, dir)
+	analyze := func(sig, rev string) []*apb.AnalysisOutput {
+		t.Helper()
+		req := &apb.AnalysisRequest{Compilation: comps(sig)[0].Unit, Revision: rev}
+		var got []*apb.AnalysisOutput
+		testutil.FatalOnErrT(t, "Analyze: %v", c.Analyze(context.Background(), req, func(_ context.Context, out *apb.AnalysisOutput) error {
+			got = append(got, out)
+			return nil
+		}))
+		return got
+	}
+	checkOutputs := func(desc string, got []*apb.AnalysisOutput) {
+		t.Helper()
+		want := outs("a", "b", "c")
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %d outputs, want %d", desc, len(got), len(want))
+		}
+		for i, out := range got {
+			if !proto.Equal(out, want[i]) {
+				t.Errorf("%s: output %d: got %v, want %v", desc, i, out, want[i])
+			}
+		}
+	}
+
+	checkOutputs("miss", analyze("t1", "r1"))
+	checkOutputs("hit", analyze("t1", "r1"))
+	if len(inner.requests) != 1 {
+		t.Errorf("Expected a cache hit to skip the inner analyzer; found %d requests", len(inner.requests))
+	}
+
+	// A different compilation or revision is a separate entry.
+	analyze("t2", "r1")
+	analyze("t1", "r2")
+	if len(inner.requests) != 3 {
+		t.Errorf("Expected 3 requests after two misses; found %d", len(inner.requests))
+	}
+
+	// Invalidating a revision discards only its entries.
+	testutil.FatalOnErrT(t, "Invalidate: %v", c.Invalidate("r1"))
+	analyze("t1", "r2")
+	if len(inner.requests) != 3 {
+		t.Errorf("Entry for another revision was invalidated: %d requests", len(inner.requests))
+	}
+	checkOutputs("after invalidation", analyze("t1", "r1"))
+	if len(inner.requests) != 4 {
+		t.Errorf("Expected a miss after invalidation; found %d requests", len(inner.requests))
+	}
+}
+
+func TestCachingAnalyzerError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachinganalyzer")
+	testutil.FatalOnErrT(t, "Creating temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	inner := &fakeAnalyzer{outputs: outs("a"), fail: map[string]error{"bad": errFromAnalysis}}
+	var c analysis.CompilationAnalyzer = NewCachingAnalyzer(inner, dir)
+	d := &Driver{Analyzer: c, ContinueOnError: true, Logger: new(testLogger)}
+	for i := 0; i < 2; i++ {
+		stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("good", "bad")...))
+		if err == nil || stats.Outputs != 2 {
+			t.Errorf("Run %d: expected an error and 2 outputs; found %v and %d", i, err, stats.Outputs)
+		}
+	}
+	// The failed analysis is not cached, so it runs again.
+	if got, want := analyzed(inner), []string{"bad", "bad", "good"}; !equalStrings(got, want) {
+		t.Errorf("Inner analyses: got %q, want %q", got, want)
+	}
+}
+
+func TestDriverMaybeServeCached(t *testing.T) {
+	a := &fakeAnalyzer{outputs: outs("fresh")}
+	var written, tornDown []string
+	d := &Driver{
+		Analyzer: a,
+		MaybeServeCached: func(ctx context.Context, cu Compilation, out analysis.OutputFunc) (bool, error) {
+			if cu.Unit.GetVName().GetSignature() != "warm" {
+				return false, nil
+			}
+			for _, o := range outs("cached1", "cached2") {
+				if err := out(ctx, o); err != nil {
+					return false, err
+				}
+			}
+			return true, nil
+		},
+		WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+			written = append(written, string(out.Value))
+			return nil
+		},
+		Context: testContext{
+			teardown: func(_ context.Context, cu Compilation) error {
+				tornDown = append(tornDown, cu.Unit.GetVName().GetSignature())
+				return nil
+			},
+		},
+	}
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("warm", "cold")...))
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	if got, want := analyzed(a), []string{"cold"}; !equalStrings(got, want) {
+		t.Errorf("Analyzed compilations: got %q, want %q", got, want)
+	}
+	if want := []string{"cached1", "cached2", "fresh"}; !equalStrings(written, want) {
+		t.Errorf("Written outputs: got %q, want %q", written, want)
+	}
+	if want := []string{"warm", "cold"}; !equalStrings(tornDown, want) {
+		t.Errorf("Torn down compilations: got %q, want %q", tornDown, want)
+	}
+	if stats.CacheHits != 1 || stats.Succeeded != 2 || stats.Outputs != 3 {
+		t.Errorf("Expected 1 cache hit, 2 successes, and 3 outputs; found %+v", stats)
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A Checkpoint records which compilations have been analyzed, so that an
+// interrupted run can be resumed without repeating work.  Compilations are
+// identified by their unit signatures.  When used with RunConcurrent, the
+// methods of a Checkpoint must be safe for concurrent use.
+type Checkpoint interface {
+	// Done reports whether the compilation with the given signature has
+	// already been analyzed.
+	Done(signature string) bool
+
+	// Mark records that the compilation with the given signature has been
+	// analyzed successfully.
+	Mark(signature string) error
+}
+
+// A FileCheckpoint is a Checkpoint that records signatures in a file, one per
+// line.  It is safe for concurrent use.
+type FileCheckpoint struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]bool
+}
+
+// NewFileCheckpoint returns a FileCheckpoint backed by the file at path, which
+// is created if it does not already exist.  Signatures recorded in the file
+// by a previous run are reported as done.  The caller must Close the
+// checkpoint when it is no longer needed.
+func NewFileCheckpoint(path string) (*FileCheckpoint, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.WithMessage(err, "opening checkpoint")
+	}
+	done := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if sig := strings.TrimSpace(s.Text()); sig != "" {
+			done[sig] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return nil, errors.WithMessage(err, "reading checkpoint")
+	}
+	return &FileCheckpoint{f: f, done: done}, nil
+}
+
+// Done implements the Checkpoint interface.
+func (c *FileCheckpoint) Done(signature string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[signature]
+}
+
+// Mark implements the Checkpoint interface.  Each signature is written to the
+// file at most once.
+func (c *FileCheckpoint) Mark(signature string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done[signature] {
+		return nil
+	}
+	if _, err := c.f.WriteString(signature + "\n"); err != nil {
+		return errors.WithMessage(err, "writing checkpoint")
+	}
+	c.done[signature] = true
+	return nil
+}
+
+// Close closes the file backing the checkpoint.
+func (c *FileCheckpoint) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.f.Close()
+}
+
+// A cursorTracker reports the cursor of a CheckpointQueue to the driver's
+// OnCheckpoint once every compilation taken from the queue before that cursor
+// has finished.  Compilations are numbered in the order they are taken.  A nil
+// *cursorTracker tracks nothing.
+type cursorTracker struct {
+	queue  CheckpointQueue
+	report func([]byte)
+
+	mu      sync.Mutex
+	taken   int            // the number of compilations taken from the queue
+	next    int            // the number of the first compilation not yet reported
+	cursors map[int][]byte // the cursor following each compilation not yet reported
+	done    map[int]bool   // compilations that have finished but not been reported
+}
+
+// newCursorTracker returns a cursorTracker for queue, or nil if the driver
+// has no OnCheckpoint or queue is not a CheckpointQueue.
+func (d *Driver) newCursorTracker(queue Queue) *cursorTracker {
+	cq, ok := queue.(CheckpointQueue)
+	if !ok || d.OnCheckpoint == nil {
+		return nil
+	}
+	return &cursorTracker{
+		queue:   cq,
+		report:  d.OnCheckpoint,
+		cursors: make(map[int][]byte),
+		done:    make(map[int]bool),
+	}
+}
+
+// take returns the number of a compilation being taken from the queue.
+func (t *cursorTracker) take() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.taken++
+	return t.taken - 1
+}
+
+// dequeued records the cursor of the queue following compilation seq.  It
+// must be called only when no other call to the queue is in progress.
+func (t *cursorTracker) dequeued(seq int) {
+	cursor := t.queue.Cursor()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cursors[seq] = cursor
+	t.advance()
+}
+
+// finished records that the compilation whose context is ctx has finished.
+func (t *cursorTracker) finished(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	seq, ok := cursorSeqFromContext(ctx)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[seq] = true
+	t.advance()
+}
+
+// advance reports the cursor following the longest run of compilations that
+// have both been dequeued and finished.  The caller must hold t.mu.
+func (t *cursorTracker) advance() {
+	var cursor []byte
+	var found bool
+	for t.done[t.next] {
+		c, ok := t.cursors[t.next]
+		if !ok {
+			break // the queue has not yet returned from presenting it
+		}
+		delete(t.done, t.next)
+		delete(t.cursors, t.next)
+		t.next++
+		cursor, found = c, true
+	}
+	if found {
+		t.report(cursor)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/test/testutil"
+)
+
+// A memCheckpoint is an in-memory Checkpoint.
+type memCheckpoint struct {
+	done   map[string]bool
+	marked []string
+	err    error
+}
+
+func (c *memCheckpoint) Done(sig string) bool { return c.done[sig] }
+
+func (c *memCheckpoint) Mark(sig string) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.marked = append(c.marked, sig)
+	return nil
+}
+
+// analyzed returns the sorted signatures of the compilations sent to a.
+func analyzed(a *fakeAnalyzer) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var sigs []string
+	for _, req := range a.requests {
+		sigs = append(sigs, req.Compilation.GetVName().GetSignature())
+	}
+	sort.Strings(sigs)
+	return sigs
+}
+
+func TestDriverCheckpoint(t *testing.T) {
+	cp := &memCheckpoint{done: map[string]bool{"t1": true, "t3": true}}
+	a := &fakeAnalyzer{fail: map[string]error{"t4": ErrSkip}}
+	var tornDown []string
+	d := &Driver{
+		Analyzer:   a,
+		Checkpoint: cp,
+		Context: &testContext{
+			teardown: func(_ context.Context, cu Compilation) error {
+				tornDown = append(tornDown, cu.Unit.GetVName().GetSignature())
+				return nil
+			},
+		},
+	}
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("t1", "t2", "t3", "t4", "t5")...))
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+	if got, want := analyzed(a), []string{"t2", "t4", "t5"}; !equalStrings(got, want) {
+		t.Errorf("Analyzed compilations: got %q, want %q", got, want)
+	}
+	if got, want := tornDown, []string{"t2", "t4", "t5"}; !equalStrings(got, want) {
+		t.Errorf("Torn down compilations: got %q, want %q", got, want)
+	}
+	if got, want := cp.marked, []string{"t2", "t5"}; !equalStrings(got, want) {
+		t.Errorf("Marked compilations: got %q, want %q", got, want)
+	}
+	if stats.Skipped != 3 || stats.Succeeded != 2 {
+		t.Errorf("Stats: got %+v, want 3 skipped and 2 succeeded", stats)
+	}
+}
+
+func TestDriverCheckpointMarkError(t *testing.T) {
+	bad := errors.New("checkpoint failed")
+	d := &Driver{
+		Analyzer:   &fakeAnalyzer{},
+		Checkpoint: &memCheckpoint{err: bad},
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(comps("t1")...)); !errors.Is(err, bad) {
+		t.Errorf("Expected error %v; found %v", bad, err)
+	}
+}
+
+func TestFileCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	testutil.FatalOnErrT(t, "Creating temp dir: %v", err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+
+	cp, err := NewFileCheckpoint(path)
+	testutil.FatalOnErrT(t, "Opening checkpoint: %v", err)
+	if cp.Done("t1") {
+		t.Error("New checkpoint reports t1 as done")
+	}
+	for _, sig := range []string{"t1", "t2", "t1"} {
+		testutil.FatalOnErrT(t, "Mark error: %v", cp.Mark(sig))
+	}
+	testutil.FatalOnErrT(t, "Close error: %v", cp.Close())
+
+	// Resuming from the same file skips the compilations already marked.
+	cp, err = NewFileCheckpoint(path)
+	testutil.FatalOnErrT(t, "Reopening checkpoint: %v", err)
+	defer cp.Close()
+	a := &fakeAnalyzer{}
+	d := &Driver{Analyzer: a, Checkpoint: cp}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), NewSliceQueue(comps("t1", "t2", "t3")...)))
+	if got, want := analyzed(a), []string{"t3"}; !equalStrings(got, want) {
+		t.Errorf("Analyzed compilations: got %q, want %q", got, want)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	testutil.FatalOnErrT(t, "Reading checkpoint: %v", err)
+	if got, want := string(data), "t1\nt2\nt3\n"; got != want {
+		t.Errorf("Checkpoint contents: got %q, want %q", got, want)
+	}
+}
+
+func TestSliceQueueCursor(t *testing.T) {
+	cus := comps("a", "b", "c")
+	q := NewSliceQueue(cus...)
+	if err := q.Next(context.Background(), func(context.Context, Compilation) error { return nil }); err != nil {
+		t.Fatalf("Next: unexpected error: %v", err)
+	}
+	cursor := q.Cursor()
+
+	resumed, err := NewSliceQueueFrom(cursor, cus...)
+	testutil.FatalOnErrT(t, "NewSliceQueueFrom error: %v", err)
+	checkDrain(t, resumed, "b", "c")
+
+	fresh, err := NewSliceQueueFrom(nil, cus...)
+	testutil.FatalOnErrT(t, "NewSliceQueueFrom error: %v", err)
+	checkDrain(t, fresh, "a", "b", "c")
+
+	for _, bad := range []string{"x", "-1", "4"} {
+		if _, err := NewSliceQueueFrom([]byte(bad), cus...); err == nil {
+			t.Errorf("NewSliceQueueFrom(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestDriverOnCheckpoint(t *testing.T) {
+	cus := comps("t1", "t2", "bad", "t3")
+	var cursors []string
+	d := &Driver{
+		Analyzer:        &fakeAnalyzer{fail: map[string]error{"bad": errFromAnalysis}},
+		ContinueOnError: true,
+		OnCheckpoint:    func(cursor []byte) { cursors = append(cursors, string(cursor)) },
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(cus...)); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
+	}
+	// The failed compilation was finished, since the run continued past it.
+	if want := []string{"1", "2", "3", "4"}; !equalStrings(cursors, want) {
+		t.Errorf("Cursors: got %q, want %q", cursors, want)
+	}
+
+	// Resume from the middle of the queue after a crash.
+	a := new(fakeAnalyzer)
+	d = &Driver{Analyzer: a, OnCheckpoint: func([]byte) {}}
+	q, err := NewSliceQueueFrom([]byte(cursors[1]), cus...)
+	testutil.FatalOnErrT(t, "NewSliceQueueFrom error: %v", err)
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), q))
+	if got, want := analyzed(a), []string{"bad", "t3"}; !equalStrings(got, want) {
+		t.Errorf("Resumed run analyzed %q, want %q", got, want)
+	}
+
+	// A failure that ends the run is not finished.
+	cursors = nil
+	d = &Driver{
+		Analyzer:     &fakeAnalyzer{fail: map[string]error{"bad": errFromAnalysis}},
+		OnCheckpoint: func(cursor []byte) { cursors = append(cursors, string(cursor)) },
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(cus...)); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
+	}
+	if want := []string{"1", "2"}; !equalStrings(cursors, want) {
+		t.Errorf("Cursors: got %q, want %q", cursors, want)
+	}
+}
+
+func TestDriverOnCheckpointConcurrent(t *testing.T) {
+	var sigs []string
+	for i := 0; i < 20; i++ {
+		sigs = append(sigs, fmt.Sprintf("t%d", i))
+	}
+
+	var mu sync.Mutex
+	finished := make(map[string]bool)
+	var cursors []int
+	d := &Driver{
+		Analyzer: new(fakeAnalyzer),
+		Context: testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				// Finish compilations out of order.
+				time.Sleep(time.Duration(len(sigs)-seqOf(cu)) * time.Millisecond / 4)
+				return nil
+			},
+			teardown: func(_ context.Context, cu Compilation) error {
+				mu.Lock()
+				defer mu.Unlock()
+				finished[cu.Unit.GetVName().GetSignature()] = true
+				return nil
+			},
+		},
+		OnCheckpoint: func(cursor []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			n, err := strconv.Atoi(string(cursor))
+			if err != nil {
+				t.Errorf("Invalid cursor %q: %v", cursor, err)
+				return
+			}
+			for _, sig := range sigs[:n] {
+				if !finished[sig] {
+					t.Errorf("Cursor %d reported before %q finished", n, sig)
+				}
+			}
+			cursors = append(cursors, n)
+		},
+	}
+	for _, prefetch := range []int{0, 3} {
+		cursors = nil
+		d.Prefetch = prefetch
+		var err error
+		if prefetch == 0 {
+			err = d.RunConcurrent(context.Background(), NewSliceQueue(comps(sigs...)...), 4)
+		} else {
+			err = d.Run(context.Background(), NewSliceQueue(comps(sigs...)...))
+		}
+		testutil.FatalOnErrT(t, "Driver error: %v", err)
+		if !sort.IntsAreSorted(cursors) || len(cursors) == 0 || cursors[len(cursors)-1] != len(sigs) {
+			t.Errorf("Prefetch=%d: cursors %v do not advance to %d", prefetch, cursors, len(sigs))
+		}
+	}
+}
+
+// seqOf returns the number in the signature of a compilation named "t<n>".
+func seqOf(cu Compilation) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(cu.Unit.GetVName().GetSignature(), "t"))
+	return n
+}
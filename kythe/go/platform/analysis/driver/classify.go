@@ -0,0 +1,37 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	goerrors "errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCErrorClass classifies err by its gRPC status code, such as "Unavailable"
+// or "NotFound", for use as a Driver's ClassifyError function.  Wrapped
+// errors are unwrapped to find the status; an error that carries no status is
+// classified as "Unknown".
+func GRPCErrorClass(err error) string {
+	for e := err; e != nil; e = goerrors.Unwrap(e) {
+		if s, ok := status.FromError(e); ok {
+			return s.Code().String()
+		}
+	}
+	return codes.Unknown.String()
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{status.Error(codes.Unavailable, "down"), "Unavailable"},
+		{status.Error(codes.NotFound, "gone"), "NotFound"},
+		{errors.New("plain"), "Unknown"},
+	}
+	for _, test := range tests {
+		if got := GRPCErrorClass(test.err); got != test.want {
+			t.Errorf("GRPCErrorClass(%v): got %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+func TestDriverClassifyError(t *testing.T) {
+	d := &Driver{
+		Analyzer: &fakeAnalyzer{fail: map[string]error{
+			"u1": status.Error(codes.Unavailable, "backend down"),
+			"u2": status.Error(codes.Unavailable, "backend still down"),
+			"nf": status.Error(codes.NotFound, "no such file"),
+			"x":  errors.New("not a status"),
+		}},
+		Context: testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				if cu.Unit.GetVName().GetSignature() == "skip" {
+					return ErrSkip
+				}
+				return nil
+			},
+		},
+		ClassifyError:   GRPCErrorClass,
+		ContinueOnError: true,
+		Logger:          &testLogger{},
+	}
+	stats, _ := d.RunStats(context.Background(), NewSliceQueue(comps("ok", "u1", "nf", "skip", "u2", "x")...))
+	want := map[string]int{"Unavailable": 2, "NotFound": 1, "Unknown": 1}
+	if !reflect.DeepEqual(stats.ErrorsByClass, want) {
+		t.Errorf("Incorrect error classes: got %v, want %v", stats.ErrorsByClass, want)
+	}
+}
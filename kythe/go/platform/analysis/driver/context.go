@@ -0,0 +1,177 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keys for the values a Driver attaches to the contexts it passes to the
+// analyzer and its callbacks.
+type (
+	attemptKey     struct{}
+	compilationKey struct{}
+	cursorSeqKey   struct{}
+	durationKey    struct{}
+	fetcherKey     struct{}
+	progressKey    struct{}
+	requestIDKey   struct{}
+	scratchKey     struct{}
+)
+
+func withCompilation(ctx context.Context, cu Compilation) context.Context {
+	return context.WithValue(ctx, compilationKey{}, cu)
+}
+
+// CompilationFromContext returns the compilation being processed by the Driver
+// call that ctx was passed to, such as Setup, Teardown, or WriteOutput.  It
+// reports false if ctx does not belong to a Driver.
+func CompilationFromContext(ctx context.Context) (Compilation, bool) {
+	cu, ok := ctx.Value(compilationKey{}).(Compilation)
+	return cu, ok
+}
+
+// lastRequestID is the most recently assigned request ID.  IDs are unique
+// within a process, even across concurrent runs.
+var lastRequestID uint64
+
+// withRequestID attaches a new request ID to ctx.
+func withRequestID(ctx context.Context) context.Context {
+	id := strconv.FormatUint(atomic.AddUint64(&lastRequestID, 1), 10)
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the ID the Driver assigned to the compilation
+// being processed when it was taken from the queue, for correlating the calls
+// made for the same compilation.  The same ID is visible to every callback
+// for the compilation, including across retries, and is included in the
+// messages the Driver logs about it.  It returns "" if ctx does not belong to
+// a Driver.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withCursorSeq records in ctx the position of the current compilation among
+// those taken from a CheckpointQueue, for use by a cursorTracker.
+func withCursorSeq(ctx context.Context, seq int) context.Context {
+	return context.WithValue(ctx, cursorSeqKey{}, seq)
+}
+
+func cursorSeqFromContext(ctx context.Context) (int, bool) {
+	seq, ok := ctx.Value(cursorSeqKey{}).(int)
+	return seq, ok
+}
+
+// A scratch holds the scratch value of a compilation.
+type scratch struct {
+	mu    sync.Mutex
+	value interface{}
+}
+
+// withScratch attaches an empty scratch value to ctx, unless it already has
+// one.
+func withScratch(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(scratchKey{}).(*scratch); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, scratchKey{}, new(scratch))
+}
+
+// SetScratch stores v as the scratch value of the compilation being processed
+// by the Driver call that ctx was passed to, typically Setup.  The value can
+// be retrieved with ScratchFromContext by every later callback for the same
+// compilation, such as WriteOutput and Teardown, so that per-compilation
+// resources need not be tracked separately.  SetScratch reports false, and
+// does nothing, if ctx does not belong to a Driver.
+func SetScratch(ctx context.Context, v interface{}) bool {
+	s, ok := ctx.Value(scratchKey{}).(*scratch)
+	if ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.value = v
+	}
+	return ok
+}
+
+// ScratchFromContext returns the scratch value most recently stored with
+// SetScratch for the compilation ctx belongs to, or nil if there is none.
+func ScratchFromContext(ctx context.Context) interface{} {
+	s, ok := ctx.Value(scratchKey{}).(*scratch)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.value
+}
+
+func withAttempt(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, attemptKey{}, attempt)
+}
+
+// AttemptFromContext reports which attempt at analyzing the current
+// compilation ctx belongs to, starting from 1 and increasing with each retry.
+// It returns 0 if ctx was not created by a Driver for an analysis.
+func AttemptFromContext(ctx context.Context) int {
+	n, _ := ctx.Value(attemptKey{}).(int)
+	return n
+}
+
+func withAnalysisDuration(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, durationKey{}, d)
+}
+
+// AnalysisDurationFromContext reports the time spent in the analyzer for the
+// current compilation.  In the context passed to AnalysisError, this is the
+// duration of the attempt that failed; in Teardown, it is the total across all
+// attempts.  It returns 0 if no analysis has completed.
+func AnalysisDurationFromContext(ctx context.Context) time.Duration {
+	d, _ := ctx.Value(durationKey{}).(time.Duration)
+	return d
+}
+
+// A detachedContext carries the values of its parent but is never cancelled
+// and has no deadline.
+type detachedContext struct{ parent context.Context }
+
+// detach returns a context with the values of ctx that is not cancelled when
+// ctx is.
+func detach(ctx context.Context) context.Context { return detachedContext{ctx} }
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// A rebasedContext carries the values of one context, but the deadline and
+// cancellation of another.
+type rebasedContext struct {
+	context.Context // provides the deadline and cancellation
+	values          context.Context
+}
+
+// rebase returns a context with the values of ctx, but the deadline and
+// cancellation of base.  The values of base are not visible unless ctx was
+// derived from it.
+func rebase(ctx, base context.Context) context.Context { return rebasedContext{base, ctx} }
+
+func (c rebasedContext) Value(key interface{}) interface{} { return c.values.Value(key) }
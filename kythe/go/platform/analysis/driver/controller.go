@@ -0,0 +1,94 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"sync"
+)
+
+// A Controller allows the analysis of individual compilations to be cancelled
+// while a run is in progress, without ending the run.  A compilation whose
+// analysis is cancelled is torn down as usual and then treated as skipped.
+// A Controller is safe for concurrent use, and may be shared by several
+// drivers.  The zero value is ready for use.
+type Controller struct {
+	mu     sync.Mutex
+	active []*activeAnalysis
+}
+
+// An activeAnalysis is a compilation being analyzed under a Controller.
+type activeAnalysis struct {
+	sig       string
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// Cancel cancels the analysis of each compilation with the given signature
+// that is currently in progress, and reports whether there were any.
+func (c *Controller) Cancel(sig string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var found bool
+	for _, a := range c.active {
+		if a.sig == sig {
+			a.cancelled = true
+			a.cancel()
+			found = true
+		}
+	}
+	return found
+}
+
+// Active returns the signatures of the compilations currently being analyzed
+// under c, in the order their analyses began.
+func (c *Controller) Active() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sigs []string
+	for _, a := range c.active {
+		sigs = append(sigs, a.sig)
+	}
+	return sigs
+}
+
+// track registers the analysis of the compilation with signature sig, and
+// returns a context for the analysis that is cancelled by Cancel(sig).  The
+// caller must call done once the analysis is finished, which reports whether
+// it was cancelled.  If c is nil, track returns ctx unchanged.
+func (c *Controller) track(ctx context.Context, sig string) (_ context.Context, done func() bool) {
+	if c == nil {
+		return ctx, func() bool { return false }
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	a := &activeAnalysis{sig: sig, cancel: cancel}
+	c.mu.Lock()
+	c.active = append(c.active, a)
+	c.mu.Unlock()
+	return ctx, func() bool {
+		cancel()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, b := range c.active {
+			if b == a {
+				c.active = append(c.active[:i], c.active[i+1:]...)
+				break
+			}
+		}
+		return a.cancelled
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+)
+
+func TestDriverController(t *testing.T) {
+	fast, stuck := new(fakeAnalyzer), &fakeAnalyzer{latency: time.Hour}
+	c := new(Controller)
+	var tornDown []string
+	d := &Driver{
+		Analyzer: fast,
+		AnalyzerFor: func(cu Compilation) analysis.CompilationAnalyzer {
+			if cu.Unit.GetVName().GetSignature() == "stuck" {
+				return stuck
+			}
+			return nil
+		},
+		Controller: c,
+		MaxRetries: 0, // retries are unlimited, but a cancelled analysis is not retried
+		Context: testContext{
+			teardown: func(_ context.Context, cu Compilation) error {
+				tornDown = append(tornDown, cu.Unit.GetVName().GetSignature())
+				return nil
+			},
+			analysisError: func(context.Context, Compilation, error) error { return ErrRetry },
+		},
+		Logger: new(testLogger),
+	}
+
+	// Cancel the stuck compilation once its analysis is under way.
+	cancelled := make(chan bool, 1)
+	go func() {
+		for {
+			if sigs := c.Active(); len(sigs) == 1 && sigs[0] == "stuck" {
+				cancelled <- c.Cancel("stuck")
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("t1", "stuck", "t3")...))
+	if err != nil {
+		t.Fatalf("Driver error: %v", err)
+	}
+	if !<-cancelled {
+		t.Error("Cancel did not find the active compilation")
+	}
+	if got, want := analyzed(fast), []string{"t1", "t3"}; !equalStrings(got, want) {
+		t.Errorf("Run did not continue after cancellation: analyzed %q, want %q", got, want)
+	}
+	if len(stuck.requests) != 1 {
+		t.Errorf("Expected 1 attempt to analyze the cancelled compilation; found %d", len(stuck.requests))
+	}
+	if want := []string{"t1", "stuck", "t3"}; !equalStrings(tornDown, want) {
+		t.Errorf("Torn down compilations: got %q, want %q", tornDown, want)
+	}
+	if stats.Skipped != 1 || stats.Succeeded != 2 {
+		t.Errorf("Expected the cancelled compilation to be skipped; found %+v", stats)
+	}
+	if c.Cancel("t1") || len(c.Active()) != 0 {
+		t.Errorf("Controller still tracks compilations after the run: %q", c.Active())
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"kythe.io/kythe/go/util/schema/facts"
+	"kythe.io/kythe/go/util/schema/nodes"
+
+	"google.golang.org/protobuf/proto"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+// DefaultDiagnosticSeverity is the severity under which diagnostics are
+// counted in Stats.DiagnosticsBySeverity.  The Kythe schema does not assign
+// diagnostics a severity, so every diagnostic node currently has this one.
+const DefaultDiagnosticSeverity = "error"
+
+// diagnosticEntry unmarshals the entry carried by out, reporting false if out
+// does not carry an entry.
+func diagnosticEntry(out *apb.AnalysisOutput) (*spb.Entry, bool) {
+	if out.GetFinalResult() != nil || len(out.GetValue()) == 0 {
+		return nil, false
+	}
+	var entry spb.Entry
+	if err := proto.Unmarshal(out.GetValue(), &entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// DiagnosticSeverity reports whether out marks a diagnostic, and if so, its
+// severity.  An output marks a diagnostic if its value is the entry that gives
+// a node the kind "diagnostic" (nodes.Diagnostic) in the Kythe schema, as
+// Kythe's indexers emit for each diagnostic before its message and other
+// facts.  Since the schema has no severity for diagnostics, the severity
+// reported is DefaultDiagnosticSeverity.
+func DiagnosticSeverity(out *apb.AnalysisOutput) (string, bool) {
+	entry, ok := diagnosticEntry(out)
+	if !ok || !isDiagnosticKind(entry) {
+		return "", false
+	}
+	return DefaultDiagnosticSeverity, true
+}
+
+func isDiagnosticKind(entry *spb.Entry) bool {
+	return entry.EdgeKind == "" && entry.FactName == facts.NodeKind && string(entry.FactValue) == nodes.Diagnostic
+}
+
+// diagnosticNodes records the diagnostic nodes seen in the outputs of an
+// analysis, so that their remaining facts are routed to OnDiagnostic along
+// with their kind.  It is safe for concurrent use.
+type diagnosticNodes struct {
+	mu    sync.Mutex
+	nodes map[string]bool
+}
+
+// vnameKey returns a key that identifies v.
+func vnameKey(v *spb.VName) string {
+	return strings.Join([]string{v.GetSignature(), v.GetCorpus(), v.GetRoot(), v.GetPath(), v.GetLanguage()}, "\x00")
+}
+
+// match reports whether entry is a fact of a diagnostic node, recording the
+// node if entry gives it its kind, and whether it gave the kind.
+func (d *diagnosticNodes) match(entry *spb.Entry) (isDiag, isKind bool) {
+	if entry.EdgeKind != "" {
+		return false, false
+	}
+	key := vnameKey(entry.Source)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if isDiagnosticKind(entry) {
+		if d.nodes == nil {
+			d.nodes = make(map[string]bool)
+		}
+		d.nodes[key] = true
+		return true, true
+	}
+	return d.nodes[key], false
+}
+
+// diagnostic reports whether out belongs to a diagnostic to be passed to
+// OnDiagnostic instead of being written, and if so, calls OnDiagnostic,
+// counting the diagnostic when out gives its node its kind.  The facts of a
+// diagnostic node that follow its kind, such as its message, belong to it;
+// edges to the node are data.
+func (r *run) diagnostic(ctx context.Context, cu Compilation, out *apb.AnalysisOutput, diags *diagnosticNodes) bool {
+	if r.OnDiagnostic == nil {
+		return false
+	}
+	entry, ok := diagnosticEntry(out)
+	if !ok {
+		return false
+	}
+	isDiag, isKind := diags.match(entry)
+	if !isDiag {
+		return false
+	} else if isKind {
+		r.update(func(s *Stats) {
+			if s.DiagnosticsBySeverity == nil {
+				s.DiagnosticsBySeverity = make(map[string]int)
+			}
+			s.DiagnosticsBySeverity[DefaultDiagnosticSeverity]++
+		})
+	}
+	r.OnDiagnostic(ctx, cu, out)
+	return true
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"kythe.io/kythe/go/util/schema/edges"
+	"kythe.io/kythe/go/util/schema/facts"
+	"kythe.io/kythe/go/util/schema/nodes"
+
+	"google.golang.org/protobuf/proto"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+// factOutput returns an output whose value is an entry giving node the fact.
+func factOutput(t *testing.T, node, fact, value string) *apb.AnalysisOutput {
+	t.Helper()
+	rec, err := proto.Marshal(&spb.Entry{Source: &spb.VName{Signature: node}, FactName: fact, FactValue: []byte(value)})
+	if err != nil {
+		t.Fatalf("Marshaling entry: %v", err)
+	}
+	return &apb.AnalysisOutput{Value: rec}
+}
+
+// edgeOutput returns an output whose value is an entry for an edge.
+func edgeOutput(t *testing.T, source, kind, target string) *apb.AnalysisOutput {
+	t.Helper()
+	rec, err := proto.Marshal(&spb.Entry{
+		Source:   &spb.VName{Signature: source},
+		EdgeKind: kind,
+		Target:   &spb.VName{Signature: target},
+		FactName: "/",
+	})
+	if err != nil {
+		t.Fatalf("Marshaling entry: %v", err)
+	}
+	return &apb.AnalysisOutput{Value: rec}
+}
+
+func TestDiagnosticSeverity(t *testing.T) {
+	tests := []struct {
+		out      *apb.AnalysisOutput
+		severity string
+		ok       bool
+	}{
+		{factOutput(t, "diag", facts.NodeKind, nodes.Diagnostic), DefaultDiagnosticSeverity, true},
+		{factOutput(t, "diag", facts.Message, "it broke"), "", false},
+		{factOutput(t, "anchor", facts.NodeKind, nodes.Anchor), "", false},
+		{&apb.AnalysisOutput{Value: []byte("not an entry")}, "", false},
+		{&apb.AnalysisOutput{FinalResult: &apb.AnalysisResult{}}, "", false},
+		{nil, "", false},
+	}
+	for _, test := range tests {
+		severity, ok := DiagnosticSeverity(test.out)
+		if severity != test.severity || ok != test.ok {
+			t.Errorf("DiagnosticSeverity(%v): got (%q, %v), want (%q, %v)", test.out, severity, ok, test.severity, test.ok)
+		}
+	}
+}
+
+func TestDriverOnDiagnostic(t *testing.T) {
+	// The outputs of a diagnostic as Kythe's indexers emit them: the kind of
+	// the diagnostic node, its other facts, and an edge tagging an anchor.
+	data := []*apb.AnalysisOutput{
+		factOutput(t, "anchor", facts.NodeKind, nodes.Anchor),
+		edgeOutput(t, "anchor", edges.Tagged, "diag1"),
+		factOutput(t, "anchor", facts.AnchorStart, "0"),
+	}
+	a := &fakeAnalyzer{outputs: []*apb.AnalysisOutput{
+		data[0],
+		factOutput(t, "diag1", facts.NodeKind, nodes.Diagnostic),
+		factOutput(t, "diag1", facts.Message, "it broke"),
+		data[1],
+		factOutput(t, "diag2", facts.NodeKind, nodes.Diagnostic),
+		factOutput(t, "diag1", facts.Details, "badly"),
+		data[2],
+	}}
+	var written, diags []*apb.AnalysisOutput
+	var diagUnits []string
+	d := &Driver{
+		Analyzer: a,
+		WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+			written = append(written, out)
+			return nil
+		},
+		OnDiagnostic: func(_ context.Context, cu Compilation, diag *apb.AnalysisOutput) {
+			diags = append(diags, diag)
+			diagUnits = append(diagUnits, cu.Unit.GetVName().GetSignature())
+		},
+	}
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("t1", "t2")...))
+	if err != nil {
+		t.Fatalf("Driver error: %v", err)
+	}
+	if want := append(data, data...); !reflect.DeepEqual(written, want) {
+		t.Errorf("Data outputs written: got %v, want %v", written, want)
+	}
+	if want := []string{"t1", "t1", "t1", "t1", "t2", "t2", "t2", "t2"}; len(diags) != 8 || !equalStrings(diagUnits, want) {
+		t.Errorf("Diagnostic outputs reported for %q, want %q", diagUnits, want)
+	}
+	if want := map[string]int{DefaultDiagnosticSeverity: 4}; !reflect.DeepEqual(stats.DiagnosticsBySeverity, want) {
+		t.Errorf("DiagnosticsBySeverity: got %v, want %v", stats.DiagnosticsBySeverity, want)
+	}
+	if stats.Outputs != 6 {
+		t.Errorf("Expected 6 outputs counted; found %d", stats.Outputs)
+	}
+
+	// Without OnDiagnostic, diagnostics are written like any other output.
+	d.OnDiagnostic, written = nil, nil
+	stats, err = d.RunStats(context.Background(), NewSliceQueue(comps("t1")...))
+	if err != nil {
+		t.Fatalf("Driver error: %v", err)
+	}
+	if len(written) != 7 || stats.Outputs != 7 || stats.DiagnosticsBySeverity != nil {
+		t.Errorf("Without OnDiagnostic: %d written, %d outputs, diagnostics %v; want 7, 7, nil",
+			len(written), stats.Outputs, stats.DiagnosticsBySeverity)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+)
+
+// InputDigest returns a digest of the required inputs and arguments of the
+// unit of cu, for use with a Driver's PriorDigest.  Since the inputs are
+// identified by their digests, the result changes whenever the contents of
+// any input change, but not if the inputs are merely listed in a different
+// order.
+func InputDigest(cu Compilation) string {
+	var inputs []string
+	for _, ri := range cu.Unit.GetRequiredInput() {
+		inputs = append(inputs, ri.GetInfo().GetPath()+"\x00"+ri.GetInfo().GetDigest())
+	}
+	sort.Strings(inputs)
+
+	h := sha256.New()
+	for _, input := range inputs {
+		io.WriteString(h, input+"\n")
+	}
+	// Arguments are order-sensitive; the separator keeps them apart from the
+	// inputs and from each other.
+	io.WriteString(h, "\x00args\n"+strings.Join(cu.Unit.GetArgument(), "\x00"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// unchanged reports whether the digest of cu matches the digest recorded by
+// the driver's PriorDigest.
+func (d *Driver) unchanged(cu Compilation) bool {
+	if d.PriorDigest == nil {
+		return false
+	}
+	prior, ok := d.PriorDigest(cu)
+	if !ok {
+		return false
+	}
+	digest := InputDigest
+	if d.DigestFunc != nil {
+		digest = d.DigestFunc
+	}
+	return digest(cu) == prior
+}
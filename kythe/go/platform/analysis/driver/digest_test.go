@@ -0,0 +1,106 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func digestUnit(args []string, inputs ...*apb.CompilationUnit_FileInput) Compilation {
+	cu := comps("unit")[0]
+	cu.Unit.Argument = args
+	cu.Unit.RequiredInput = inputs
+	return cu
+}
+
+func TestInputDigest(t *testing.T) {
+	changed := input("b.h")
+	changed.Info.Digest = "other"
+	base := InputDigest(digestUnit([]string{"-c", "a.cc"}, input("a.cc"), input("b.h")))
+	tests := []struct {
+		desc string
+		cu   Compilation
+		same bool
+	}{
+		{"identical", digestUnit([]string{"-c", "a.cc"}, input("a.cc"), input("b.h")), true},
+		{"reordered inputs", digestUnit([]string{"-c", "a.cc"}, input("b.h"), input("a.cc")), true},
+		{"changed input", digestUnit([]string{"-c", "a.cc"}, input("a.cc"), changed), false},
+		{"added input", digestUnit([]string{"-c", "a.cc"}, input("a.cc"), input("b.h"), input("c.h")), false},
+		{"changed arguments", digestUnit([]string{"-c", "a.cc", "-O2"}, input("a.cc"), input("b.h")), false},
+		{"reordered arguments", digestUnit([]string{"a.cc", "-c"}, input("a.cc"), input("b.h")), false},
+	}
+	for _, test := range tests {
+		if got := InputDigest(test.cu); (got == base) != test.same {
+			t.Errorf("%s: digest %q vs. %q; want same=%v", test.desc, got, base, test.same)
+		}
+	}
+}
+
+func TestDriverPriorDigest(t *testing.T) {
+	cus := comps("same", "changed", "new")
+	for _, cu := range cus {
+		cu.Unit.RequiredInput = []*apb.CompilationUnit_FileInput{input("a.cc")}
+	}
+	prior := map[string]string{
+		"same":    InputDigest(cus[0]),
+		"changed": InputDigest(digestUnit(nil, input("old.cc"))),
+	}
+	a := new(fakeAnalyzer)
+	var setups []string
+	d := &Driver{
+		Analyzer: a,
+		PriorDigest: func(cu Compilation) (string, bool) {
+			digest, ok := prior[cu.Unit.GetVName().GetSignature()]
+			return digest, ok
+		},
+		Context: testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				setups = append(setups, cu.Unit.GetVName().GetSignature())
+				return nil
+			},
+		},
+	}
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(cus...))
+	if err != nil {
+		t.Fatalf("Driver error: %v", err)
+	}
+	want := []string{"changed", "new"}
+	if got := analyzed(a); !equalStrings(got, want) {
+		t.Errorf("Analyzed compilations: got %q, want %q", got, want)
+	}
+	if !equalStrings(setups, want) {
+		t.Errorf("Set up compilations: got %q, want %q", setups, want)
+	}
+	if stats.Unchanged != 1 || stats.Skipped != 1 || stats.Succeeded != 2 {
+		t.Errorf("Expected 1 unchanged, 1 skipped, and 2 succeeded; found %+v", stats)
+	}
+
+	// A custom DigestFunc replaces the default.
+	a = new(fakeAnalyzer)
+	d.Analyzer = a
+	d.DigestFunc = func(cu Compilation) string { return prior[cu.Unit.GetVName().GetSignature()] }
+	setups = nil
+	if stats, err = d.RunStats(context.Background(), NewSliceQueue(cus...)); err != nil {
+		t.Fatalf("Driver error: %v", err)
+	}
+	if got, want := analyzed(a), []string{"new"}; !equalStrings(got, want) || stats.Unchanged != 2 {
+		t.Errorf("With DigestFunc: analyzed %q with %d unchanged; want %q with 2", got, stats.Unchanged, want)
+	}
+}
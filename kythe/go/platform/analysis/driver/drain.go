@@ -0,0 +1,56 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import "context"
+
+// Drain consumes the remaining compilations from queue without analyzing them,
+// for example to exhaust a queue whose remaining work was cut off by
+// MaxRunDuration.  The driver's OnDequeue and OnProgress hooks are called for
+// each compilation as usual, with ErrSkip as its outcome, but none of the
+// other hooks are.  Drain returns nil once the queue reports the end of its
+// input, and closes a CloseableQueue as Run does.
+func (d *Driver) Drain(ctx context.Context, queue Queue) (err error) {
+	defer closeQueue(queue, &err)
+
+	var index int
+	skip := func(ctx context.Context, cu Compilation) error {
+		ctx = withRequestID(withCompilation(ctx, cu))
+		if d.OnDequeue != nil {
+			d.OnDequeue(ctx, cu)
+		}
+		if d.OnProgress != nil {
+			d.OnProgress(ctx, cu, index, ErrSkip)
+		}
+		index++
+		return nil
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := queue.Next(ctx, skip); isEndOfQueue(err) {
+			return nil
+		} else if isNoMoreNow(err) {
+			if err := sleepCtx(ctx, d.pollInterval()); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDriverDrain(t *testing.T) {
+	a := new(fakeAnalyzer)
+	var dequeued, progressed []string
+	d := &Driver{
+		Analyzer:       a,
+		MaxRunDuration: time.Nanosecond, // the run is cut off immediately
+		Context: testContext{
+			setup: func(context.Context, Compilation) error {
+				t.Error("Setup called while draining")
+				return nil
+			},
+		},
+		OnDequeue: func(ctx context.Context, cu Compilation) {
+			if got, ok := CompilationFromContext(ctx); !ok || got.Unit != cu.Unit {
+				t.Errorf("OnDequeue context does not carry the compilation %q", cu.Unit.GetVName().GetSignature())
+			}
+			dequeued = append(dequeued, cu.Unit.GetVName().GetSignature())
+		},
+		OnProgress: func(_ context.Context, cu Compilation, index int, err error) {
+			if err != ErrSkip {
+				t.Errorf("OnProgress for %q: got error %v, want %v", cu.Unit.GetVName().GetSignature(), err, ErrSkip)
+			}
+			if index != len(progressed) {
+				t.Errorf("OnProgress for %q: got index %d, want %d", cu.Unit.GetVName().GetSignature(), index, len(progressed))
+			}
+			progressed = append(progressed, cu.Unit.GetVName().GetSignature())
+		},
+	}
+	q := &closingQueue{Queue: NewSliceQueue(comps("t1", "t2", "t3")...)}
+	if err := d.Run(context.Background(), q); err != ErrRunBudgetExceeded {
+		t.Fatalf("Expected error %v; found %v", ErrRunBudgetExceeded, err)
+	}
+	if err := d.Drain(context.Background(), q); err != nil {
+		t.Fatalf("Drain error: %v", err)
+	}
+
+	want := []string{"t1", "t2", "t3"}
+	if !equalStrings(dequeued, want) || !equalStrings(progressed, want) {
+		t.Errorf("Drained compilations: dequeued %q, progressed %q; want %q", dequeued, progressed, want)
+	}
+	if len(a.requests) != 0 {
+		t.Errorf("Expected no analyses while draining; found %d", len(a.requests))
+	}
+	if err := q.Next(context.Background(), nil); !isEndOfQueue(err) {
+		t.Errorf("Queue was not exhausted: Next returned %v", err)
+	}
+	if q.closed != 2 {
+		t.Errorf("Expected the queue to be closed by both Run and Drain; closed %d times", q.closed)
+	}
+}
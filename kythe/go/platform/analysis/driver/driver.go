@@ -21,14 +21,25 @@ package driver // import "kythe.io/kythe/go/platform/analysis/driver"
 import (
 	"context"
 	goerrors "errors"
+	"fmt"
+	"io"
 	"log"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 
 	"kythe.io/kythe/go/platform/analysis"
 
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/proto"
 
 	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
 )
 
 // A Compilation represents a compilation and other metadata needed to analyze it.
@@ -37,6 +48,10 @@ type Compilation struct {
 	Revision   string               // revision marker to attribute to the compilation
 	UnitDigest string               // unit digest identifying the compilation in a KCD
 	BuildID    string               // id of the build executing the compilation
+
+	// FileDataService, if set, overrides the driver's FileDataService address
+	// for this compilation.
+	FileDataService string
 }
 
 // CompilationFunc handles a single CompilationUnit.
@@ -45,74 +60,630 @@ type CompilationFunc func(context.Context, Compilation) error
 // A Queue represents an ordered sequence of compilation units.
 type Queue interface {
 	// Next invokes f with the next available compilation in the queue.  If no
-	// further values are available, Next must return ErrEndOfQueue; otherwise,
-	// the return value from f is propagated to the caller of Next.
+	// further values are available, Next must return ErrEndOfQueue or io.EOF,
+	// possibly wrapped; otherwise, the return value from f is propagated to
+	// the caller of Next.
+	// If no value is available yet but more may arrive later, Next may return
+	// ErrNoMoreNow rather than blocking.
+	//
+	// Next may pass f a context derived from its own, for example to attach
+	// values describing where the compilation came from.  The driver uses
+	// that context for all further processing of the compilation, including
+	// the Context callbacks, the analyzer, and WriteOutput.  Since RunConcurrent
+	// and Prefetch may process the compilation after f returns, the context
+	// should not be cancelled when Next returns.
 	Next(_ context.Context, f CompilationFunc) error
 }
 
-// A Context packages callbacks invoked during analysis.
+// A CloseableQueue is a Queue that holds resources that must be released when
+// it is no longer needed.  A Driver closes such a queue when its run ends,
+// whether or not the queue was exhausted.
+type CloseableQueue interface {
+	Queue
+
+	// Close releases the resources held by the queue.
+	Close() error
+}
+
+// A CheckpointQueue is a Queue that can report its position, so that a run
+// interrupted by a crash can be resumed where it left off.  How a queue is
+// resumed from a cursor depends on the queue; see, for example,
+// NewSliceQueueFrom.
+type CheckpointQueue interface {
+	Queue
+
+	// Cursor returns an opaque token for the current position of the queue,
+	// following the last compilation it presented.
+	Cursor() []byte
+}
+
+// closeQueue closes queue if it is a CloseableQueue.  If *err is nil, it is
+// replaced by any error from closing the queue.
+func closeQueue(queue Queue, err *error) {
+	if c, ok := queue.(CloseableQueue); ok {
+		if cerr := c.Close(); cerr != nil && *err == nil {
+			*err = errors.WithMessage(cerr, "driver: closing queue")
+		}
+	}
+}
+
+// A Context packages callbacks invoked during analysis.  The context passed to
+// each callback carries the current compilation (see CompilationFromContext).
+// When used with RunConcurrent, calls for different compilations may overlap,
+// so the implementation must be safe for concurrent use.
 type Context interface {
 	// Setup is invoked after a compilation has been fetched from a Queue but
 	// before it is sent to the analyzer.  If Setup reports an error, analysis
-	// is aborted.
+	// is aborted.  If Setup returns the special value ErrSkip, the compilation
+	// is not analyzed, but Teardown is still called.
 	Setup(context.Context, Compilation) error
 
 	// Teardown is invoked after a analysis has completed for the compilation.
-	// If Teardown reports an error after analysis succeeds, it is logged but
-	// does not cause the analysis to fail.
+	// Once Setup has succeeded, Teardown is always called, even if the context
+	// ends before analysis begins.  The context passed to Teardown reports the
+	// total time spent in the analyzer via AnalysisDurationFromContext.  It
+	// is derived from the context passed to Setup, not from the context of
+	// the analysis, so it remains live even if the analysis timed out.
+	// If Teardown reports an error after analysis succeeds, processing of the
+	// compilation fails with that error.  If the analysis had already failed,
+	// the error from Teardown is passed to the driver's OnTeardownError, or
+	// logged if that is not set, and the analysis error is reported.
+	//
+	// If Teardown returns the special value ErrRetry, the compilation is
+	// processed again from the start, including Setup, subject to the
+	// driver's MaxRetries, RetryBudget, and RetryBackoff.  Outputs already
+	// written for the compilation are not withdrawn, except that with
+	// OrderedOutput, outputs still awaiting their turn are discarded.
 	Teardown(context.Context, Compilation) error
 
 	// AnalysisError is invoked for each non-nil error reported by the analyzer
 	// prior to calling Teardown. The error returned from AnalysisError replaces
 	// the error returned by the analyzer itself.
 	//
+	// The context passed to AnalysisError reports the number of the failed
+	// attempt via AttemptFromContext, starting from 1, and its duration via
+	// AnalysisDurationFromContext.
+	//
 	// If AnalysisError returns the special value ErrRetry, the analysis is
-	// retried immediately.
+	// retried, subject to the driver's MaxRetries, RetryBudget, and
+	// RetryBackoff.  If it returns a RetryAfter, the analysis is retried after
+	// the given delay, which takes the place of RetryBackoff.  If it returns
+	// ErrSkip, the failure is ignored and the driver moves on to the next
+	// compilation.
 	AnalysisError(context.Context, Compilation, error) error
 }
 
 var (
 	// ErrRetry can be returned from a Driver's AnalysisError function to signal
-	// that the driver should retry the analysis immediately.
+	// that the driver should retry the analysis, or from Teardown to signal
+	// that the whole compilation should be processed again.
 	ErrRetry = goerrors.New("retry analysis")
 
+	// ErrSkip can be returned from a Driver's Setup or AnalysisError function
+	// to signal that the driver should abandon the current compilation and
+	// continue with the next one, rather than failing the run.
+	ErrSkip = goerrors.New("skip compilation")
+
+	// ErrNoMoreNow can be returned from a Queue to signal that no compilation
+	// is available yet, but that the queue is not exhausted.  The driver waits
+	// for its PollInterval and then asks the queue again.  It may be wrapped.
+	ErrNoMoreNow = goerrors.New("no compilation available now")
+
+	// ErrRunBudgetExceeded is returned by a Driver that stopped taking
+	// compilations from its queue because its MaxRunDuration had elapsed.
+	ErrRunBudgetExceeded = goerrors.New("run budget exceeded")
+
+	// ErrEmptyQueue is returned by a Driver with FailIfEmpty set whose queue
+	// was exhausted without presenting any compilations.
+	ErrEmptyQueue = goerrors.New("queue produced no compilations")
+
+	// ErrFatal can be returned, possibly wrapped, from a Driver's WriteOutput
+	// to signal a condition from which the run cannot recover, such as a full
+	// disk.  The analysis is abandoned without retrying it, the compilation
+	// is torn down, and the run stops at once, even if ContinueOnError is set.
+	ErrFatal = goerrors.New("fatal output error")
+
 	// ErrEndOfQueue can be returned from a Queue to signal there are no
-	// compilations left to analyze.
+	// compilations left to analyze.  The driver also accepts io.EOF, and
+	// either may be wrapped.
 	ErrEndOfQueue = goerrors.New("end of queue")
 )
 
+// RetryAfter can be returned from a Driver's AnalysisError function to signal
+// that the driver should retry the analysis after waiting for Delay.  It is
+// otherwise treated like ErrRetry.  It may be returned as a value or a
+// pointer, and may be wrapped.
+type RetryAfter struct {
+	Delay time.Duration
+}
+
+func (r RetryAfter) Error() string { return fmt.Sprintf("retry analysis after %v", r.Delay) }
+
+// retryAfter reports the delay requested by a RetryAfter in err, if any.
+func retryAfter(err error) (time.Duration, bool) {
+	var ra RetryAfter
+	if goerrors.As(err, &ra) {
+		return ra.Delay, true
+	}
+	var pra *RetryAfter
+	if goerrors.As(err, &pra) && pra != nil {
+		return pra.Delay, true
+	}
+	return 0, false
+}
+
+// isRetry reports whether err requests a retry of the analysis.
+func isRetry(err error) bool {
+	_, ok := retryAfter(err)
+	return ok || goerrors.Is(err, ErrRetry)
+}
+
+// errTeardownRetry is reported by complete when Teardown returns ErrRetry.
+var errTeardownRetry = goerrors.New("teardown requested a retry")
+
+// isEndOfQueue reports whether err signals that a Queue is exhausted, even if
+// it has been wrapped.  An error reported for a compilation is not the end of
+// the queue, even if it wraps io.EOF, for example from reading an input.
+func isEndOfQueue(err error) bool {
+	var cerr *compilationErr
+	if goerrors.As(err, &cerr) {
+		return false
+	}
+	return goerrors.Is(err, ErrEndOfQueue) || goerrors.Is(err, io.EOF)
+}
+
+// isNoMoreNow reports whether err signals that a Queue has no compilation
+// available yet, even if it has been wrapped.  As with isEndOfQueue, an error
+// reported for a compilation does not qualify.
+func isNoMoreNow(err error) bool {
+	var cerr *compilationErr
+	if goerrors.As(err, &cerr) {
+		return false
+	}
+	return goerrors.Is(err, ErrNoMoreNow)
+}
+
 // AnalysisOptions contains extra configuration for analysis requests.
 type AnalysisOptions struct {
 	// Timeout, if nonzero, sets the given timeout for each analysis request.
+	// The timeout applies to each call of the analyzer separately; Setup and
+	// Teardown are not subject to it.  A request that times out reports
+	// context.DeadlineExceeded to AnalysisError like any other failure.
 	Timeout time.Duration
 }
 
-// Driver sends compilations sequentially from a queue to an analyzer.
+// Driver sends compilations from a queue to an analyzer, either sequentially
+// (Run) or across a pool of workers (RunConcurrent).
+// Prefer New, which checks the configuration, to constructing a Driver
+// directly; every field may still be set after New returns.  A Driver must
+// not be copied once it has been used.
 type Driver struct {
 	Analyzer        analysis.CompilationAnalyzer
 	AnalysisOptions AnalysisOptions
 
+	// AnalyzerFor, if non-nil, selects the analyzer for each compilation.  If
+	// it returns nil for a compilation, Analyzer is used instead, and if
+	// neither is available, processing the compilation fails.
+	AnalyzerFor func(Compilation) analysis.CompilationAnalyzer
+
+	// Prefetch, if positive, allows Run to take up to Prefetch compilations
+	// from the queue and set them up while the current compilation is being
+	// analyzed, so that the work of Setup overlaps with analysis.  The
+	// compilations are still analyzed and torn down in queue order, but Setup
+	// may run concurrently with the other callbacks, so the Context must be
+	// safe for concurrent use.  If the run ends early, every compilation that
+	// was set up is still torn down.  RunConcurrent ignores Prefetch.
+	Prefetch int
+
+	// OnAnalysisProgress, if non-nil, receives the progress the analyzer
+	// reports for each compilation with ReportProgress, as a fraction from 0
+	// to 1.  Reports made after the analyzer has returned are discarded, and
+	// calls for the same compilation do not overlap.
+	OnAnalysisProgress func(ctx context.Context, cu Compilation, fraction float64)
+
+	// Heartbeat, if non-nil, is called every HeartbeatInterval while the
+	// analyzer is running, from a separate goroutine, so that watchdogs can
+	// tell a long analysis from a hung process.  No heartbeats are delivered
+	// once the analyzer has returned.  Both fields must be set to enable
+	// heartbeats.
+	Heartbeat         func(context.Context, Compilation)
+	HeartbeatInterval time.Duration
+
+	// MaxRunDuration, if positive, bounds the wall-clock time of a run.  Once
+	// it has elapsed, no further compilations are taken from the queue, and
+	// the run returns ErrRunBudgetExceeded after the compilations already in
+	// progress have finished, including their Teardown.  The queue's Next is
+	// passed a context with the corresponding deadline, so a queue waiting for
+	// compilations is interrupted, but the processing of the compilations it
+	// delivers is not.
+	MaxRunDuration time.Duration
+
+	// PollInterval is how long to wait before asking the queue again after it
+	// reports ErrNoMoreNow.  If zero, a default of one second is used.
+	PollInterval time.Duration
+
+	// DeadlineFromUnit, if non-nil, is called with each compilation before it
+	// is analyzed.  If it reports true, the duration it returns replaces
+	// AnalysisOptions.Timeout for the analysis of that compilation, with the
+	// same meaning; in particular, zero means no timeout.
+	DeadlineFromUnit func(Compilation) (time.Duration, bool)
+
+	// MaxRetries, if positive, bounds the number of times a single compilation
+	// is retried when AnalysisError reports ErrRetry.  Once the limit is
+	// exceeded, the last error reported by the analyzer is returned instead.
+	// If zero, retries are unlimited.
+	MaxRetries int
+
+	// RetryBudget, if positive, bounds the total number of retries across all
+	// the compilations of a run.  Once it is spent, a request to retry is
+	// ignored, and the error reported by the analyzer is returned as if
+	// MaxRetries had been reached.
+	RetryBudget int
+
+	// RetryBackoff, if non-nil, reports how long to wait before each retry of
+	// a compilation.  The attempt number passed is 1 for the first retry and
+	// increases with each subsequent retry.  If nil, retries are immediate.
+	RetryBackoff func(attempt int) time.Duration
+
+	// RetryPolicy, if non-nil, is consulted with each error reported by the
+	// analyzer and the (1-based) number of the attempt that failed.  If it
+	// returns true, the analysis is retried, subject to MaxRetries and
+	// RetryBackoff, without calling AnalysisError.  Otherwise the error is
+	// passed to AnalysisError as usual, which may still return ErrRetry.
+	RetryPolicy func(err error, attempt int) bool
+
+	// RecoverPanics, if true, converts a panic in the analyzer into an error
+	// carrying the panic value and stack trace, which is then handled like
+	// any other analysis error.
+	RecoverPanics bool
+
+	// ValidateUnit, if true, checks each compilation unit for structural
+	// problems such as a missing VName or duplicate required inputs before
+	// it is set up, and reports an error for any that fail.
+	ValidateUnit bool
+
+	// InputSize, if non-nil, reports the size in bytes of a required input, or
+	// false if its size is not known.  Since compilation units do not record
+	// the sizes of their inputs, this is how Stats.TotalInputBytes is
+	// computed; without it, every input is counted as of unknown size.
+	InputSize func(*apb.CompilationUnit_FileInput) (int64, bool)
+
+	// RequiredInputExists, if non-nil, is called with the path of each
+	// required input of a compilation once it has been set up.  If it reports
+	// false for any of them, the compilation is skipped as if Setup had
+	// returned ErrSkip, and a warning naming the missing inputs is logged.
+	RequiredInputExists func(path string) bool
+
+	// FailIfEmpty, if true, causes a run to return ErrEmptyQueue if its queue
+	// is exhausted without presenting any compilations.  Otherwise, such a
+	// run succeeds.
+	FailIfEmpty bool
+
+	// ContinueOnError, if true, causes an error processing one compilation to
+	// be logged and recorded rather than ending the run.  Once the queue is
+	// exhausted, the recorded errors are returned together.
+	ContinueOnError bool
+
+	// DryRun, if true, causes each compilation to be set up and torn down as
+	// usual, with the usual hooks and statistics, but not sent to the
+	// analyzer; each compilation that is set up successfully is treated as
+	// having been analyzed without error.  An Analyzer need not be specified.
+	DryRun bool
+
+	// ClassifyError, if non-nil, is called with the error that ended the
+	// processing of each failed compilation, and the number of failures in
+	// each class it reports is tallied in Stats.ErrorsByClass.  See, for
+	// example, GRPCErrorClass.
+	ClassifyError func(error) string
+
+	// Tracer, if non-nil, is used to record a span covering the setup,
+	// analysis, and teardown of each compilation.
+	Tracer trace.Tracer
+
+	// RateLimit, if non-nil, bounds the rate at which compilations are sent to
+	// the analyzer.  Retries of a compilation are not limited.
+	RateLimit *rate.Limiter
+
+	// Semaphore, if non-nil, bounds the number of analyses in progress at
+	// once.  A unit of the semaphore is held for each call to the analyzer,
+	// including each retry, but not while waiting to retry.  Sharing the
+	// semaphore among several drivers, or several calls to RunConcurrent,
+	// bounds their analyses together.
+	Semaphore *semaphore.Weighted
+
+	// AugmentInputs, if non-nil, is called with each compilation before it is
+	// sent to the analyzer, and the inputs it returns are appended to the
+	// required inputs of the unit in the analysis request.  The unit of the
+	// original compilation is not modified.  An error from AugmentInputs is
+	// handled as if it had been reported by the analyzer.
+	AugmentInputs func(context.Context, Compilation) ([]*apb.CompilationUnit_FileInput, error)
+
+	// PreAnalyze, if non-nil, is called with each request just before it is
+	// sent to the analyzer, and may modify it.  An error from PreAnalyze is
+	// handled as if it had been reported by the analyzer.
+	PreAnalyze func(context.Context, Compilation, *apb.AnalysisRequest) error
+
+	// SetupTransform, if non-nil, is called in place of the Context's Setup
+	// method, and the compilation it returns replaces the original for the
+	// remainder of its processing, including the analysis request, the
+	// context passed to WriteOutput, and Teardown.  Errors are handled as for
+	// Setup; if it fails, Teardown receives the original compilation.
+	SetupTransform func(context.Context, Compilation) (Compilation, error)
+
+	// TeardownResult, if non-nil, is called in place of the Context's
+	// Teardown method, and additionally receives the outcome of processing
+	// the compilation: nil if it was analyzed successfully, ErrSkip if it was
+	// skipped, or the error that will be reported for it.  A compilation that
+	// was set up by Prefetch but abandoned when the run ended receives
+	// context.Canceled.  Errors are handled as for Teardown.
+	TeardownResult func(context.Context, Compilation, error) error
+
+	// OnTeardownError, if non-nil, is called in place of logging a warning
+	// when Teardown reports an error for a compilation whose processing had
+	// already failed, with both errors.  The analysis error remains the one
+	// reported for the compilation.
+	OnTeardownError func(ctx context.Context, cu Compilation, teardownErr, analysisErr error)
+
+	// TeardownTimeout, if positive, bounds the time spent in Teardown (or
+	// TeardownResult) for each compilation.  Teardown receives a context that
+	// expires after TeardownTimeout, and if it has not returned by then, or
+	// fails because its context expired, the driver logs a warning, counts it
+	// in Stats.TeardownTimeouts, and moves on without waiting for it,
+	// reporting the outcome of the compilation as if Teardown had succeeded.
+	// An abandoned Teardown keeps running in the background until it returns.
+	TeardownTimeout time.Duration
+
+	// OnDequeue, if non-nil, is called with each compilation as soon as it is
+	// taken from the queue, before any other processing, including Setup.
+	OnDequeue func(context.Context, Compilation)
+
+	// OnProgress, if non-nil, is called once for each compilation after its
+	// Teardown, with the number of compilations finished before it and the
+	// error that ended its processing: nil on success, or ErrSkip if it was
+	// skipped.
+	OnProgress func(_ context.Context, _ Compilation, index int, err error)
+
+	// OnCheckpoint, if non-nil and the queue is a CheckpointQueue, is called
+	// with the cursor of the queue after each compilation is finished, so that
+	// the caller may persist it.  A compilation is finished once it has been
+	// processed and its outputs written, even if it failed or was skipped,
+	// provided the run continued.  When compilations are processed
+	// concurrently, the cursor is only reported once every compilation before
+	// it has finished, so resuming from the cursor repeats no finished work
+	// and skips none that is unfinished.  Calls to OnCheckpoint do not
+	// overlap.
+	OnCheckpoint func(cursor []byte)
+
+	// OnComplete, if non-nil, is called exactly once as each run is about to
+	// return, with the statistics of the run and the error it will return:
+	// nil on success.  It is called however the run ends, including when it
+	// is cancelled or fails.  Except in RunPasses, which calls it for each
+	// pass, it is called after the queue has been closed.
+	OnComplete func(ctx context.Context, stats Stats, err error)
+
+	// OutputBoundary, if non-nil, is called once for each compilation sent to
+	// the analyzer, after its last output has been written and before
+	// Teardown, whether or not the analysis succeeded.  It allows a sink
+	// shared by all compilations to flush or mark the end of each one.  An
+	// error from OutputBoundary fails the compilation.
+	OutputBoundary func(context.Context, Compilation) error
+
+	// FailOnNilOutput, if true, causes a nil output from the analyzer to be
+	// reported to it as an error.  Otherwise nil outputs are logged and
+	// discarded.  In neither case is a nil output passed to WriteOutput.
+	FailOnNilOutput bool
+
+	// FinalizeOutput, if non-nil, is called for each compilation just before
+	// Teardown, whether or not its analysis succeeded or was attempted at all.
+	// It is meant for flushing outputs that WriteOutput has buffered, such as
+	// those from BatchOutput, so they are not lost if Teardown fails.  An
+	// error from FinalizeOutput fails a compilation that had not otherwise
+	// failed; if the compilation had already failed, it is logged.
+	FinalizeOutput func(context.Context, Compilation) error
+
+	// OrderedOutput, if true, causes RunConcurrent to write the outputs of
+	// each compilation together, in the order the compilations were taken
+	// from the queue, rather than as they are emitted.  The outputs of each
+	// compilation are held in memory until it and every compilation before it
+	// have finished, so a slow compilation can cause many outputs to
+	// accumulate.  Buffered outputs are not yet written when OutputBoundary
+	// and FinalizeOutput are called, and an error writing them fails the run
+	// regardless of ContinueOnError.  Run always writes outputs in order.
+	OrderedOutput bool
+
+	// AsyncOutputBuffer, if positive, decouples the analyzer from WriteOutput:
+	// outputs are passed to WriteOutput by a separate goroutine, in order,
+	// through a buffer holding up to AsyncOutputBuffer outputs.  The analyzer
+	// only blocks when the buffer is full.  If WriteOutput reports an error,
+	// the analysis is cancelled and the error is reported as its result.
+	AsyncOutputBuffer int
+
+	// OutputErrorMode determines whether an error from WriteOutput is
+	// returned to the analyzer (the default) or collected and reported once
+	// the analyzer returns.
+	OutputErrorMode OutputErrorMode
+
+	// RouteOutput, if non-nil, is used in place of WriteOutput.  Each output is
+	// decoded with DecodeEntry, and the entry is written to the Sink that
+	// RouteOutput selects for it.  Errors decoding, routing, or writing an
+	// entry are handled as errors from WriteOutput.  Outputs that carry a
+	// final result rather than an entry are not routed.  If RouteOutput
+	// returns a nil Sink without an error, the entry is dropped.
+	RouteOutput func(*spb.Entry) (Sink, error)
+
+	// MinOutputsPerCompilation is the number of outputs each successful
+	// analysis is expected to emit.  If an analysis emits fewer, a warning is
+	// logged, or if FailOnInsufficientOutput is set, processing of the
+	// compilation fails.
+	MinOutputsPerCompilation int
+	FailOnInsufficientOutput bool
+
+	// TransformOutput, if non-nil, is called with each output emitted by the
+	// analyzer before it is written, and the output it returns is written in
+	// place of the original.  If it returns nil, the output is dropped.  An
+	// error from TransformOutput is handled as an error from WriteOutput, so
+	// it fails the analysis.  Outputs are counted in Stats.Outputs before
+	// they are transformed, so dropped outputs are included.
+	TransformOutput func(context.Context, *apb.AnalysisOutput) (*apb.AnalysisOutput, error)
+
+	// DedupOutputs, if true, causes outputs whose values are identical to one
+	// already emitted for the same compilation to be dropped before they are
+	// written, and counted in Stats.DuplicateOutputs instead of Stats.Outputs.
+	// The values seen are forgotten when each analysis attempt begins, so
+	// memory use is bounded by the largest compilation.
+	DedupOutputs bool
+
+	// OnOutput, if non-nil, is called with each output emitted by the
+	// analyzer, after it has been passed to WriteOutput (whether or not that
+	// succeeded), so it can observe but not affect what was written.
+	OnOutput func(context.Context, *apb.AnalysisOutput)
+
+	// OnDiagnostic, if non-nil, is called in place of writing each output
+	// emitted by the analyzer that belongs to a diagnostic: the entry that
+	// DiagnosticSeverity recognizes as marking a diagnostic node, and the
+	// facts of that node that follow it, such as its message.  These outputs
+	// are not counted in Stats.Outputs; instead each diagnostic is counted by
+	// severity in Stats.DiagnosticsBySeverity.  OnDiagnostic is
+	// called as the diagnostic is emitted, even when outputs are otherwise
+	// buffered, and in RunConcurrent it may be called concurrently.
+	OnDiagnostic func(ctx context.Context, cu Compilation, diag *apb.AnalysisOutput)
+
+	// Controller, if non-nil, allows the analysis of individual compilations
+	// to be cancelled by signature while the run is in progress.
+	Controller *Controller
+
+	// Checkpoint, if non-nil, is consulted before each compilation is set up,
+	// and compilations it reports as done are skipped.  Each compilation that
+	// is analyzed successfully is marked in the Checkpoint after Teardown.
+	Checkpoint Checkpoint
+
+	// MaybeServeCached, if non-nil, is called for each compilation after it
+	// has been set up, and may pass previously computed outputs for it to the
+	// given OutputFunc, in place of analysis.  If it reports true, the
+	// compilation is not sent to the analyzer, but is otherwise processed as
+	// if it had been, including Teardown, and is counted in Stats.CacheHits.
+	// An error from MaybeServeCached fails the compilation.
+	MaybeServeCached func(ctx context.Context, cu Compilation, out analysis.OutputFunc) (served bool, err error)
+
+	// PriorDigest, if non-nil, is called for each compilation before it is
+	// set up, and reports the digest of the compilation when it was last
+	// analyzed, if known.  If it matches the compilation's current digest,
+	// as computed by DigestFunc, the compilation is skipped without being set
+	// up, and counted in Stats.Unchanged as well as Stats.Skipped.
+	PriorDigest func(Compilation) (string, bool)
+
+	// DigestFunc computes the digest compared with PriorDigest.  If nil,
+	// InputDigest is used.
+	DigestFunc func(Compilation) string
+
+	// RevisionFunc, if non-nil, is called for each compilation that does not
+	// have a Revision of its own, and its result is used as the revision in
+	// the analysis request.
+	RevisionFunc func(Compilation) string
+
+	// FailOnMixedRevision, if true, causes a compilation to fail before it
+	// is set up if its revision differs from that of the first compilation
+	// of the same corpus processed in the run.  Compilations without a
+	// revision are not checked.  Whether or not it is set, the revisions of
+	// each corpus are recorded in Stats.PerCorpus.
+	FailOnMixedRevision bool
+
 	FileDataService string
+	Metrics         Metrics             // if nil, metrics are discarded
 	Context         Context             // if nil, callbacks are no-ops
 	WriteOutput     analysis.OutputFunc // if nil, output is discarded
+	Logger          Logger              // if nil, messages go to the log package
+
+	pauseMu sync.Mutex
+	resumed chan struct{} // if non-nil, the driver is paused until it is closed
+}
+
+// A Logger receives diagnostic messages from a Driver.  RunConcurrent logs
+// from each of its workers, so implementations must be safe for concurrent
+// use.
+type Logger interface {
+	// Warningf logs a warning, formatting its arguments as fmt.Sprintf does.
+	Warningf(format string, args ...interface{})
+}
+
+func (d *Driver) warningf(format string, args ...interface{}) {
+	if l := d.Logger; l != nil {
+		l.Warningf(format, args...)
+	} else {
+		log.Printf("WARNING: "+format, args...)
+	}
+}
+
+// notifyComplete calls the driver's OnComplete, if any, with the result of a
+// run.
+func (d *Driver) notifyComplete(ctx context.Context, stats Stats, err error) {
+	if d.OnComplete != nil {
+		d.OnComplete(ctx, stats, err)
+	}
+}
+
+// hasAnalyzer reports whether the driver is able to analyze compilations.
+func (d *Driver) hasAnalyzer() bool {
+	return d.Analyzer != nil || d.AnalyzerFor != nil || d.DryRun
+}
+
+// analyzer returns the analyzer for cu, or nil if there is none.
+func (d *Driver) analyzer(cu Compilation) analysis.CompilationAnalyzer {
+	if d.AnalyzerFor != nil {
+		if a := d.AnalyzerFor(cu); a != nil {
+			return a
+		}
+	}
+	return d.Analyzer
+}
+
+// revision returns the revision attributed to cu, from cu itself or the
+// driver's RevisionFunc.
+func (d *Driver) revision(cu Compilation) string {
+	if cu.Revision == "" && d.RevisionFunc != nil {
+		return d.RevisionFunc(cu)
+	}
+	return cu.Revision
+}
+
+// contextWarningf logs a warning about the compilation ctx belongs to,
+// prefixed by its request ID, if any.
+func (d *Driver) contextWarningf(ctx context.Context, format string, args ...interface{}) {
+	if id := RequestIDFromContext(ctx); id != "" {
+		format = "[request " + id + "] " + format
+	}
+	d.warningf(format, args...)
+}
+
+func (d *Driver) metrics() Metrics {
+	if d.Metrics == nil {
+		return nopMetrics{}
+	}
+	return d.Metrics
 }
 
 func (d *Driver) writeOutput(ctx context.Context, out *apb.AnalysisOutput) error {
-	if write := d.WriteOutput; write != nil {
+	if d.RouteOutput != nil {
+		return d.routeOutput(ctx, out)
+	} else if write := d.WriteOutput; write != nil {
 		return write(ctx, out)
 	}
 	return nil
 }
 
-func (d *Driver) setup(ctx context.Context, unit Compilation) error {
-	if c := d.Context; c != nil {
-		return c.Setup(ctx, unit)
+func (d *Driver) setup(ctx context.Context, unit Compilation) (Compilation, error) {
+	if d.SetupTransform != nil {
+		return d.SetupTransform(ctx, unit)
+	} else if c := d.Context; c != nil {
+		return unit, c.Setup(ctx, unit)
 	}
-	return nil
+	return unit, nil
 }
 
-func (d *Driver) teardown(ctx context.Context, unit Compilation) error {
-	if c := d.Context; c != nil {
+func (d *Driver) teardown(ctx context.Context, unit Compilation, result error) error {
+	if d.TeardownResult != nil {
+		return d.TeardownResult(ctx, unit, result)
+	} else if c := d.Context; c != nil {
 		return c.Teardown(ctx, unit)
 	}
 	return nil
@@ -128,45 +699,948 @@ func (d *Driver) analysisError(ctx context.Context, unit Compilation, err error)
 // Run sends each compilation received from the driver's Queue to the driver's
 // Analyzer.  All outputs are passed to Output in turn.  An error is immediately
 // returned if the Analyzer, Output, or Compilations fields are unset.
+//
+// If ctx ends during a run, no further compilations are pulled from the queue,
+// but the compilation in progress is still torn down before Run returns.
+//
+// An error processing a compilation is annotated with the corpus and
+// signature of its unit before it is returned.  The original error remains
+// available to errors.Is and errors.As.
 func (d *Driver) Run(ctx context.Context, queue Queue) error {
-	if d.Analyzer == nil {
-		return errors.New("no analyzer has been specified")
+	_, err := d.RunStats(ctx, queue)
+	return err
+}
+
+// RunStats behaves like Run, but additionally returns a summary of the work
+// done.  The Stats are populated even if an error is returned.
+func (d *Driver) RunStats(ctx context.Context, queue Queue) (Stats, error) {
+	return d.newRun().runQueue(ctx, queue)
+}
+
+// runQueue processes each compilation from queue in turn, until the queue is
+// exhausted or reports an error.
+func (r *run) runQueue(ctx context.Context, queue Queue) (stats Stats, err error) {
+	defer func() { r.notifyComplete(ctx, stats, err) }()
+	if !r.hasAnalyzer() {
+		return Stats{}, errors.New("no analyzer has been specified")
+	}
+	defer closeQueue(queue, &err)
+	return r.drive(ctx, queue)
+}
+
+// drive does the work of runQueue, but leaves the queue open.
+func (r *run) drive(ctx context.Context, queue Queue) (Stats, error) {
+	r.cursors = r.newCursorTracker(queue)
+	if r.Prefetch > 0 {
+		return r.finish(r.runPrefetch(ctx, queue))
 	}
+	return r.finish(r.pull(ctx, queue, func(ctx context.Context, cu Compilation) error {
+		if err := r.process(ctx, cu); err != nil {
+			return err
+		}
+		r.cursors.finished(ctx)
+		return nil
+	}))
+}
 
+// pull calls queue.Next with f until ctx ends, the run exceeds its
+// MaxRunDuration, or Next reports an error other than ErrNoMoreNow, and
+// returns the error that ended it.  While the driver is paused, pull blocks
+// before calling Next.  Waiting for the queue is subject to MaxRunDuration,
+// but f is not.
+func (r *run) pull(ctx context.Context, queue Queue, f CompilationFunc) error {
+	qctx, cancel := r.budgeted(ctx)
+	defer cancel()
 	for {
-		if err := queue.Next(ctx, func(ctx context.Context, cu Compilation) error {
-			if err := d.setup(ctx, cu); err != nil {
-				return errors.WithMessage(err, "driver: analysis setup")
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := r.waitResumed(ctx); err != nil {
+			return err
+		}
+		if r.budgetExceeded() {
+			return ErrRunBudgetExceeded
+		}
+		var ferr error // the error reported by f, if it was called
+		err := r.next(qctx, queue, func(fctx context.Context, cu Compilation) error {
+			if qctx != ctx {
+				fctx = rebase(fctx, ctx) // lift the deadline of qctx
 			}
-			err := ErrRetry
-			for err == ErrRetry {
-				err = d.analysisError(ctx, cu, d.runAnalysis(ctx, cu))
+			ferr = f(fctx, cu)
+			return ferr
+		})
+		if isNoMoreNow(err) {
+			err = sleepCtx(qctx, r.pollInterval())
+		}
+		if err == nil {
+			continue
+		} else if qctx.Err() != nil && ctx.Err() == nil && (ferr == nil || !goerrors.Is(err, ferr)) {
+			// The queue was interrupted by the deadline of the run.
+			return ErrRunBudgetExceeded
+		}
+		return err
+	}
+}
+
+// budgeted returns a context derived from ctx that expires when the run's
+// MaxRunDuration has elapsed, and a function to release it.  If there is no
+// MaxRunDuration, it returns ctx itself.
+func (r *run) budgeted(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.MaxRunDuration <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, r.start.Add(r.MaxRunDuration))
+}
+
+// next calls queue.Next with f, adding the time spent in the queue, but not in
+// f, to the run's QueueWaitTotal.  If the run tracks the queue's cursor, the
+// compilation is numbered in the context passed to f.
+func (r *run) next(ctx context.Context, queue Queue, f CompilationFunc) error {
+	var inside time.Duration // time spent in f
+	seq := -1                // the number of the compilation, if tracked
+	start := time.Now()
+	err := queue.Next(ctx, func(ctx context.Context, cu Compilation) error {
+		called := time.Now()
+		defer func() { inside += time.Since(called) }()
+		if r.cursors != nil {
+			seq = r.cursors.take()
+			ctx = withCursorSeq(ctx, seq)
+		}
+		return f(ctx, cu)
+	})
+	wait := time.Since(start) - inside
+	r.update(func(s *Stats) { s.QueueWaitTotal += wait })
+	if err == nil && seq >= 0 {
+		r.cursors.dequeued(seq)
+	}
+	return err
+}
+
+// RunConcurrent behaves like Run, but analyzes up to workers compilations at
+// once.  Compilations are pulled from queue by a single goroutine and handed
+// off to the workers, so the queue need not be safe for concurrent use, but
+// the Compilation must remain valid after the queue's callback returns.
+//
+// Calls to the driver's Context and WriteOutput for different compilations
+// may overlap, so they must be safe for concurrent use.  The first error
+// reported for any compilation cancels the remaining work and is returned.
+func (d *Driver) RunConcurrent(ctx context.Context, queue Queue, workers int) (err error) {
+	var stats Stats
+	defer func() { d.notifyComplete(ctx, stats, err) }()
+	if !d.hasAnalyzer() {
+		return errors.New("no analyzer has been specified")
+	} else if workers < 1 {
+		return errors.Errorf("invalid number of workers: %d", workers)
+	}
+	defer closeQueue(queue, &err)
+
+	r := d.newRun()
+	r.cursors = r.newCursorTracker(queue)
+	g, ctx := errgroup.WithContext(ctx)
+	units := make(chan work)
+	var exceeded bool // set if the puller stopped for MaxRunDuration
+	g.Go(func() error {
+		defer close(units)
+		var seq int
+		err := r.pull(ctx, queue, func(ctx context.Context, cu Compilation) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case units <- work{ctx: ctx, cu: cu, seq: seq}:
+				seq++
+				return nil
 			}
-			if terr := d.teardown(ctx, cu); terr != nil {
-				if err == nil {
-					return errors.WithMessage(terr, "driver: analysis teardown")
+		})
+		switch {
+		case isEndOfQueue(err):
+			return nil
+		case err == ErrRunBudgetExceeded:
+			// Let the workers finish their compilations undisturbed.
+			exceeded = true
+			return nil
+		}
+		return err
+	})
+	var seq *sequencer
+	if d.OrderedOutput {
+		seq = newSequencer(r.emit)
+	}
+	for i := 0; i < workers; i++ {
+		g.Go(func() error {
+			for w := range units {
+				if seq == nil {
+					if err := r.process(w.ctx, w.cu); err != nil {
+						return err
+					}
+					r.cursors.finished(w.ctx)
+					continue
+				}
+				w.ctx = withScratch(w.ctx) // shared with the buffered outputs
+				buf := &outputBuffer{ctx: withCompilation(w.ctx, w.cu)}
+				err := r.process(withOutputBuffer(w.ctx, buf), w.cu)
+				if serr := seq.complete(w.seq, buf); err == nil {
+					err = serr
 				}
-				log.Printf("WARNING: analysis teardown failed: %v (analysis error: %v)", terr, err)
+				if err != nil {
+					return err
+				}
+				r.cursors.finished(w.ctx)
 			}
-			return err
-		}); err == ErrEndOfQueue {
 			return nil
-		} else if err != nil {
+		})
+	}
+	err = g.Wait()
+	if err == nil && exceeded {
+		err = ErrRunBudgetExceeded
+	}
+	stats, err = r.finish(err)
+	return err
+}
+
+// A run holds the state of a single call to RunStats or RunConcurrent.  Its
+// methods are safe for concurrent use.
+type run struct {
+	*Driver
+
+	start time.Time
+	mu    sync.Mutex
+	stats Stats
+	errs  []error // per-compilation errors, if ContinueOnError is set
+	fatal error   // the first ErrFatal reported by WriteOutput, if any
+
+	cursors *cursorTracker // if non-nil, reports the queue's cursor to OnCheckpoint
+
+	revisions map[string]string // the first revision of each corpus, if FailOnMixedRevision
+
+	budgetUsed int // retries charged to the RetryBudget
+
+	report *Report // if non-nil, accumulates a record of each compilation
+
+	pass analysis.CompilationAnalyzer // if non-nil, overrides the driver's analyzers
+}
+
+// analyzer returns the analyzer for cu in this run, or nil if there is none.
+func (r *run) analyzer(cu Compilation) analysis.CompilationAnalyzer {
+	if r.pass != nil {
+		return r.pass
+	}
+	return r.Driver.analyzer(cu)
+}
+
+// teardown tears down cu as the driver does, subject to TeardownTimeout.
+func (r *run) teardown(ctx context.Context, cu Compilation, result error) error {
+	if r.TeardownTimeout <= 0 {
+		return r.Driver.teardown(ctx, cu, result)
+	}
+	tctx, cancel := context.WithTimeout(ctx, r.TeardownTimeout)
+	defer cancel()
+	done := make(chan error, 1) // buffered so an abandoned Teardown can finish
+	go func() { done <- r.Driver.teardown(tctx, cu, result) }()
+
+	select {
+	case err := <-done:
+		if err == nil || tctx.Err() != context.DeadlineExceeded || ctx.Err() != nil {
+			return err
+		}
+		// Teardown gave up on its own when its deadline passed.
+	case <-tctx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err() // the run ended; Teardown is abandoned with it
+		}
+	}
+	r.update(func(s *Stats) { s.TeardownTimeouts++ })
+	r.contextWarningf(ctx, "teardown of %q did not finish within %v", cu.Unit.GetVName().GetSignature(), r.TeardownTimeout)
+	return nil
+}
+
+// A work item is a compilation handed from the queue to a worker by
+// RunConcurrent, with the context the queue passed along with it and its
+// position in the queue.
+type work struct {
+	ctx context.Context
+	cu  Compilation
+	seq int
+}
+
+func (d *Driver) newRun() *run { return &run{Driver: d, start: time.Now()} }
+
+// defaultPollInterval is the PollInterval used if none is specified.
+const defaultPollInterval = time.Second
+
+func (d *Driver) pollInterval() time.Duration {
+	if d.PollInterval <= 0 {
+		return defaultPollInterval
+	}
+	return d.PollInterval
+}
+
+// budgetExceeded reports whether the run has outlasted the driver's
+// MaxRunDuration, if any.
+func (r *run) budgetExceeded() bool {
+	return r.MaxRunDuration > 0 && time.Since(r.start) >= r.MaxRunDuration
+}
+
+// update calls f with exclusive access to the run's statistics.
+func (r *run) update(f func(*Stats)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f(&r.stats)
+}
+
+// finish records the total duration of the run and returns its statistics
+// along with the overall result of the run, given the error that ended it.
+func (r *run) finish(err error) (Stats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.TotalDuration = time.Since(r.start)
+	if isEndOfQueue(err) {
+		err = nil
+	}
+	if err == nil && r.FailIfEmpty && r.stats.Compilations == 0 {
+		err = ErrEmptyQueue
+	}
+	if len(r.errs) == 0 {
+		return r.stats, err
+	}
+	return r.stats, joinErrors(append(r.errs, err)...)
+}
+
+// process handles the setup, analysis, and teardown of a single compilation.
+func (r *run) process(ctx context.Context, cu Compilation) error {
+	return r.processPrepared(r.dequeue(ctx, cu), cu, nil)
+}
+
+// dequeue returns the context for processing cu, which has just been taken
+// from the queue with the given context.
+func (r *run) dequeue(ctx context.Context, cu Compilation) context.Context {
+	ctx = withScratch(withRequestID(withCompilation(ctx, cu)))
+	if r.OnDequeue != nil {
+		r.OnDequeue(ctx, cu)
+	}
+	return ctx
+}
+
+// processPrepared does the work of process for a compilation that has been
+// dequeued.  If p is non-nil, the compilation has already been prepared.
+func (r *run) processPrepared(ctx context.Context, cu Compilation, p *prepared) error {
+	start := time.Now()
+	ctx, endSpan := r.startSpan(ctx, cu)
+	if p == nil {
+		pp := r.prepare(ctx, cu)
+		p = &pp
+	}
+	var rec Record
+	dequeued := cu
+	cu, err := r.complete(ctx, *p, &rec)
+	var retried bool // whether Teardown requested a retry
+	for pass := 1; err == errTeardownRetry; pass++ {
+		// Teardown asked for the whole compilation to be processed again.
+		if ferr := r.fatalError(); ferr != nil {
+			err = ferr
+			break
+		} else if !r.mayRetry(pass) {
+			err = errors.WithMessage(ErrRetry, "driver: analysis teardown")
+			break
+		}
+		r.countRetry(dequeued)
+		retried = true
+		if r.RetryBackoff != nil {
+			if err = sleepCtx(ctx, r.RetryBackoff(pass)); err != nil {
+				break
+			}
+		}
+		if buf := outputBufferFromContext(ctx); buf != nil {
+			buf.reset() // discard the outputs of the abandoned pass
+		}
+		pp := r.prepare(ctx, dequeued)
+		p, rec = &pp, Record{}
+		cu, err = r.complete(ctx, *p, &rec)
+	}
+	endSpan(err)
+	elapsed := p.elapsed + time.Since(start)
+	var class string
+	if err != nil && err != ErrSkip && r.ClassifyError != nil {
+		class = r.ClassifyError(err)
+	}
+	var inputs inputStats
+	if rec.Attempts > 0 {
+		inputs = r.inputStats(cu.Unit)
+	}
+	rev := r.revision(cu)
+	var index int
+	r.update(func(s *Stats) {
+		index = s.Compilations
+		s.Compilations++
+		s.ProcessTotal += elapsed
+		if rec.Cached {
+			s.CacheHits++
+		}
+		if rec.Attempts > 0 && rec.Outputs == 0 {
+			s.EmptyCompilations++
+		}
+		if rec.Analyzer != "" {
+			if s.CompilationsByAnalyzer == nil {
+				s.CompilationsByAnalyzer = make(map[string]int)
+			}
+			s.CompilationsByAnalyzer[rec.Analyzer]++
+		}
+		s.TotalInputs += inputs.count
+		s.TotalInputBytes += inputs.bytes
+		s.MissingSizeInputs += inputs.missing
+		corpus := cu.Unit.GetVName().GetCorpus()
+		if err != ErrSkip && rev != "" {
+			s.updateCorpus(corpus, func(cs *CorpusStats) { cs.addRevision(rev) })
+		}
+		switch err {
+		case nil:
+			s.Succeeded++
+			s.updateCorpus(corpus, func(cs *CorpusStats) { cs.Succeeded++ })
+			if retried || rec.Attempts > 1 {
+				s.FlakyCompilations = append(s.FlakyCompilations, cu.Unit.GetVName().GetSignature())
+			}
+		case ErrSkip:
+			s.Skipped++
+			if p.unchanged {
+				s.Unchanged++
+			}
+		default:
+			s.Failed++
+			s.updateCorpus(corpus, func(cs *CorpusStats) { cs.Failed++ })
+			if r.ClassifyError != nil {
+				if s.ErrorsByClass == nil {
+					s.ErrorsByClass = make(map[string]int)
+				}
+				s.ErrorsByClass[class]++
+			}
+		}
+		if r.report != nil {
+			rec.Signature = cu.Unit.GetVName().GetSignature()
+			rec.Revision = rev
+			if err != nil {
+				rec.Error = err.Error()
+			}
+			r.report.Records = append(r.report.Records, rec)
+		}
+	})
+	r.metrics().IncrCompilations()
+	if err != nil && err != ErrSkip {
+		r.metrics().IncrFailures()
+	}
+	if r.OnProgress != nil {
+		r.OnProgress(ctx, cu, index, err)
+	}
+	if err == ErrSkip || err == nil {
+		return nil
+	}
+	err = compilationError(cu, err)
+	if r.ContinueOnError && !goerrors.Is(err, ErrFatal) {
+		r.contextWarningf(ctx, "analysis failed: %v", err)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.errs = append(r.errs, err)
+		return nil
+	}
+	return err
+}
+
+// compilationError annotates err with the corpus and signature of cu, so that
+// the failing compilation can be identified from the error returned by Run.
+// The result wraps err, so errors.Is and errors.As see through it.
+func compilationError(cu Compilation, err error) error {
+	vname := cu.Unit.GetVName()
+	return &compilationErr{prefix: fmt.Sprintf("analyzing %s:%s: ", vname.GetCorpus(), vname.GetSignature()), err: err}
+}
+
+// A compilationErr is an error reported for a compilation.
+type compilationErr struct {
+	prefix string // identifies the compilation
+	err    error
+}
+
+func (e *compilationErr) Error() string { return e.prefix + e.err.Error() }
+func (e *compilationErr) Unwrap() error { return e.err }
+
+// A multiError combines several errors, all of which are matched by
+// errors.Is and errors.As.
+type multiError []error
+
+// joinErrors returns an error combining the non-nil errors in errs, or nil if
+// there are none.
+func joinErrors(errs ...error) error {
+	var me multiError
+	for _, err := range errs {
+		if err != nil {
+			me = append(me, err)
+		}
+	}
+	if len(me) == 0 {
+		return nil
+	}
+	return me
+}
+
+func (e multiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Is reports whether any of the errors matches target.
+func (e multiError) Is(target error) bool {
+	for _, err := range e {
+		if goerrors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors that matches target.
+func (e multiError) As(target interface{}) bool {
+	for _, err := range e {
+		if goerrors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// inputStats summarizes the required inputs of a compilation.
+type inputStats struct {
+	count   int   // the number of inputs
+	bytes   int64 // the total size of the inputs of known size
+	missing int   // the number of inputs of unknown size
+}
+
+func (r *run) inputStats(unit *apb.CompilationUnit) inputStats {
+	st := inputStats{count: len(unit.GetRequiredInput())}
+	for _, ri := range unit.GetRequiredInput() {
+		if r.InputSize == nil {
+			st.missing++
+		} else if size, ok := r.InputSize(ri); ok {
+			st.bytes += size
+		} else {
+			st.missing++
+		}
+	}
+	return st
+}
+
+// A prepared compilation has been taken through the steps of processing up
+// to and including Setup.
+type prepared struct {
+	sig   string      // the signature of the compilation as dequeued
+	cu    Compilation // the compilation as modified by SetupTransform, if any
+	err   error       // an error that ended processing, or nil
+	setUp bool        // whether Teardown is needed
+
+	unchanged bool // whether the compilation was skipped for matching PriorDigest
+
+	elapsed time.Duration // the time spent preparing, if done ahead of processing
+}
+
+// prepare checks and sets up cu, reporting the outcome.
+func (r *run) prepare(ctx context.Context, cu Compilation) prepared {
+	p := prepared{sig: cu.Unit.GetVName().GetSignature(), cu: cu}
+	if r.Checkpoint != nil && r.Checkpoint.Done(p.sig) {
+		p.err = ErrSkip
+		return p
+	}
+	if r.unchanged(cu) {
+		p.err, p.unchanged = ErrSkip, true
+		return p
+	}
+	if r.ValidateUnit {
+		if err := validateUnit(cu.Unit); err != nil {
+			p.err = errors.WithMessage(err, "driver: invalid compilation")
+			return p
+		}
+	}
+	if r.FailOnMixedRevision {
+		if err := r.checkRevision(cu); err != nil {
+			p.err = err
+			return p
+		}
+	}
+	ncu, err := r.setup(ctx, cu)
+	switch err {
+	case nil:
+		p.cu, p.setUp = ncu, true
+	case ErrSkip:
+		p.err, p.setUp = ErrSkip, true
+	default:
+		p.err = errors.WithMessage(err, "driver: analysis setup")
+	}
+	return p
+}
+
+// complete finishes the processing of a prepared compilation, returning the
+// compilation as modified by the driver's SetupTransform, if any.  The
+// analysis of the compilation is recorded in rec.
+func (r *run) complete(ctx context.Context, p prepared, rec *Record) (Compilation, error) {
+	cu, err := p.cu, p.err
+	if !p.setUp {
+		return cu, err
+	}
+	if err == nil {
+		ctx = withCompilation(ctx, cu)
+
+		// If ctx ended during setup, don't start the analysis, but do still
+		// tear down whatever Setup allocated.
+		if err = ctx.Err(); err == nil {
+			err = r.checkInputs(ctx, cu)
+		}
+		if err == nil && !r.DryRun && r.MaybeServeCached != nil {
+			if rec.Cached, err = r.MaybeServeCached(ctx, cu, r.output(ctx, cu, &rec.Outputs)); err != nil {
+				err = errors.WithMessage(err, "driver: serving cached outputs")
+			}
+		}
+		needAnalysis := !r.DryRun && !rec.Cached
+		var a analysis.CompilationAnalyzer
+		if err == nil && needAnalysis {
+			if a = r.analyzer(cu); a == nil {
+				err = errors.Errorf("driver: no analyzer for %q", cu.Unit.GetVName().GetSignature())
+			}
+			rec.Analyzer = analyzerIdentity(a)
+		}
+		if err == nil && needAnalysis {
+			err = r.wait(ctx)
+		}
+		if err == nil && needAnalysis {
+			actx, done := r.Controller.track(ctx, p.sig)
+			err = r.analyze(actx, cu, a, rec)
+			if done() {
+				r.contextWarningf(ctx, "analysis of %q was cancelled", p.sig)
+				err = ErrSkip
+			}
+			if err == nil {
+				err = r.checkOutputs(ctx, p.sig, rec.Outputs)
+			}
+			r.metrics().ObserveAnalysisDuration(rec.Duration)
+			ctx = withAnalysisDuration(ctx, rec.Duration)
+		}
+		if (rec.Attempts > 0 || rec.Cached) && r.OutputBoundary != nil {
+			if berr := r.OutputBoundary(ctx, cu); berr != nil {
+				if err == nil {
+					err = errors.WithMessage(berr, "driver: output boundary")
+				} else {
+					r.contextWarningf(ctx, "output boundary failed: %v (analysis error: %v)", berr, err)
+				}
+			}
+		}
+	}
+	if r.FinalizeOutput != nil {
+		if ferr := r.FinalizeOutput(ctx, cu); ferr != nil {
+			if err == nil || err == ErrSkip {
+				err = errors.WithMessage(ferr, "driver: finalizing output")
+			} else {
+				r.contextWarningf(ctx, "finalizing output failed: %v (analysis error: %v)", ferr, err)
+			}
+		}
+	}
+	if terr := r.teardown(ctx, cu, err); terr == ErrRetry {
+		return cu, errTeardownRetry
+	} else if terr != nil {
+		if err == nil || err == ErrSkip {
+			return cu, errors.WithMessage(terr, "driver: analysis teardown")
+		}
+		if r.OnTeardownError != nil {
+			r.OnTeardownError(ctx, cu, terr, err)
+		} else {
+			r.contextWarningf(ctx, "analysis teardown failed: %v (analysis error: %v)", terr, err)
+		}
+	}
+	if err == nil && r.Checkpoint != nil {
+		if err := r.Checkpoint.Mark(p.sig); err != nil {
+			return cu, errors.WithMessage(err, "driver: marking checkpoint")
+		}
+	}
+	return cu, err
+}
+
+// checkOutputs reports whether n outputs from the analysis of the compilation
+// with signature sig satisfy MinOutputsPerCompilation.  An insufficient
+// number is an error if FailOnInsufficientOutput is set, and otherwise
+// logged as a warning.
+func (r *run) checkOutputs(ctx context.Context, sig string, n int) error {
+	if n >= r.MinOutputsPerCompilation {
+		return nil
+	} else if r.FailOnInsufficientOutput {
+		return errors.Errorf("driver: analysis emitted %d outputs, fewer than the minimum of %d", n, r.MinOutputsPerCompilation)
+	}
+	r.contextWarningf(ctx, "analysis of %q emitted %d outputs, fewer than the minimum of %d", sig, n, r.MinOutputsPerCompilation)
+	return nil
+}
+
+// checkInputs reports ErrSkip if the driver's RequiredInputExists rejects any
+// of the required inputs of cu.
+func (r *run) checkInputs(ctx context.Context, cu Compilation) error {
+	if r.RequiredInputExists == nil {
+		return nil
+	}
+	if missing := missingInputs(cu.Unit, r.RequiredInputExists); len(missing) != 0 {
+		r.contextWarningf(ctx, "skipping %q: missing required inputs %q", cu.Unit.GetVName().GetSignature(), missing)
+		return ErrSkip
+	}
+	return nil
+}
+
+// wait blocks until the driver's RateLimit, if any, allows another
+// compilation to be analyzed.
+func (r *run) wait(ctx context.Context) error {
+	if r.RateLimit != nil {
+		return r.RateLimit.Wait(ctx)
+	}
+	return nil
+}
+
+// analyze sends cu to the analyzer, retrying as requested by the
+// AnalysisError callback until it succeeds or MaxRetries is exceeded.  It
+// records the number of attempts made and the total time spent in the
+// analyzer in rec.
+func (r *run) analyze(ctx context.Context, cu Compilation, a analysis.CompilationAnalyzer, rec *Record) error {
+	for attempt := 1; ; attempt++ {
+		actx := withAttempt(ctx, attempt)
+		if r.Semaphore != nil {
+			if err := r.Semaphore.Acquire(actx, 1); err != nil {
+				return err
+			}
+		}
+		start := time.Now()
+		rec.Outputs = 0 // only the outputs of the last attempt are counted
+		stopHeartbeat := r.startHeartbeat(actx, cu)
+		pctx, stopProgress := r.progress(actx, cu)
+		aerr := r.runAnalysis(pctx, cu, a, &rec.Outputs)
+		stopProgress()
+		stopHeartbeat()
+		elapsed := time.Since(start)
+		if r.Semaphore != nil {
+			r.Semaphore.Release(1)
+		}
+		rec.Attempts = attempt
+		rec.Duration += elapsed
+		if ferr := r.fatalError(); ferr != nil {
+			return ferr // neither retried nor passed to AnalysisError
+		}
+
+		var err error
+		if aerr != nil && r.RetryPolicy != nil && r.RetryPolicy(aerr, attempt) && r.mayRetry(attempt) {
+			err = ErrRetry // AnalysisError is not consulted for policy retries
+		} else {
+			err = r.analysisError(withAnalysisDuration(actx, elapsed), cu, aerr)
+			if isRetry(err) && !r.mayRetry(attempt) {
+				return aerr
+			}
+		}
+		if !isRetry(err) {
 			return err
+		} else if err := ctx.Err(); err != nil {
+			return err // don't retry an analysis that has been cancelled
 		}
+		r.countRetry(cu)
+		if delay, ok := retryAfter(err); ok {
+			if err := sleepCtx(ctx, delay); err != nil {
+				return err
+			}
+		} else if r.RetryBackoff != nil {
+			if err := sleepCtx(ctx, r.RetryBackoff(attempt)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkRevision reports an error if the revision of cu differs from the first
+// revision seen for its corpus during the run.
+func (r *run) checkRevision(cu Compilation) error {
+	rev := r.revision(cu)
+	if rev == "" {
+		return nil
+	}
+	corpus := cu.Unit.GetVName().GetCorpus()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.revisions == nil {
+		r.revisions = make(map[string]string)
+	}
+	if first, ok := r.revisions[corpus]; !ok {
+		r.revisions[corpus] = rev
+	} else if rev != first {
+		return errors.Errorf("driver: mixed revisions: compilation has revision %q, but corpus %q has %q", rev, corpus, first)
+	}
+	return nil
+}
+
+// fatalError returns the ErrFatal reported by WriteOutput during the run, or
+// nil if there has been none.
+func (r *run) fatalError() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fatal
+}
+
+// countRetry records a retry of cu in the run's statistics and metrics.
+func (r *run) countRetry(cu Compilation) {
+	r.update(func(s *Stats) {
+		s.Retries++
+		s.updateCorpus(cu.Unit.GetVName().GetCorpus(), func(cs *CorpusStats) { cs.Retries++ })
+	})
+	r.metrics().IncrRetries()
+}
+
+// mayRetry reports whether the driver's limits permit a retry after the
+// given (1-based) attempt.  If so, the retry is charged to the RetryBudget.
+func (r *run) mayRetry(attempt int) bool {
+	if r.MaxRetries > 0 && attempt > r.MaxRetries {
+		return false
+	} else if r.RetryBudget <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.budgetUsed >= r.RetryBudget {
+		return false
 	}
+	r.budgetUsed++
+	return true
 }
 
-func (d *Driver) runAnalysis(ctx context.Context, cu Compilation) error {
-	if d.AnalysisOptions.Timeout != 0 {
+// runAnalysis sends cu to a once, counting the outputs it emits in *outputs.
+func (r *run) runAnalysis(ctx context.Context, cu Compilation, a analysis.CompilationAnalyzer, outputs *int) (err error) {
+	if r.RecoverPanics {
+		defer func() {
+			if p := recover(); p != nil {
+				err = errors.Errorf("analyzer panic: %v\n%s", p, debug.Stack())
+			}
+		}()
+	}
+	if timeout := r.timeout(cu); timeout != 0 {
 		var cancel func()
-		ctx, cancel = context.WithTimeout(ctx, d.AnalysisOptions.Timeout)
+		ctx, cancel = context.WithTimeout(ctx, timeout)
 		defer cancel()
 	}
-	return d.Analyzer.Analyze(ctx, &apb.AnalysisRequest{
+	fds := cu.FileDataService
+	if fds == "" {
+		fds = r.FileDataService
+	}
+	req := &apb.AnalysisRequest{
 		Compilation:     cu.Unit,
-		FileDataService: d.FileDataService,
-		Revision:        cu.Revision,
+		FileDataService: fds,
+		Revision:        r.revision(cu),
 		BuildId:         cu.BuildID,
-	}, d.writeOutput)
+	}
+	if r.AugmentInputs != nil {
+		extra, err := r.AugmentInputs(ctx, cu)
+		if err != nil {
+			return errors.WithMessage(err, "driver: augmenting required inputs")
+		}
+		if len(extra) != 0 {
+			unit := proto.Clone(cu.Unit).(*apb.CompilationUnit)
+			unit.RequiredInput = append(unit.RequiredInput, extra...)
+			req.Compilation = unit
+		}
+	}
+	if r.PreAnalyze != nil {
+		if err := r.PreAnalyze(ctx, cu, req); err != nil {
+			return errors.WithMessage(err, "driver: preparing analysis request")
+		}
+	}
+	out := r.output(ctx, cu, outputs)
+	var c *outputCollector
+	if r.OutputErrorMode == ContinueAndCollect {
+		c = new(outputCollector)
+		out = c.wrap(out)
+	}
+	if r.AsyncOutputBuffer > 0 {
+		err = analyzeAsync(ctx, a, req, out, r.AsyncOutputBuffer)
+	} else {
+		err = a.Analyze(ctx, req, out)
+	}
+	if c != nil {
+		return c.join(err)
+	}
+	return err
+}
+
+// timeout returns the timeout for each analysis of cu, or zero if none.
+func (r *run) timeout(cu Compilation) time.Duration {
+	if r.DeadlineFromUnit != nil {
+		if d, ok := r.DeadlineFromUnit(cu); ok {
+			return d
+		}
+	}
+	return r.AnalysisOptions.Timeout
+}
+
+// output returns the OutputFunc passed to the analyzer for cu, which filters
+// out nil outputs, counts the rest in the run's Stats and in *count, and passes
+// them to the driver's WriteOutput, or to the output buffer attached to ctx,
+// if any.
+func (r *run) output(ctx context.Context, cu Compilation, count *int) analysis.OutputFunc {
+	buf := outputBufferFromContext(ctx)
+	var seen *outputSet
+	if r.DedupOutputs {
+		seen = new(outputSet)
+	}
+	diags := new(diagnosticNodes)
+	sc, _ := ctx.Value(scratchKey{}).(*scratch)
+	return func(ctx context.Context, out *apb.AnalysisOutput) error {
+		// The analyzer is not obliged to pass along the context it was given.
+		if _, ok := CompilationFromContext(ctx); !ok {
+			ctx = withCompilation(ctx, cu)
+			if sc != nil {
+				ctx = context.WithValue(ctx, scratchKey{}, sc)
+			}
+		}
+		if out == nil {
+			if r.FailOnNilOutput {
+				return errors.New("driver: analyzer emitted a nil output")
+			}
+			r.contextWarningf(ctx, "discarding nil output from analysis of %q", cu.Unit.GetVName().GetSignature())
+			return nil
+		}
+		if r.diagnostic(ctx, cu, out, diags) {
+			return nil
+		}
+		if seen != nil && out.GetFinalResult() == nil && !seen.add(out.GetValue()) {
+			r.update(func(s *Stats) { s.DuplicateOutputs++ })
+			return nil
+		}
+		r.update(func(s *Stats) {
+			s.Outputs++
+			*count++
+		})
+		if r.TransformOutput != nil {
+			tout, err := r.TransformOutput(ctx, out)
+			if err != nil {
+				return errors.WithMessage(err, "driver: transforming output")
+			} else if tout == nil {
+				return nil // dropped by the transform
+			}
+			out = tout
+		}
+		if buf != nil {
+			buf.add(out)
+			return nil
+		}
+		return r.emit(ctx, out)
+	}
+}
+
+// emit passes out to the driver's WriteOutput and then to OnOutput.
+func (r *run) emit(ctx context.Context, out *apb.AnalysisOutput) error {
+	err := r.writeOutput(ctx, out)
+	if goerrors.Is(err, ErrFatal) {
+		r.mu.Lock()
+		if r.fatal == nil {
+			r.fatal = err
+		}
+		r.mu.Unlock()
+	}
+	if r.OnOutput != nil {
+		r.OnOutput(ctx, out)
+	}
+	return err
 }
@@ -21,14 +21,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"kythe.io/kythe/go/platform/analysis"
 	"kythe.io/kythe/go/test/testutil"
 
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+
 	apb "kythe.io/kythe/proto/analysis_go_proto"
 	spb "kythe.io/kythe/proto/storage_go_proto"
 )
@@ -204,7 +211,7 @@ func TestDriverAnalyzeError(t *testing.T) {
 		Analyzer:    m,
 		WriteOutput: m.out(),
 	}
-	if err := d.Run(context.Background(), m); err != errFromAnalysis {
+	if err := d.Run(context.Background(), m); !errors.Is(err, errFromAnalysis) {
 		t.Errorf("Expected AnalysisError: %v; found: %v", errFromAnalysis, err)
 	}
 	if len(m.Requests) != 1 { // we didn't analyze the second
@@ -239,6 +246,398 @@ func TestDriverErrorHandler(t *testing.T) {
 	}
 }
 
+func TestDriverMaxRetries(t *testing.T) {
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a", "b", "c"),
+		Compilations: comps("target1", "target2"),
+		AnalyzeError: errFromAnalysis,
+	}
+	d := &Driver{
+		Analyzer:    m,
+		WriteOutput: m.out(),
+		MaxRetries:  3,
+		Context: testContext{
+			analysisError: func(context.Context, Compilation, error) error { return ErrRetry },
+		},
+	}
+	if err := d.Run(context.Background(), m); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected AnalysisError: %v; found: %v", errFromAnalysis, err)
+	}
+	if len(m.Requests) != d.MaxRetries+1 { // the initial attempt plus each retry
+		t.Errorf("Expected %d AnalysisRequests; found %v", d.MaxRetries+1, m.Requests)
+	}
+}
+
+func TestDriverWrappedErrRetry(t *testing.T) {
+	a := &fakeAnalyzer{fail: map[string]error{"target1": errFromAnalysis}}
+	d := &Driver{
+		Analyzer:   a,
+		MaxRetries: 2,
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error {
+				return fmt.Errorf("transient: %w", ErrRetry)
+			},
+		},
+	}
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("target1")...))
+	if !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
+	}
+	if len(a.requests) != d.MaxRetries+1 || stats.Retries != d.MaxRetries {
+		t.Errorf("Expected %d analyses and %d retries; found %d and %d", d.MaxRetries+1, d.MaxRetries, len(a.requests), stats.Retries)
+	}
+}
+
+func TestDriverRetryBudget(t *testing.T) {
+	const n, budget = 10, 5
+	var sigs []string
+	fail := make(map[string]error)
+	for i := 0; i < n; i++ {
+		sig := fmt.Sprintf("t%d", i)
+		sigs = append(sigs, sig)
+		fail[sig] = errFromAnalysis
+	}
+	newDriver := func(a *fakeAnalyzer) *Driver {
+		return &Driver{
+			Analyzer:        a,
+			MaxRetries:      3, // would allow 3*n retries without the budget
+			RetryBudget:     budget,
+			RetryPolicy:     func(error, int) bool { return true },
+			ContinueOnError: true,
+			Logger:          new(testLogger),
+			Context: testContext{
+				analysisError: func(context.Context, Compilation, error) error { return ErrRetry },
+			},
+		}
+	}
+
+	a := &fakeAnalyzer{fail: fail}
+	stats, err := newDriver(a).RunStats(context.Background(), NewSliceQueue(comps(sigs...)...))
+	if !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
+	}
+	if stats.Retries != budget || stats.Failed != n {
+		t.Errorf("Expected %d retries and %d failures; found %d and %d", budget, n, stats.Retries, stats.Failed)
+	}
+	if got, want := len(a.requests), n+budget; got != want {
+		t.Errorf("Expected %d AnalysisRequests; found %d", want, got)
+	}
+
+	// The budget is shared exactly by concurrent workers, which also log
+	// through the same Logger at once.
+	for round := 0; round < 5; round++ {
+		a = &fakeAnalyzer{fail: fail}
+		d := newDriver(a)
+		logger := new(testLogger)
+		d.Logger = logger
+		var stats Stats
+		d.OnComplete = func(_ context.Context, s Stats, _ error) { stats = s }
+		if err := d.RunConcurrent(context.Background(), NewSliceQueue(comps(sigs...)...), 4); !errors.Is(err, errFromAnalysis) {
+			t.Errorf("RunConcurrent: expected error %v; found %v", errFromAnalysis, err)
+		}
+		if got, want := len(a.requests), n+budget; got != want {
+			t.Errorf("RunConcurrent: expected %d AnalysisRequests; found %d", want, got)
+		}
+		if stats.Retries != budget || stats.Failed != n {
+			t.Errorf("RunConcurrent: expected %d retries and %d failures; found %d and %d", budget, n, stats.Retries, stats.Failed)
+		}
+		if len(logger.messages) != n {
+			t.Errorf("RunConcurrent: expected %d warnings; found %d", n, len(logger.messages))
+		}
+	}
+}
+
+func TestDriverMaxRetriesReset(t *testing.T) {
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a", "b", "c"),
+		Compilations: comps("target1", "target2"),
+		AnalyzeError: errFromAnalysis,
+	}
+	const retries = 2
+	failures := make(map[string]int)
+	d := &Driver{
+		Analyzer:    m,
+		WriteOutput: m.out(),
+		MaxRetries:  retries,
+		Context: testContext{
+			analysisError: func(_ context.Context, cu Compilation, err error) error {
+				sig := cu.Unit.GetVName().GetSignature()
+				failures[sig]++
+				if failures[sig] <= retries {
+					return ErrRetry
+				}
+				return nil // give up quietly once the retries are spent
+			},
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
+	if want := len(m.Compilations) * (retries + 1); len(m.Requests) != want {
+		t.Errorf("Expected %d AnalysisRequests; found %d", want, len(m.Requests))
+	}
+	for _, cu := range m.Compilations {
+		sig := cu.Unit.GetVName().GetSignature()
+		if got := failures[sig]; got != retries+1 {
+			t.Errorf("Expected %d failures for %q; found %d", retries+1, sig, got)
+		}
+	}
+}
+
+func TestDriverRetryBackoff(t *testing.T) {
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a", "b", "c"),
+		Compilations: comps("target1"),
+		AnalyzeError: errFromAnalysis,
+	}
+	var attempts []int
+	d := &Driver{
+		Analyzer:    m,
+		WriteOutput: m.out(),
+		MaxRetries:  3,
+		RetryBackoff: func(attempt int) time.Duration {
+			attempts = append(attempts, attempt)
+			return time.Millisecond
+		},
+		Context: testContext{
+			analysisError: func(context.Context, Compilation, error) error { return ErrRetry },
+		},
+	}
+	if err := d.Run(context.Background(), m); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected AnalysisError: %v; found: %v", errFromAnalysis, err)
+	}
+	if want := []int{1, 2, 3}; fmt.Sprint(attempts) != fmt.Sprint(want) {
+		t.Errorf("Expected backoff attempts %v; found %v", want, attempts)
+	}
+}
+
+func TestDriverRetryBackoffCancel(t *testing.T) {
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a", "b", "c"),
+		Compilations: comps("target1", "target2"),
+		AnalyzeError: errFromAnalysis,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &Driver{
+		Analyzer:    m,
+		WriteOutput: m.out(),
+		RetryBackoff: func(int) time.Duration {
+			cancel()
+			return time.Hour
+		},
+		Context: testContext{
+			analysisError: func(context.Context, Compilation, error) error { return ErrRetry },
+		},
+	}
+	if err := d.Run(ctx, m); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected error %v; found %v", context.Canceled, err)
+	}
+	if len(m.Requests) != 1 {
+		t.Errorf("Expected 1 AnalysisRequest; found %v", m.Requests)
+	}
+}
+
+func TestDriverRetryAfter(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	for _, retry := range []error{
+		RetryAfter{Delay: delay},
+		&RetryAfter{Delay: delay},
+		fmt.Errorf("parsing Retry-After: %w", RetryAfter{Delay: delay}),
+	} {
+		checkRetryAfter(t, retry, delay)
+	}
+}
+
+// checkRetryAfter checks that an analysis whose AnalysisError reports retry is
+// retried once, after delay.
+func checkRetryAfter(t *testing.T, retry error, delay time.Duration) {
+	t.Helper()
+	var starts []time.Time
+	d := &Driver{
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			starts = append(starts, time.Now())
+			if len(starts) == 1 {
+				return errFromAnalysis
+			}
+			return nil
+		}),
+		RetryBackoff: func(int) time.Duration {
+			t.Error("RetryBackoff called for RetryAfter")
+			return 0
+		},
+		Context: testContext{
+			analysisError: func(context.Context, Compilation, error) error { return retry },
+		},
+	}
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("target1")...))
+	if err != nil {
+		t.Fatalf("Retry %v: driver error: %v", retry, err)
+	}
+	if len(starts) != 2 {
+		t.Fatalf("Retry %v: expected 2 analyses; found %d", retry, len(starts))
+	}
+	if got := starts[1].Sub(starts[0]); got < delay {
+		t.Errorf("Retry %v: retry began after %v; want at least %v", retry, got, delay)
+	}
+	if stats.Retries != 1 {
+		t.Errorf("Retry %v: expected 1 retry; found %d", retry, stats.Retries)
+	}
+}
+
+func TestDriverRetryAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := &mock{
+		t:            t,
+		Compilations: comps("target1"),
+		AnalyzeError: errFromAnalysis,
+	}
+	d := &Driver{
+		Analyzer: m,
+		Context: testContext{
+			analysisError: func(context.Context, Compilation, error) error {
+				cancel()
+				return RetryAfter{Delay: time.Hour}
+			},
+		},
+	}
+	if err := d.Run(ctx, m); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected error %v; found %v", context.Canceled, err)
+	}
+	if len(m.Requests) != 1 {
+		t.Errorf("Expected 1 AnalysisRequest; found %v", m.Requests)
+	}
+}
+
+func TestDriverRetryAttempt(t *testing.T) {
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a"),
+		Compilations: comps("target1", "target2"),
+		AnalyzeError: errFromAnalysis,
+	}
+	var attempts []int
+	d := &Driver{
+		Analyzer:    m,
+		WriteOutput: m.out(),
+		Context: testContext{
+			analysisError: func(ctx context.Context, _ Compilation, err error) error {
+				n := AttemptFromContext(ctx)
+				attempts = append(attempts, n)
+				if n < 3 {
+					return ErrRetry
+				}
+				return nil
+			},
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
+	if want := []int{1, 2, 3, 1, 2, 3}; fmt.Sprint(attempts) != fmt.Sprint(want) {
+		t.Errorf("Expected attempts %v; found %v", want, attempts)
+	}
+	if n := AttemptFromContext(context.Background()); n != 0 {
+		t.Errorf("AttemptFromContext(background): got %d, want 0", n)
+	}
+}
+
+func TestDriverAnalysisDuration(t *testing.T) {
+	latency := 20 * time.Millisecond
+	a := &fakeAnalyzer{
+		latency: latency,
+		fail:    map[string]error{"target1": errFromAnalysis},
+	}
+	var attempts []time.Duration
+	var total time.Duration
+	d := &Driver{
+		Analyzer: a,
+		Context: testContext{
+			analysisError: func(ctx context.Context, _ Compilation, err error) error {
+				attempts = append(attempts, AnalysisDurationFromContext(ctx))
+				if len(attempts) < 3 {
+					return ErrRetry
+				}
+				return nil
+			},
+			teardown: func(ctx context.Context, _ Compilation) error {
+				total = AnalysisDurationFromContext(ctx)
+				return nil
+			},
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), NewSliceQueue(comps("target1")...)))
+
+	// Allow generous slack above the latency for slow test machines.
+	within := func(got, want time.Duration) bool { return got >= want && got < want+time.Second }
+	if len(attempts) != 3 {
+		t.Fatalf("Expected 3 failed attempts; found %v", attempts)
+	}
+	for i, got := range attempts {
+		if !within(got, latency) {
+			t.Errorf("Attempt %d: duration %v not within tolerance of %v", i+1, got, latency)
+		}
+	}
+	if !within(total, 3*latency) {
+		t.Errorf("Total duration %v not within tolerance of %v", total, 3*latency)
+	}
+}
+
+func TestDriverRetryPolicy(t *testing.T) {
+	errTransient := errors.New("transient failure")
+	errPermanent := errors.New("permanent failure")
+
+	// Each compilation fails with the listed errors in turn, then succeeds.
+	failures := map[string][]error{
+		"flaky":  {errTransient, errTransient},
+		"broken": {errPermanent},
+		"stuck":  {errTransient, errTransient, errTransient, errTransient},
+	}
+	var calls []string
+	a := analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+		sig := req.Compilation.GetVName().GetSignature()
+		calls = append(calls, sig)
+		if errs := failures[sig]; len(errs) != 0 {
+			failures[sig] = errs[1:]
+			return errs[0]
+		}
+		return nil
+	})
+	var handled []error
+	d := &Driver{
+		Analyzer:   a,
+		MaxRetries: 2,
+		RetryPolicy: func(err error, attempt int) bool {
+			return errors.Is(err, errTransient)
+		},
+		ContinueOnError: true,
+		Logger:          new(testLogger),
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error {
+				handled = append(handled, err)
+				return err
+			},
+		},
+	}
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("flaky", "broken", "stuck")...))
+	if !errors.Is(err, errPermanent) || !errors.Is(err, errTransient) {
+		t.Errorf("Expected both permanent and transient errors; found %v", err)
+	}
+
+	wantCalls := []string{"flaky", "flaky", "flaky", "broken", "stuck", "stuck", "stuck"}
+	if fmt.Sprint(calls) != fmt.Sprint(wantCalls) {
+		t.Errorf("Incorrect analyses:\n got: %q\nwant: %q", calls, wantCalls)
+	}
+	// Only errors that were not retried by the policy reach AnalysisError.
+	if wantErrs := []error{errPermanent, errTransient}; fmt.Sprint(handled) != fmt.Sprint(wantErrs) {
+		t.Errorf("Incorrect errors passed to AnalysisError: got %v, want %v", handled, wantErrs)
+	}
+	if stats.Retries != 4 {
+		t.Errorf("Expected 4 retries; found %d", stats.Retries)
+	}
+}
+
 func TestDriverSetup(t *testing.T) {
 	m := &mock{
 		t:            t,
@@ -278,66 +677,895 @@ func TestDriverSetup(t *testing.T) {
 	}
 }
 
-func TestDriverTeardown(t *testing.T) {
-	m := &mock{
-		t:            t,
-		Outputs:      outs("a", "b", "c"),
-		Compilations: comps("target1", "target2"),
+func TestDriverSkip(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests int // expected number of analyses
+		ctx      testContext
+	}{
+		{"Setup", 2, testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				if cu.Unit.GetVName().GetSignature() == "skipped" {
+					return ErrSkip
+				}
+				return nil
+			},
+		}},
+		{"AnalysisError", 3, testContext{
+			analysisError: func(context.Context, Compilation, error) error { return ErrSkip },
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &fakeAnalyzer{fail: map[string]error{"skipped": errFromAnalysis}}
+			m := &mock{
+				t:            t,
+				Compilations: comps("target1", "skipped", "target2"),
+			}
+			var teardowns []string
+			ctx := test.ctx
+			ctx.teardown = func(_ context.Context, cu Compilation) error {
+				teardowns = append(teardowns, cu.Unit.GetVName().GetSignature())
+				return nil
+			}
+			d := &Driver{Analyzer: a, Context: ctx}
+			stats, err := d.RunStats(context.Background(), m)
+			testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+			if want := []string{"target1", "skipped", "target2"}; fmt.Sprint(teardowns) != fmt.Sprint(want) {
+				t.Errorf("Expected Teardown for %v; found %v", want, teardowns)
+			}
+			if len(a.requests) != test.requests {
+				t.Errorf("Expected %d AnalysisRequests; found %d", test.requests, len(a.requests))
+			}
+			if stats.Succeeded != 2 || stats.Skipped != 1 || stats.Failed != 0 {
+				t.Errorf("Incorrect stats: %+v", stats)
+			}
+		})
+	}
+}
+
+func TestDriverOnDequeue(t *testing.T) {
+	var events []string
+	event := func(kind string) func(context.Context, Compilation) error {
+		return func(_ context.Context, cu Compilation) error {
+			events = append(events, kind+":"+cu.Unit.GetVName().GetSignature())
+			return nil
+		}
 	}
-	var teardownIdx int
 	d := &Driver{
-		Analyzer:    m,
-		WriteOutput: m.out(),
+		Analyzer:   new(fakeAnalyzer),
+		Checkpoint: &memCheckpoint{done: map[string]bool{"t2": true}},
+		OnDequeue:  func(ctx context.Context, cu Compilation) { event("dequeue")(ctx, cu) },
 		Context: testContext{
-			teardown: func(_ context.Context, cu Compilation) error {
-				teardownIdx++
+			setup:    event("setup"),
+			teardown: event("teardown"),
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), NewSliceQueue(comps("t1", "t2", "t3")...)))
+
+	want := []string{
+		"dequeue:t1", "setup:t1", "teardown:t1",
+		"dequeue:t2", // skipped by the checkpoint
+		"dequeue:t3", "setup:t3", "teardown:t3",
+	}
+	if !equalStrings(events, want) {
+		t.Errorf("Incorrect events:\n got: %q\nwant: %q", events, want)
+	}
+}
+
+func TestDriverOnProgress(t *testing.T) {
+	a := &fakeAnalyzer{fail: map[string]error{
+		"flaky":   errFromAnalysis,
+		"skipped": errFromAnalysis,
+		"broken":  errFromAnalysis,
+	}}
+	m := &mock{t: t, Compilations: comps("t1", "flaky", "skipped", "t2", "broken", "t3")}
+	var progress []string
+	d := &Driver{
+		Analyzer: a,
+		Context: testContext{
+			teardown: func(context.Context, Compilation) error {
+				progress = append(progress, "teardown")
 				return nil
 			},
+			analysisError: func(_ context.Context, cu Compilation, err error) error {
+				switch cu.Unit.GetVName().GetSignature() {
+				case "flaky":
+					delete(a.fail, "flaky")
+					return ErrRetry
+				case "skipped":
+					return ErrSkip
+				}
+				return err
+			},
+		},
+		OnProgress: func(_ context.Context, cu Compilation, index int, err error) {
+			progress = append(progress, fmt.Sprintf("%d:%s:%v", index, cu.Unit.GetVName().GetSignature(), err))
 		},
 	}
-	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
-	if len(m.Requests) != len(m.Compilations) {
-		t.Errorf("Expected %d AnalysisRequests; found %v", len(m.Compilations), m.Requests)
+	if err := d.Run(context.Background(), m); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
 	}
-	if teardownIdx != len(m.Compilations) {
-		t.Errorf("Expected %d calls to Teardown; found %d", len(m.Compilations), teardownIdx)
+	want := []string{
+		"teardown", "0:t1:<nil>",
+		"teardown", "1:flaky:<nil>",
+		"teardown", "2:skipped:" + ErrSkip.Error(),
+		"teardown", "3:t2:<nil>",
+		"teardown", "4:broken:" + errFromAnalysis.Error(),
+	}
+	if fmt.Sprint(progress) != fmt.Sprint(want) {
+		t.Errorf("Incorrect progress:\n got: %q\nwant: %q", progress, want)
 	}
 }
 
-func TestDriverTimeout(t *testing.T) {
-	timeout := 10 * time.Millisecond
-	m := &mock{
-		t:            t,
-		Outputs:      outs("a", "b", "c"),
-		Compilations: comps("target1", "target2"),
-
-		AnalysisDuration: timeout * 3,
-	}
+func TestDriverContinueOnError(t *testing.T) {
+	errOther := errors.New("another analysis error")
+	a := &fakeAnalyzer{fail: map[string]error{
+		"bad1": errFromAnalysis,
+		"bad2": errOther,
+	}}
+	m := &mock{t: t, Compilations: comps("t1", "bad1", "t2", "bad2", "t3")}
+	var logger testLogger
 	d := &Driver{
-		Analyzer:        m,
-		AnalysisOptions: AnalysisOptions{Timeout: timeout},
-		WriteOutput:     m.out(),
-		Context:         testContext{},
+		Analyzer:        a,
+		ContinueOnError: true,
+		Logger:          &logger,
 	}
-	if err := d.Run(context.Background(), m); !errors.Is(err, context.DeadlineExceeded) {
-		t.Errorf("Expected error %v; found %v", context.DeadlineExceeded, err)
+	stats, err := d.RunStats(context.Background(), m)
+	if !errors.Is(err, errFromAnalysis) || !errors.Is(err, errOther) {
+		t.Errorf("Expected error to include %v and %v; found %v", errFromAnalysis, errOther, err)
 	}
-	if len(m.Requests) != 1 {
-		t.Errorf("Expected 1 AnalysisRequest; found %v", m.Requests)
+	if cerr := (*compilationErr)(nil); !errors.As(err, &cerr) {
+		t.Errorf("Expected error to include a compilation error; found %v", err)
+	}
+	if len(a.requests) != len(m.Compilations) {
+		t.Errorf("Expected %d AnalysisRequests; found %d", len(m.Compilations), len(a.requests))
+	}
+	if stats.Succeeded != 3 || stats.Failed != 2 {
+		t.Errorf("Incorrect stats: %+v", stats)
+	}
+	if len(logger.messages) != 2 {
+		t.Errorf("Expected 2 warnings; found %q", logger.messages)
 	}
 }
 
-func outs(vals ...string) (as []*apb.AnalysisOutput) {
-	for _, val := range vals {
-		as = append(as, &apb.AnalysisOutput{Value: []byte(val)})
-	}
-	return
+func TestDriverContinueOnErrorSuccess(t *testing.T) {
+	m := &mock{t: t, Compilations: comps("t1", "t2")}
+	d := &Driver{Analyzer: new(fakeAnalyzer), ContinueOnError: true}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
 }
 
-func comps(sigs ...string) (cs []Compilation) {
-	for _, sig := range sigs {
-		cs = append(cs, Compilation{
-			Unit:       &apb.CompilationUnit{VName: &spb.VName{Signature: sig}},
+func TestCompilationFromContext(t *testing.T) {
+	if cu, ok := CompilationFromContext(context.Background()); ok {
+		t.Errorf("Unexpected compilation in background context: %v", cu)
+	}
+
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a", "b"),
+		Compilations: comps("target1", "target2"),
+	}
+	var seen []string
+	check := func(ctx context.Context, hook string) {
+		cu, ok := CompilationFromContext(ctx)
+		if !ok {
+			t.Errorf("%s: no compilation in context", hook)
+			return
+		}
+		seen = append(seen, hook+":"+cu.Unit.GetVName().GetSignature())
+	}
+	out := m.out()
+	d := &Driver{
+		Analyzer: m,
+		WriteOutput: func(ctx context.Context, o *apb.AnalysisOutput) error {
+			check(ctx, "output")
+			return out(ctx, o)
+		},
+		Context: testContext{
+			setup: func(ctx context.Context, _ Compilation) error {
+				check(ctx, "setup")
+				return nil
+			},
+			teardown: func(ctx context.Context, _ Compilation) error {
+				check(ctx, "teardown")
+				return nil
+			},
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
+	want := []string{
+		"setup:target1", "output:target1", "output:target1", "teardown:target1",
+		"setup:target2", "output:target2", "output:target2", "teardown:target2",
+	}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("Incorrect compilations:\n got: %q\nwant: %q", seen, want)
+	}
+}
+
+func TestDriverSetupTransform(t *testing.T) {
+	a := &fakeAnalyzer{outputs: outs("a")}
+	m := &mock{t: t, Compilations: comps("target1", "target2")}
+	var outputs, teardowns []string
+	d := &Driver{
+		Analyzer: a,
+		WriteOutput: func(ctx context.Context, _ *apb.AnalysisOutput) error {
+			cu, _ := CompilationFromContext(ctx)
+			outputs = append(outputs, cu.Revision)
+			return nil
+		},
+		SetupTransform: func(_ context.Context, cu Compilation) (Compilation, error) {
+			cu.Revision = "resolved-" + cu.Unit.GetVName().GetSignature()
+			return cu, nil
+		},
+		Context: testContext{
+			setup: func(context.Context, Compilation) error {
+				t.Error("Setup called despite SetupTransform")
+				return nil
+			},
+			teardown: func(_ context.Context, cu Compilation) error {
+				teardowns = append(teardowns, cu.Revision)
+				return nil
+			},
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
+
+	want := []string{"resolved-target1", "resolved-target2"}
+	var revisions []string
+	for _, req := range a.requests {
+		revisions = append(revisions, req.Revision)
+	}
+	for _, got := range [][]string{revisions, outputs, teardowns} {
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Transformed compilation not used: got %q, want %q", got, want)
+		}
+	}
+	for _, cu := range m.Compilations {
+		if cu.Revision != "12345" {
+			t.Errorf("Original compilation was modified: %v", cu)
+		}
+	}
+}
+
+func TestDriverTeardown(t *testing.T) {
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a", "b", "c"),
+		Compilations: comps("target1", "target2"),
+	}
+	var teardownIdx int
+	d := &Driver{
+		Analyzer:    m,
+		WriteOutput: m.out(),
+		Context: testContext{
+			teardown: func(_ context.Context, cu Compilation) error {
+				teardownIdx++
+				return nil
+			},
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
+	if len(m.Requests) != len(m.Compilations) {
+		t.Errorf("Expected %d AnalysisRequests; found %v", len(m.Compilations), m.Requests)
+	}
+	if teardownIdx != len(m.Compilations) {
+		t.Errorf("Expected %d calls to Teardown; found %d", len(m.Compilations), teardownIdx)
+	}
+}
+
+// A testLogger implements the Logger interface by recording its messages.
+// Its messages may be read once the run that logs them has returned.
+type testLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Warningf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func TestDriverLogger(t *testing.T) {
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a"),
+		Compilations: comps("target1"),
+		AnalyzeError: errFromAnalysis,
+	}
+	errTeardown := errors.New("teardown failed")
+	var logger testLogger
+	var id string
+	d := &Driver{
+		Analyzer:    m,
+		WriteOutput: m.out(),
+		Logger:      &logger,
+		Context: testContext{
+			teardown: func(ctx context.Context, _ Compilation) error {
+				id = RequestIDFromContext(ctx)
+				return errTeardown
+			},
+		},
+	}
+	if err := d.Run(context.Background(), m); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected AnalysisError: %v; found: %v", errFromAnalysis, err)
+	}
+	want := fmt.Sprintf("[request %s] analysis teardown failed: %v (analysis error: %v)", id, errTeardown, errFromAnalysis)
+	if len(logger.messages) != 1 || logger.messages[0] != want {
+		t.Errorf("Expected warning %q; found %q", want, logger.messages)
+	}
+}
+
+type panicAnalyzer struct{}
+
+func (panicAnalyzer) Analyze(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+	panic("analyzer exploded")
+}
+
+func TestDriverRecoverPanics(t *testing.T) {
+	m := &mock{t: t, Compilations: comps("target1", "target2")}
+	var analysisErr error
+	d := &Driver{
+		Analyzer:      panicAnalyzer{},
+		RecoverPanics: true,
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error {
+				analysisErr = err
+				return err
+			},
+		},
+	}
+	err := d.Run(context.Background(), m)
+	if err == nil {
+		t.Fatal("Expected error from a panicking analyzer but got none")
+	} else if !errors.Is(err, analysisErr) {
+		t.Errorf("Panic was not reported to AnalysisError: got %v, want %v", analysisErr, err)
+	}
+	msg := err.Error()
+	for _, want := range []string{"analyzer exploded", "panicAnalyzer"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Error %q does not mention %q", msg, want)
+		}
+	}
+}
+
+func TestDriverPreAnalyze(t *testing.T) {
+	a := new(fakeAnalyzer)
+	m := &mock{t: t, Compilations: comps("target1", "target2")}
+	d := &Driver{
+		Analyzer:        a,
+		FileDataService: "default:1234",
+		PreAnalyze: func(_ context.Context, cu Compilation, req *apb.AnalysisRequest) error {
+			req.FileDataService = "custom:5678"
+			req.Revision = "rev-" + cu.Unit.GetVName().GetSignature()
+			return nil
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
+	if len(a.requests) != len(m.Compilations) {
+		t.Fatalf("Expected %d AnalysisRequests; found %d", len(m.Compilations), len(a.requests))
+	}
+	for i, req := range a.requests {
+		want := "rev-" + m.Compilations[i].Unit.GetVName().GetSignature()
+		if req.FileDataService != "custom:5678" || req.Revision != want {
+			t.Errorf("Request %d was not modified: %+v", i, req)
+		}
+	}
+}
+
+func TestDriverFileDataServiceOverride(t *testing.T) {
+	a := new(fakeAnalyzer)
+	cus := comps("default1", "custom", "default2")
+	cus[1].FileDataService = "custom:5678"
+	d := &Driver{
+		Analyzer:        a,
+		FileDataService: "default:1234",
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), NewSliceQueue(cus...)))
+
+	var got []string
+	for _, req := range a.requests {
+		got = append(got, req.FileDataService)
+	}
+	if want := []string{"default:1234", "custom:5678", "default:1234"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Incorrect file data services: got %q, want %q", got, want)
+	}
+}
+
+func TestDriverRevisionFunc(t *testing.T) {
+	cus := comps("explicit", "derived", "none")
+	cus[1].Revision = ""
+	cus[2].Revision = ""
+	revisions := map[string]string{"explicit": "ignored", "derived": "corpus-rev"}
+
+	for _, useFunc := range []bool{false, true} {
+		a := new(fakeAnalyzer)
+		d := &Driver{Analyzer: a}
+		if useFunc {
+			d.RevisionFunc = func(cu Compilation) string { return revisions[cu.Unit.GetVName().GetSignature()] }
+		}
+		report, err := d.RunReport(context.Background(), NewSliceQueue(cus...))
+		testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+		var got, reported []string
+		for _, req := range a.requests {
+			got = append(got, req.Revision)
+		}
+		for _, rec := range report.Records {
+			reported = append(reported, rec.Revision)
+		}
+		want := []string{"12345", "", ""}
+		if useFunc {
+			want = []string{"12345", "corpus-rev", ""}
+		}
+		if !equalStrings(got, want) {
+			t.Errorf("RevisionFunc=%v: incorrect revisions: got %q, want %q", useFunc, got, want)
+		}
+		if !equalStrings(reported, want) {
+			t.Errorf("RevisionFunc=%v: incorrect revisions in report: got %q, want %q", useFunc, reported, want)
+		}
+	}
+	if cus[1].Revision != "" {
+		t.Errorf("RevisionFunc modified the compilation: %+v", cus[1])
+	}
+}
+
+func TestDriverPreAnalyzeError(t *testing.T) {
+	a := new(fakeAnalyzer)
+	m := &mock{t: t, Compilations: comps("target1", "target2")}
+	d := &Driver{
+		Analyzer: a,
+		PreAnalyze: func(context.Context, Compilation, *apb.AnalysisRequest) error {
+			return errFromAnalysis
+		},
+	}
+	if err := d.Run(context.Background(), m); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
+	}
+	if len(a.requests) != 0 {
+		t.Errorf("Unexpected AnalysisRequests: %v", a.requests)
+	}
+}
+
+func TestDriverCancelAfterSetup(t *testing.T) {
+	a := new(fakeAnalyzer)
+	m := &mock{t: t, Compilations: comps("target1", "target2")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var teardowns int
+	d := &Driver{
+		Analyzer: a,
+		Context: testContext{
+			setup: func(context.Context, Compilation) error {
+				cancel()
+				return nil
+			},
+			teardown: func(context.Context, Compilation) error {
+				teardowns++
+				return nil
+			},
+		},
+	}
+	if err := d.Run(ctx, m); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected error %v; found %v", context.Canceled, err)
+	}
+	if len(a.requests) != 0 {
+		t.Errorf("Unexpected AnalysisRequests: %v", a.requests)
+	}
+	if teardowns != 1 {
+		t.Errorf("Expected 1 call to Teardown; found %d", teardowns)
+	}
+}
+
+func TestDriverRateLimit(t *testing.T) {
+	const perSecond = 100
+	a := new(fakeAnalyzer)
+	m := &mock{t: t, Compilations: comps("t1", "t2", "t3", "t4", "t5", "t6")}
+	d := &Driver{
+		Analyzer:  a,
+		RateLimit: rate.NewLimiter(perSecond, 1),
+	}
+	start := time.Now()
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
+
+	// The first compilation uses the initial token; each of the rest waits.
+	min := time.Duration(len(m.Compilations)-1) * time.Second / perSecond
+	if elapsed := time.Since(start); elapsed < min {
+		t.Errorf("Run took %v; expected at least %v", elapsed, min)
+	}
+	if len(a.requests) != len(m.Compilations) {
+		t.Errorf("Expected %d AnalysisRequests; found %d", len(m.Compilations), len(a.requests))
+	}
+}
+
+func TestDriverRateLimitCancel(t *testing.T) {
+	a := new(fakeAnalyzer)
+	m := &mock{t: t, Compilations: comps("t1", "t2")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &Driver{
+		Analyzer:  a,
+		RateLimit: rate.NewLimiter(rate.Every(time.Hour), 1),
+	}
+	time.AfterFunc(10*time.Millisecond, cancel) // while the second compilation waits
+	if err := d.Run(ctx, m); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected error %v; found %v", context.Canceled, err)
+	}
+	if len(a.requests) != 1 {
+		t.Errorf("Expected 1 AnalysisRequest; found %d", len(a.requests))
+	}
+}
+
+func TestDriverCancelDuringAnalysis(t *testing.T) {
+	a := &fakeAnalyzer{latency: time.Hour} // blocks until cancelled
+	m := &mock{t: t, Compilations: comps("target1", "target2")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var teardowns int
+	d := &Driver{
+		Analyzer: a,
+		Context: testContext{
+			setup: func(context.Context, Compilation) error {
+				time.AfterFunc(10*time.Millisecond, cancel)
+				return nil
+			},
+			teardown: func(context.Context, Compilation) error {
+				teardowns++
+				return nil
+			},
+		},
+	}
+	if err := d.Run(ctx, m); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected error %v; found %v", context.Canceled, err)
+	}
+	if teardowns != 1 {
+		t.Errorf("Expected 1 call to Teardown; found %d", teardowns)
+	}
+	if m.idx != 1 {
+		t.Errorf("Expected 1 compilation pulled from the queue; found %d", m.idx)
+	}
+}
+
+func TestDriverCancelContinueOnError(t *testing.T) {
+	a := new(fakeAnalyzer)
+	m := &mock{t: t, Compilations: comps("target1", "target2", "target3")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &Driver{
+		Analyzer:        a,
+		ContinueOnError: true,
+		Context: testContext{
+			teardown: func(context.Context, Compilation) error {
+				cancel()
+				return nil
+			},
+		},
+	}
+	if err := d.Run(ctx, m); err != context.Canceled {
+		t.Errorf("Expected error %v; found %v", context.Canceled, err)
+	}
+	if len(a.requests) != 1 {
+		t.Errorf("Expected 1 AnalysisRequest; found %d", len(a.requests))
+	}
+}
+
+func TestDriverTimeout(t *testing.T) {
+	timeout := 10 * time.Millisecond
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a", "b", "c"),
+		Compilations: comps("target1", "target2"),
+
+		AnalysisDuration: timeout * 3,
+	}
+	d := &Driver{
+		Analyzer:        m,
+		AnalysisOptions: AnalysisOptions{Timeout: timeout},
+		WriteOutput:     m.out(),
+		Context:         testContext{},
+	}
+	if err := d.Run(context.Background(), m); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected error %v; found %v", context.DeadlineExceeded, err)
+	}
+	if len(m.Requests) != 1 {
+		t.Errorf("Expected 1 AnalysisRequest; found %v", m.Requests)
+	}
+}
+
+func TestDriverTeardownAfterTimeout(t *testing.T) {
+	var cleaned []string
+	d := &Driver{
+		Analyzer: analyzerFunc(func(ctx context.Context, _ *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+		AnalysisOptions: AnalysisOptions{Timeout: 10 * time.Millisecond},
+		DeadlineFromUnit: func(cu Compilation) (time.Duration, bool) {
+			return 5 * time.Millisecond, cu.Unit.GetVName().GetSignature() == "t2"
+		},
+		ContinueOnError: true,
+		Logger:          &testLogger{},
+		Context: testContext{
+			teardown: func(ctx context.Context, cu Compilation) error {
+				// Cleanup that depends on a live context still succeeds.
+				if _, ok := ctx.Deadline(); ok {
+					t.Errorf("Teardown of %q has the analysis deadline", cu.Unit.GetVName().GetSignature())
+				}
+				if err := sleepCtx(ctx, time.Millisecond); err != nil {
+					return err
+				}
+				cleaned = append(cleaned, cu.Unit.GetVName().GetSignature())
+				return nil
+			},
+		},
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(comps("t1", "t2")...)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected error %v; found %v", context.DeadlineExceeded, err)
+	}
+	if want := []string{"t1", "t2"}; !equalStrings(cleaned, want) {
+		t.Errorf("Cleaned up compilations: got %q, want %q", cleaned, want)
+	}
+}
+
+func TestDriverDeadlineFromUnit(t *testing.T) {
+	budgets := map[string]time.Duration{
+		"fast": 10 * time.Millisecond,
+		"slow": 60 * time.Millisecond,
+		"none": 0,
+	}
+	const global = 30 * time.Millisecond
+	remaining := make(map[string]time.Duration) // time left when analysis began
+	d := &Driver{
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			sig := req.Compilation.GetVName().GetSignature()
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				remaining[sig] = -1
+				return nil
+			}
+			remaining[sig] = time.Until(deadline)
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+		AnalysisOptions: AnalysisOptions{Timeout: global},
+		DeadlineFromUnit: func(cu Compilation) (time.Duration, bool) {
+			budget, ok := budgets[cu.Unit.GetVName().GetSignature()]
+			return budget, ok
+		},
+		ContinueOnError: true,
+		Logger:          &testLogger{},
+	}
+	err := d.Run(context.Background(), NewSliceQueue(comps("fast", "slow", "global", "none")...))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected error %v; found %v", context.DeadlineExceeded, err)
+	}
+
+	for sig, want := range map[string]time.Duration{
+		"fast":   budgets["fast"],
+		"slow":   budgets["slow"],
+		"global": global,
+	} {
+		// Allow generous slack for slow test machines.
+		if got := remaining[sig]; got > want || got < want-5*time.Millisecond {
+			t.Errorf("Analysis of %q had %v remaining; want about %v", sig, got, want)
+		}
+	}
+	if got := remaining["none"]; got != -1 {
+		t.Errorf("Analysis of %q had a deadline; want none", "none")
+	}
+}
+
+// An analyzerFunc implements the analysis.CompilationAnalyzer interface by
+// calling a function.
+type analyzerFunc func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error
+
+func (f analyzerFunc) Analyze(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+	return f(ctx, req, out)
+}
+
+// A fakeAnalyzer is a CompilationAnalyzer that takes a fixed amount of time to
+// analyze each compilation and emits a fixed set of outputs for each.  It is
+// safe for concurrent use.
+type fakeAnalyzer struct {
+	latency time.Duration
+	outputs []*apb.AnalysisOutput
+	fail    map[string]error // per-signature analysis errors
+
+	mu       sync.Mutex
+	requests []*apb.AnalysisRequest
+	active   int // number of analyses currently running
+	maxUsed  int // highest observed value of active
+}
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (s *fakeAnalyzer) Analyze(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc) error {
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.active++
+	if s.active > s.maxUsed {
+		s.maxUsed = s.active
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(s.latency):
+	}
+	for _, out := range s.outputs {
+		if err := f(ctx, out); err != nil {
+			return err
+		}
+	}
+	return s.fail[req.Compilation.GetVName().GetSignature()]
+}
+
+func TestDriverRunConcurrent(t *testing.T) {
+	const workers = 4
+	latency := 20 * time.Millisecond
+	a := &fakeAnalyzer{latency: latency}
+	m := &mock{
+		t:            t,
+		Compilations: comps("t1", "t2", "t3", "t4", "t5", "t6", "t7", "t8"),
+	}
+	d := &Driver{Analyzer: a}
+
+	start := time.Now()
+	testutil.FatalOnErrT(t, "Driver error: %v", d.RunConcurrent(context.Background(), m, workers))
+	elapsed := time.Since(start)
+
+	if len(a.requests) != len(m.Compilations) {
+		t.Errorf("Expected %d AnalysisRequests; found %d", len(m.Compilations), len(a.requests))
+	}
+	if a.maxUsed < 2 || a.maxUsed > workers {
+		t.Errorf("Expected between 2 and %d concurrent analyses; found %d", workers, a.maxUsed)
+	}
+	if serial := latency * time.Duration(len(m.Compilations)); elapsed >= serial {
+		t.Errorf("Concurrent run took %v; expected less than serial time %v", elapsed, serial)
+	}
+}
+
+func TestDriverRunConcurrentError(t *testing.T) {
+	a := &fakeAnalyzer{
+		latency: time.Millisecond,
+		fail:    map[string]error{"t3": errFromAnalysis},
+	}
+	m := &mock{
+		t:            t,
+		Compilations: comps("t1", "t2", "t3", "t4", "t5", "t6", "t7", "t8"),
+	}
+	d := &Driver{Analyzer: a}
+	if err := d.RunConcurrent(context.Background(), m, 2); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
+	}
+}
+
+func TestDriverRunConcurrentInvalid(t *testing.T) {
+	m := &mock{t: t}
+	if err := (&Driver{Analyzer: m}).RunConcurrent(context.Background(), m, 0); err == nil {
+		t.Error("Expected error for zero workers but got none")
+	}
+	if err := new(Driver).RunConcurrent(context.Background(), m, 1); err == nil {
+		t.Error("Expected error for missing analyzer but got none")
+	}
+}
+
+func TestDriverRunStats(t *testing.T) {
+	a := &fakeAnalyzer{
+		outputs: outs("a", "b"),
+		fail: map[string]error{
+			"flaky":  errFromAnalysis,
+			"broken": errFromAnalysis,
+		},
+	}
+	m := &mock{
+		t:            t,
+		Compilations: comps("t1", "flaky", "t2", "broken", "t3"),
+	}
+	d := &Driver{
+		Analyzer: a,
+		Context: testContext{
+			analysisError: func(_ context.Context, cu Compilation, err error) error {
+				if cu.Unit.GetVName().GetSignature() == "flaky" {
+					delete(a.fail, "flaky") // succeed on the next attempt
+					return ErrRetry
+				}
+				return err
+			},
+		},
+	}
+	stats, err := d.RunStats(context.Background(), m)
+	if !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
+	}
+	want := Stats{
+		Compilations: 4, // t3 is never reached
+		Succeeded:    3,
+		Failed:       1,
+		Retries:      1,
+		Outputs:      2 * 5, // five analyses, including the retry
+
+		FlakyCompilations: []string{"flaky"},
+		PerCorpus: map[string]CorpusStats{
+			"": {Succeeded: 3, Failed: 1, Retries: 1, Revisions: []string{"12345"}},
+		},
+	}
+	if stats.TotalDuration <= 0 || stats.ProcessTotal <= 0 {
+		t.Errorf("Expected a positive TotalDuration and ProcessTotal; found %v, %v", stats.TotalDuration, stats.ProcessTotal)
+	}
+	if stats.QueueWaitTotal < 0 {
+		t.Errorf("Expected a non-negative QueueWaitTotal; found %v", stats.QueueWaitTotal)
+	}
+	stats.TotalDuration, stats.ProcessTotal, stats.QueueWaitTotal = 0, 0, 0
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("Incorrect stats:\n got: %+v\nwant: %+v", stats, want)
+	}
+}
+
+func TestDriverTimeoutHooks(t *testing.T) {
+	timeout := 10 * time.Millisecond
+	a := &fakeAnalyzer{latency: time.Hour} // blocks until the timeout
+	m := &mock{
+		t:            t,
+		Compilations: comps("target1", "target2"),
+	}
+	checkParent := func(ctx context.Context, hook string) {
+		if _, ok := ctx.Deadline(); ok {
+			t.Errorf("%s: context unexpectedly has a deadline", hook)
+		} else if err := ctx.Err(); err != nil {
+			t.Errorf("%s: context unexpectedly done: %v", hook, err)
+		}
+	}
+	var analysisErrs []error
+	d := &Driver{
+		Analyzer:        a,
+		AnalysisOptions: AnalysisOptions{Timeout: timeout},
+		Context: testContext{
+			setup: func(ctx context.Context, _ Compilation) error {
+				checkParent(ctx, "Setup")
+				return nil
+			},
+			teardown: func(ctx context.Context, _ Compilation) error {
+				checkParent(ctx, "Teardown")
+				return nil
+			},
+			analysisError: func(_ context.Context, _ Compilation, err error) error {
+				analysisErrs = append(analysisErrs, err)
+				return nil // abandon the compilation and carry on
+			},
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
+	if len(a.requests) != len(m.Compilations) {
+		t.Errorf("Expected %d AnalysisRequests; found %d", len(m.Compilations), len(a.requests))
+	}
+	if len(analysisErrs) != len(m.Compilations) {
+		t.Fatalf("Expected %d analysis errors; found %v", len(m.Compilations), analysisErrs)
+	}
+	for _, err := range analysisErrs {
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected analysis error %v; found %v", context.DeadlineExceeded, err)
+		}
+	}
+}
+
+func outs(vals ...string) (as []*apb.AnalysisOutput) {
+	for _, val := range vals {
+		as = append(as, &apb.AnalysisOutput{Value: []byte(val)})
+	}
+	return
+}
+
+func comps(sigs ...string) (cs []Compilation) {
+	for _, sig := range sigs {
+		cs = append(cs, Compilation{
+			Unit:       &apb.CompilationUnit{VName: &spb.VName{Signature: sig}},
 			Revision:   "12345",
 			UnitDigest: "digest:" + sig,
 			BuildID:    buildID,
@@ -345,3 +1573,694 @@ func comps(sigs ...string) (cs []Compilation) {
 	}
 	return
 }
+
+func TestDriverMaxRunDuration(t *testing.T) {
+	const latency = 20 * time.Millisecond
+	for _, workers := range []int{0, 2} {
+		a := &fakeAnalyzer{latency: latency}
+		var tornDown int
+		var mu sync.Mutex
+		d := &Driver{
+			Analyzer:       a,
+			MaxRunDuration: 3 * latency,
+			Context: testContext{
+				teardown: func(ctx context.Context, cu Compilation) error {
+					if err := ctx.Err(); err != nil {
+						t.Errorf("Teardown of %q has an ended context: %v", cu.Unit.GetVName().GetSignature(), err)
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					tornDown++
+					return nil
+				},
+			},
+		}
+		q := NewRepeatQueue(comps("t")[0], 100)
+		var err error
+		if workers == 0 {
+			err = d.Run(context.Background(), q)
+		} else {
+			err = d.RunConcurrent(context.Background(), q, workers)
+		}
+		if err != ErrRunBudgetExceeded {
+			t.Errorf("Workers=%d: expected error %v; found %v", workers, ErrRunBudgetExceeded, err)
+		}
+		if n := len(a.requests); n == 0 || n >= 20 {
+			t.Errorf("Workers=%d: expected the run to stop early; found %d analyses", workers, n)
+		}
+		if tornDown != len(a.requests) {
+			t.Errorf("Workers=%d: %d analyses but %d teardowns", workers, len(a.requests), tornDown)
+		}
+	}
+}
+
+func TestDriverMaxRunDurationBlockedQueue(t *testing.T) {
+	const budget = 20 * time.Millisecond
+	for _, mode := range []string{"Run", "RunIdle", "Prefetch", "RunConcurrent"} {
+		// The queue delivers one compilation, whose analysis outlasts the
+		// budget, and then never yields another.  In RunIdle, it never yields
+		// any.
+		ch := make(chan Compilation, 1)
+		if mode != "RunIdle" {
+			ch <- comps("slow")[0]
+		}
+		d := &Driver{
+			Analyzer: analyzerFunc(func(ctx context.Context, _ *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+				return sleepCtx(ctx, 2*budget)
+			}),
+			MaxRunDuration: budget,
+		}
+		// The outer deadline only guards against the run hanging.
+		ctx, cancel := context.WithTimeout(context.Background(), 20*budget)
+		var err error
+		switch mode {
+		case "Run", "RunIdle":
+			err = d.Run(ctx, NewChannelQueue(ch))
+		case "Prefetch":
+			d.Prefetch = 2
+			err = d.Run(ctx, NewChannelQueue(ch))
+		case "RunConcurrent":
+			err = d.RunConcurrent(ctx, NewChannelQueue(ch), 2)
+		}
+		cancel()
+		if err != ErrRunBudgetExceeded {
+			t.Errorf("%s: expected error %v; found %v", mode, ErrRunBudgetExceeded, err)
+		}
+	}
+}
+
+func TestDriverPerCorpusStats(t *testing.T) {
+	cus := comps("a1", "a2", "a3", "b1", "b2")
+	for _, cu := range cus {
+		cu.Unit.VName.Corpus = cu.Unit.VName.Signature[:1]
+	}
+	retried := make(map[string]bool)
+	d := &Driver{
+		Analyzer: &fakeAnalyzer{fail: map[string]error{
+			"a2": errFromAnalysis,
+			"b1": errFromAnalysis,
+			"b2": errFromAnalysis,
+		}},
+		Context: testContext{
+			analysisError: func(_ context.Context, cu Compilation, err error) error {
+				// Retry each failure once before giving up.
+				if sig := cu.Unit.GetVName().GetSignature(); !retried[sig] {
+					retried[sig] = true
+					return ErrRetry
+				}
+				return err
+			},
+		},
+		ContinueOnError: true,
+		Logger:          &testLogger{},
+	}
+	stats, _ := d.RunStats(context.Background(), NewSliceQueue(cus...))
+	want := map[string]CorpusStats{
+		"a": {Succeeded: 2, Failed: 1, Retries: 1, Revisions: []string{"12345"}},
+		"b": {Failed: 2, Retries: 2, Revisions: []string{"12345"}},
+	}
+	if !reflect.DeepEqual(stats.PerCorpus, want) {
+		t.Errorf("Incorrect per-corpus stats:\n got: %+v\nwant: %+v", stats.PerCorpus, want)
+	}
+}
+
+func TestDriverMixedRevision(t *testing.T) {
+	units := func() []Compilation {
+		cus := comps("a1", "a2", "a3", "b1", "b2")
+		for _, cu := range cus {
+			cu.Unit.VName.Corpus = cu.Unit.VName.Signature[:1]
+		}
+		cus[1].Revision = "r2" // corpus a is inconsistent
+		cus[2].Revision = ""   // falls back to RevisionFunc
+		return cus
+	}
+	revisionFunc := func(Compilation) string { return "r3" }
+
+	for _, fail := range []bool{false, true} {
+		a := new(fakeAnalyzer)
+		d := &Driver{
+			Analyzer:            a,
+			RevisionFunc:        revisionFunc,
+			FailOnMixedRevision: fail,
+			ContinueOnError:     true,
+			Logger:              &testLogger{},
+		}
+		report, err := d.RunReport(context.Background(), NewSliceQueue(units()...))
+		if !fail {
+			if err != nil {
+				t.Errorf("FailOnMixedRevision=false: unexpected error: %v", err)
+			}
+			want := map[string][]string{"a": {"12345", "r2", "r3"}, "b": {"12345"}}
+			for corpus, revs := range want {
+				if got := report.Totals.PerCorpus[corpus].Revisions; !equalStrings(got, revs) {
+					t.Errorf("Revisions of corpus %q: got %q, want %q", corpus, got, revs)
+				}
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), `corpus "a" has "12345"`) {
+			t.Errorf("FailOnMixedRevision=true: expected a mixed revision error; found %v", err)
+		}
+		if got, want := analyzed(a), []string{"a1", "b1", "b2"}; !equalStrings(got, want) {
+			t.Errorf("FailOnMixedRevision=true: analyzed %q, want %q", got, want)
+		}
+	}
+
+	// Consistent revisions are accepted.
+	d := &Driver{Analyzer: new(fakeAnalyzer), FailOnMixedRevision: true}
+	cus := comps("a1", "a2")
+	cus[1].Unit.VName.Corpus = "other"
+	cus[1].Revision = "r2"
+	if err := d.Run(context.Background(), NewSliceQueue(append(cus, comps("a3")...)...)); err != nil {
+		t.Errorf("Consistent revisions: unexpected error: %v", err)
+	}
+}
+
+func TestDriverDryRun(t *testing.T) {
+	var setups, teardowns, progress int
+	analyzer := analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+		t.Error("Analyzer called in a dry run")
+		return nil
+	})
+	for _, a := range []analysis.CompilationAnalyzer{analyzer, nil} {
+		withAnalyzer := a != nil
+		setups, teardowns, progress = 0, 0, 0
+		d := &Driver{
+			Analyzer: a,
+			DryRun:   true,
+			WriteOutput: func(context.Context, *apb.AnalysisOutput) error {
+				t.Error("WriteOutput called in a dry run")
+				return nil
+			},
+			OnProgress: func(context.Context, Compilation, int, error) { progress++ },
+			Context: testContext{
+				setup: func(context.Context, Compilation) error {
+					setups++
+					return nil
+				},
+				teardown: func(context.Context, Compilation) error {
+					teardowns++
+					return nil
+				},
+			},
+		}
+		stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("t1", "t2", "t3")...))
+		testutil.FatalOnErrT(t, "Driver error: %v", err)
+		if setups != 3 || teardowns != 3 || progress != 3 {
+			t.Errorf("Analyzer=%v: got %d setups, %d teardowns, %d progress calls; want 3 of each", withAnalyzer, setups, teardowns, progress)
+		}
+		if stats.Succeeded != 3 {
+			t.Errorf("Analyzer=%v: expected 3 successes; found %+v", withAnalyzer, stats)
+		}
+	}
+}
+
+func TestDriverErrorIdentifiesCompilation(t *testing.T) {
+	cus := comps("good", "bad")
+	cus[1].Unit.VName.Corpus = "corpus"
+	errFailed := fmt.Errorf("still failing: %w", errFromAnalysis)
+	for _, continueOnError := range []bool{false, true} {
+		d := &Driver{
+			Analyzer:        &fakeAnalyzer{fail: map[string]error{"bad": errFailed}},
+			ContinueOnError: continueOnError,
+			Logger:          new(testLogger),
+		}
+		err := d.Run(context.Background(), NewSliceQueue(cus...))
+		if err == nil {
+			t.Fatalf("ContinueOnError=%v: expected an error", continueOnError)
+		}
+		if msg := err.Error(); !strings.Contains(msg, "analyzing corpus:bad: still failing") {
+			t.Errorf("ContinueOnError=%v: error does not identify the compilation: %v", continueOnError, err)
+		}
+		if !errors.Is(err, errFromAnalysis) {
+			t.Errorf("ContinueOnError=%v: error does not wrap %v: %v", continueOnError, errFromAnalysis, err)
+		}
+	}
+}
+
+func TestDriverTeardownResult(t *testing.T) {
+	results := make(map[string]error)
+	var contextTeardowns int
+	d := &Driver{
+		Analyzer: &fakeAnalyzer{fail: map[string]error{"bad": errFromAnalysis}},
+		Context: testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				if cu.Unit.GetVName().GetSignature() == "skip" {
+					return ErrSkip
+				}
+				return nil
+			},
+			teardown: func(context.Context, Compilation) error {
+				contextTeardowns++
+				return nil
+			},
+		},
+		TeardownResult: func(_ context.Context, cu Compilation, err error) error {
+			results[cu.Unit.GetVName().GetSignature()] = err
+			return nil
+		},
+		ContinueOnError: true,
+		Logger:          new(testLogger),
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(comps("good", "bad", "skip")...)); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
+	}
+	if len(results) != 3 {
+		t.Errorf("Expected TeardownResult for 3 compilations; found %v", results)
+	}
+	if err, ok := results["good"]; !ok || err != nil {
+		t.Errorf("TeardownResult for a successful analysis: got %v, want nil", err)
+	}
+	if err := results["bad"]; !errors.Is(err, errFromAnalysis) {
+		t.Errorf("TeardownResult for a failed analysis: got %v, want %v", err, errFromAnalysis)
+	}
+	if err := results["skip"]; err != ErrSkip {
+		t.Errorf("TeardownResult for a skipped compilation: got %v, want %v", err, ErrSkip)
+	}
+	if contextTeardowns != 0 {
+		t.Errorf("Context Teardown was called %d times despite TeardownResult", contextTeardowns)
+	}
+}
+
+func TestDriverQueueWaitAndProcessTotals(t *testing.T) {
+	const (
+		queueDelay   = 20 * time.Millisecond
+		analyzeDelay = 30 * time.Millisecond
+		n            = 3
+	)
+	cus := comps("t1", "t2", "t3")
+	var next int
+	slowQueue := NewFuncQueue(func(context.Context) (Compilation, error) {
+		if next == len(cus) {
+			return Compilation{}, io.EOF
+		}
+		time.Sleep(queueDelay)
+		next++
+		return cus[next-1], nil
+	})
+	d := &Driver{Analyzer: &fakeAnalyzer{latency: analyzeDelay}}
+	stats, err := d.RunStats(context.Background(), slowQueue)
+	if err != nil {
+		t.Fatalf("Driver error: %v", err)
+	}
+
+	// Processing happens inside the queue's callback, but must not be
+	// attributed to the queue, and vice versa.  Each total must be less than
+	// the sum of both delays, with the remainder allowed as slack.
+	if lo, hi := n*queueDelay, n*(queueDelay+analyzeDelay); stats.QueueWaitTotal < lo || stats.QueueWaitTotal >= hi {
+		t.Errorf("QueueWaitTotal: got %v, want in [%v, %v)", stats.QueueWaitTotal, lo, hi)
+	}
+	if lo, hi := n*analyzeDelay, n*(queueDelay+analyzeDelay); stats.ProcessTotal < lo || stats.ProcessTotal >= hi {
+		t.Errorf("ProcessTotal: got %v, want in [%v, %v)", stats.ProcessTotal, lo, hi)
+	}
+}
+
+func TestRequestIDFromContext(t *testing.T) {
+	if id := RequestIDFromContext(context.Background()); id != "" {
+		t.Errorf("RequestIDFromContext outside a driver: got %q, want \"\"", id)
+	}
+
+	var mu sync.Mutex
+	ids := make(map[string]map[string]bool) // signature → request IDs seen
+	record := func(ctx context.Context) {
+		mu.Lock()
+		defer mu.Unlock()
+		cu, _ := CompilationFromContext(ctx)
+		sig := cu.Unit.GetVName().GetSignature()
+		if ids[sig] == nil {
+			ids[sig] = make(map[string]bool)
+		}
+		ids[sig][RequestIDFromContext(ctx)] = true
+	}
+	d := &Driver{
+		Analyzer:  &fakeAnalyzer{outputs: outs("a")},
+		OnDequeue: func(ctx context.Context, _ Compilation) { record(ctx) },
+		Context: testContext{
+			setup: func(ctx context.Context, _ Compilation) error {
+				record(ctx)
+				return nil
+			},
+			teardown: func(ctx context.Context, _ Compilation) error {
+				record(ctx)
+				return nil
+			},
+		},
+		WriteOutput: func(ctx context.Context, _ *apb.AnalysisOutput) error {
+			record(ctx)
+			return nil
+		},
+	}
+	sigs := []string{"t1", "t2", "t3", "t4"}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.RunConcurrent(context.Background(), NewSliceQueue(comps(sigs...)...), 2))
+
+	seen := make(map[string]string) // id → signature
+	for _, sig := range sigs {
+		if len(ids[sig]) != 1 {
+			t.Errorf("Compilation %q: expected one request ID across hooks; found %v", sig, ids[sig])
+			continue
+		}
+		for id := range ids[sig] {
+			if id == "" {
+				t.Errorf("Compilation %q has no request ID", sig)
+			} else if other, ok := seen[id]; ok {
+				t.Errorf("Compilations %q and %q share request ID %q", other, sig, id)
+			}
+			seen[id] = sig
+		}
+	}
+}
+
+func TestDriverTeardownRetry(t *testing.T) {
+	var setups, teardowns int
+	a := new(fakeAnalyzer)
+	d := &Driver{
+		Analyzer: a,
+		Context: testContext{
+			setup: func(context.Context, Compilation) error {
+				setups++
+				return nil
+			},
+			teardown: func(_ context.Context, cu Compilation) error {
+				teardowns++
+				if cu.Unit.GetVName().GetSignature() == "corrupt" && teardowns == 1 {
+					return ErrRetry // verification failed once
+				}
+				return nil
+			},
+		},
+	}
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("corrupt", "t2")...))
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	if got, want := analyzed(a), []string{"corrupt", "corrupt", "t2"}; !equalStrings(got, want) {
+		t.Errorf("Analyzed compilations: got %q, want %q", got, want)
+	}
+	if setups != 3 || teardowns != 3 {
+		t.Errorf("Expected 3 setups and teardowns; found %d and %d", setups, teardowns)
+	}
+	if stats.Retries != 1 || stats.Succeeded != 2 || stats.Compilations != 2 {
+		t.Errorf("Expected 2 compilations with 1 retry; found %+v", stats)
+	}
+
+	// A Teardown that always requests a retry is bounded by MaxRetries.
+	a = new(fakeAnalyzer)
+	d = &Driver{
+		Analyzer:   a,
+		MaxRetries: 2,
+		TeardownResult: func(context.Context, Compilation, error) error {
+			return ErrRetry
+		},
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(comps("t1")...)); !errors.Is(err, ErrRetry) {
+		t.Errorf("Expected error %v; found %v", ErrRetry, err)
+	}
+	if len(a.requests) != 3 {
+		t.Errorf("Expected 3 analyses; found %d", len(a.requests))
+	}
+}
+
+func TestDriverTeardownRetryOrderedOutput(t *testing.T) {
+	var mu sync.Mutex
+	var written []string
+	retried := false
+	d := &Driver{
+		Analyzer:      &fakeAnalyzer{outputs: outs("a", "b")},
+		OrderedOutput: true,
+		TeardownResult: func(_ context.Context, cu Compilation, _ error) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if cu.Unit.GetVName().GetSignature() == "t1" && !retried {
+				retried = true
+				return ErrRetry
+			}
+			return nil
+		},
+		WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+			mu.Lock()
+			defer mu.Unlock()
+			written = append(written, string(out.Value))
+			return nil
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.RunConcurrent(context.Background(), NewSliceQueue(comps("t1", "t2")...), 2))
+	if want := []string{"a", "b", "a", "b"}; !equalStrings(written, want) {
+		t.Errorf("Written outputs: got %q, want %q", written, want)
+	}
+}
+
+func TestDriverOnTeardownError(t *testing.T) {
+	errTeardown := errors.New("teardown failed")
+	var logger testLogger
+	var calls int
+	d := &Driver{
+		Analyzer: &fakeAnalyzer{fail: map[string]error{"bad": errFromAnalysis}},
+		Logger:   &logger,
+		Context: testContext{
+			teardown: func(context.Context, Compilation) error { return errTeardown },
+		},
+		OnTeardownError: func(ctx context.Context, cu Compilation, teardownErr, analysisErr error) {
+			calls++
+			if sig := cu.Unit.GetVName().GetSignature(); sig != "bad" {
+				t.Errorf("OnTeardownError called for %q", sig)
+			}
+			if teardownErr != errTeardown {
+				t.Errorf("OnTeardownError: got teardown error %v, want %v", teardownErr, errTeardown)
+			}
+			if analysisErr != errFromAnalysis {
+				t.Errorf("OnTeardownError: got analysis error %v, want %v", analysisErr, errFromAnalysis)
+			}
+		},
+	}
+	err := d.Run(context.Background(), NewSliceQueue(comps("bad")...))
+	if !errors.Is(err, errFromAnalysis) || errors.Is(err, errTeardown) {
+		t.Errorf("Expected the analysis error %v; found %v", errFromAnalysis, err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 call to OnTeardownError; found %d", calls)
+	}
+	if len(logger.messages) != 0 {
+		t.Errorf("Expected no warnings when OnTeardownError is set; found %q", logger.messages)
+	}
+
+	// After a successful analysis, the Teardown error is reported directly.
+	calls = 0
+	if err := d.Run(context.Background(), NewSliceQueue(comps("good")...)); !errors.Is(err, errTeardown) {
+		t.Errorf("Expected the teardown error %v; found %v", errTeardown, err)
+	}
+	if calls != 0 {
+		t.Errorf("OnTeardownError called after a successful analysis")
+	}
+}
+
+func TestDriverTeardownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var cleaned []string
+	var mu sync.Mutex // the abandoned Teardown may still be running
+	logger := new(testLogger)
+	d := &Driver{
+		Analyzer: &fakeAnalyzer{},
+		Context: testContext{
+			teardown: func(ctx context.Context, cu Compilation) error {
+				switch cu.Unit.GetVName().GetSignature() {
+				case "stuck":
+					<-release // ignores its context altogether
+				case "slow":
+					<-ctx.Done()
+					return ctx.Err()
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				cleaned = append(cleaned, cu.Unit.GetVName().GetSignature())
+				return nil
+			},
+		},
+		TeardownTimeout: 10 * time.Millisecond,
+		Logger:          logger,
+	}
+	start := time.Now()
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("stuck", "slow", "quick")...))
+	if err != nil {
+		t.Errorf("RunStats: unexpected error: %v", err)
+	}
+	// Each stuck Teardown holds up the run for TeardownTimeout and no longer.
+	if elapsed := time.Since(start); elapsed > 2*d.TeardownTimeout+50*time.Millisecond {
+		t.Errorf("Run took %v; want about %v", elapsed, 2*d.TeardownTimeout)
+	}
+	if stats.Succeeded != 3 || stats.TeardownTimeouts != 2 {
+		t.Errorf("Stats: got %d succeeded and %d teardown timeouts, want 3 and 2", stats.Succeeded, stats.TeardownTimeouts)
+	}
+	if len(logger.messages) != 2 {
+		t.Errorf("Expected 2 warnings of teardown timeouts; found %q", logger.messages)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"quick"}; !equalStrings(cleaned, want) {
+		t.Errorf("Cleaned up compilations: got %q, want %q", cleaned, want)
+	}
+}
+
+func TestDriverOnComplete(t *testing.T) {
+	type call struct {
+		stats Stats
+		err   error
+	}
+	var calls []call
+	onComplete := func(_ context.Context, stats Stats, err error) { calls = append(calls, call{stats, err}) }
+
+	// A successful run.
+	var q *resettingQueue
+	d := &Driver{Analyzer: new(fakeAnalyzer), OnComplete: func(ctx context.Context, stats Stats, err error) {
+		if q != nil && q.closed == 0 {
+			t.Error("OnComplete was called before the queue was closed")
+		}
+		onComplete(ctx, stats, err)
+	}}
+	q = &resettingQueue{SliceQueue: NewSliceQueue(comps("t1", "t2")...)}
+	testutil.FatalOnErrT(t, "Run error: %v", d.Run(context.Background(), q))
+	if len(calls) != 1 || calls[0].err != nil || calls[0].stats.Succeeded != 2 {
+		t.Errorf("After success: got calls %+v, want one with 2 successes", calls)
+	}
+	if q.closed != 1 {
+		t.Errorf("Expected the queue to be closed once; found %d", q.closed)
+	}
+
+	// A failed run, ending early.
+	calls = nil
+	d.Analyzer = &fakeAnalyzer{fail: map[string]error{"t2": errFromAnalysis}}
+	err := d.RunConcurrent(context.Background(), NewSliceQueue(comps("t1", "t2")...), 1)
+	if len(calls) != 1 || calls[0].err != err || !errors.Is(err, errFromAnalysis) {
+		t.Fatalf("After failure: got calls %+v, want one with error %v", calls, err)
+	}
+	if s := calls[0].stats; s.Succeeded != 1 || s.Failed != 1 {
+		t.Errorf("After failure: got stats %+v, want one success and one failure", s)
+	}
+
+	// A run that cannot start.
+	calls = nil
+	d.Analyzer = nil
+	if err := d.Run(context.Background(), NewSliceQueue()); err == nil || len(calls) != 1 || calls[0].err != err {
+		t.Errorf("Without an analyzer: got calls %+v for error %v", calls, err)
+	}
+}
+
+func TestDriverSharedSemaphore(t *testing.T) {
+	// Both runs share the analyzer, which records the peak overlap.
+	a := &fakeAnalyzer{latency: time.Millisecond}
+	sem := semaphore.NewWeighted(1)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		d := &Driver{Analyzer: a, Semaphore: sem}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.RunConcurrent(context.Background(), NewRepeatQueue(comps("t")[0], 5), 3); err != nil {
+				t.Errorf("RunConcurrent error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(a.requests); n != 10 {
+		t.Errorf("Expected 10 analyses; found %d", n)
+	}
+	if a.maxUsed != 1 {
+		t.Errorf("Expected analyses never to overlap; found %d at once", a.maxUsed)
+	}
+
+	// A cancelled run does not wait for the semaphore.
+	testutil.FatalOnErrT(t, "Acquire error: %v", sem.Acquire(context.Background(), 1))
+	defer sem.Release(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	d := &Driver{Analyzer: a, Semaphore: sem}
+	if err := d.Run(ctx, NewSliceQueue(comps("t")...)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected error %v; found %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestScratchFromContext(t *testing.T) {
+	if SetScratch(context.Background(), "x") || ScratchFromContext(context.Background()) != nil {
+		t.Error("Scratch value stored outside a Driver")
+	}
+
+	// The analyzer drops its context, which must not lose the scratch value.
+	detached := analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+		return out(context.Background(), &apb.AnalysisOutput{Value: []byte(req.Compilation.GetVName().GetSignature())})
+	})
+	for _, ordered := range []bool{false, true} {
+		var mu sync.Mutex
+		var problems []string
+		check := func(ctx context.Context, where, sig string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if got, _ := ScratchFromContext(ctx).(string); got != "tmp/"+sig {
+				problems = append(problems, fmt.Sprintf("%s of %s: scratch %q", where, sig, got))
+			}
+		}
+		var teardowns int32
+		d := &Driver{
+			Analyzer:      TeeAnalyzer(new(fakeAnalyzer), detached),
+			OrderedOutput: ordered,
+			Context: testContext{
+				setup: func(ctx context.Context, cu Compilation) error {
+					if !SetScratch(ctx, "tmp/"+cu.Unit.GetVName().GetSignature()) {
+						t.Error("SetScratch failed in Setup")
+					}
+					return nil
+				},
+				teardown: func(ctx context.Context, cu Compilation) error {
+					atomic.AddInt32(&teardowns, 1)
+					check(ctx, "Teardown", cu.Unit.GetVName().GetSignature())
+					return nil
+				},
+			},
+			WriteOutput: func(ctx context.Context, out *apb.AnalysisOutput) error {
+				check(ctx, "WriteOutput", string(out.Value))
+				return nil
+			},
+		}
+		if err := d.RunConcurrent(context.Background(), NewSliceQueue(comps("t1", "t2", "t3", "t4")...), 2); err != nil {
+			t.Fatalf("RunConcurrent error: %v", err)
+		}
+		if len(problems) != 0 || teardowns != 4 {
+			t.Errorf("OrderedOutput=%v: %d teardowns, problems: %q", ordered, teardowns, problems)
+		}
+	}
+}
+
+func TestDriverFlakyCompilations(t *testing.T) {
+	failures := map[string]int{"flaky": 1, "broken": 100}
+	var redone bool
+	d := &Driver{
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			if sig := req.Compilation.GetVName().GetSignature(); failures[sig] > 0 {
+				failures[sig]--
+				return errFromAnalysis
+			}
+			return nil
+		}),
+		ContinueOnError: true,
+		MaxRetries:      2,
+		Logger:          &testLogger{},
+		Context: testContext{
+			analysisError: func(context.Context, Compilation, error) error { return ErrRetry },
+			teardown: func(_ context.Context, cu Compilation) error {
+				// Ask once for the whole of "redo" to be processed again.
+				if cu.Unit.GetVName().GetSignature() == "redo" && !redone {
+					redone = true
+					return ErrRetry
+				}
+				return nil
+			},
+		},
+	}
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("clean", "flaky", "broken", "redo")...))
+	if !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
+	}
+	if want := []string{"flaky", "redo"}; !equalStrings(stats.FlakyCompilations, want) {
+		t.Errorf("FlakyCompilations: got %q, want %q", stats.FlakyCompilations, want)
+	}
+	if stats.Succeeded != 3 || stats.Failed != 1 {
+		t.Errorf("Expected 3 successes and 1 failure; found %d and %d", stats.Succeeded, stats.Failed)
+	}
+}
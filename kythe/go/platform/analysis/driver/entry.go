@@ -0,0 +1,63 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+// A Sink receives the entries routed to it by a Driver's RouteOutput.
+type Sink func(context.Context, *spb.Entry) error
+
+// DecodeEntry unmarshals the value of out as a Kythe entry.  It reports an
+// error if out carries a final analysis result instead of a value.
+func DecodeEntry(out *apb.AnalysisOutput) (*spb.Entry, error) {
+	if out.GetFinalResult() != nil {
+		return nil, errors.New("output carries a final result, not an entry")
+	}
+	entry := new(spb.Entry)
+	if err := proto.Unmarshal(out.GetValue(), entry); err != nil {
+		return nil, errors.WithMessage(err, "unmarshaling entry")
+	}
+	return entry, nil
+}
+
+// routeOutput decodes out and writes it to the sink selected by RouteOutput.
+// Outputs carrying only a final result have no entry to route, and entries
+// for which RouteOutput selects no sink are dropped.
+func (d *Driver) routeOutput(ctx context.Context, out *apb.AnalysisOutput) error {
+	if out.GetFinalResult() != nil {
+		return nil
+	}
+	entry, err := DecodeEntry(out)
+	if err != nil {
+		return errors.WithMessage(err, "driver: decoding output")
+	}
+	sink, err := d.RouteOutput(entry)
+	if err != nil {
+		return errors.WithMessage(err, "driver: routing output")
+	} else if sink == nil {
+		return nil
+	}
+	return sink(ctx, entry)
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+func entryOutput(t *testing.T, lang, sig string) *apb.AnalysisOutput {
+	t.Helper()
+	rec, err := proto.Marshal(&spb.Entry{
+		Source:   &spb.VName{Language: lang, Signature: sig},
+		FactName: "/kythe/node/kind",
+	})
+	if err != nil {
+		t.Fatalf("Marshaling entry: %v", err)
+	}
+	return &apb.AnalysisOutput{Value: rec}
+}
+
+func TestDecodeEntry(t *testing.T) {
+	entry, err := DecodeEntry(entryOutput(t, "go", "pkg"))
+	if err != nil {
+		t.Fatalf("DecodeEntry: unexpected error: %v", err)
+	}
+	if got := entry.GetSource().GetSignature(); got != "pkg" || entry.FactName != "/kythe/node/kind" {
+		t.Errorf("DecodeEntry: got %+v", entry)
+	}
+
+	for _, bad := range []*apb.AnalysisOutput{
+		{Value: []byte("\xff not an entry")},
+		{FinalResult: &apb.AnalysisResult{Status: apb.AnalysisResult_COMPLETE}},
+	} {
+		if entry, err := DecodeEntry(bad); err == nil {
+			t.Errorf("DecodeEntry(%v): got %v, want error", bad, entry)
+		}
+	}
+}
+
+func TestDriverRouteOutput(t *testing.T) {
+	routed := make(map[string][]string)
+	sinkFor := func(name string) Sink {
+		return func(_ context.Context, entry *spb.Entry) error {
+			routed[name] = append(routed[name], entry.GetSource().GetSignature())
+			return nil
+		}
+	}
+	goSink, javaSink := sinkFor("go"), sinkFor("java")
+	errNoSink := errors.New("no sink")
+	route := func(entry *spb.Entry) (Sink, error) {
+		switch entry.GetSource().GetLanguage() {
+		case "go":
+			return goSink, nil
+		case "java":
+			return javaSink, nil
+		case "none":
+			return nil, nil // dropped
+		}
+		return nil, errNoSink
+	}
+
+	a := &fakeAnalyzer{outputs: []*apb.AnalysisOutput{
+		entryOutput(t, "go", "a"),
+		entryOutput(t, "java", "b"),
+		entryOutput(t, "none", "x"),
+		entryOutput(t, "go", "c"),
+		{FinalResult: &apb.AnalysisResult{Status: apb.AnalysisResult_COMPLETE}},
+	}}
+	d := &Driver{
+		Analyzer:    a,
+		RouteOutput: route,
+		WriteOutput: func(context.Context, *apb.AnalysisOutput) error {
+			t.Error("WriteOutput called despite RouteOutput")
+			return nil
+		},
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(comps("t1")...)); err != nil {
+		t.Fatalf("Driver error: %v", err)
+	}
+	if got, want := routed["go"], []string{"a", "c"}; !equalStrings(got, want) {
+		t.Errorf("Entries routed to go: got %q, want %q", got, want)
+	}
+	if got, want := routed["java"], []string{"b"}; !equalStrings(got, want) {
+		t.Errorf("Entries routed to java: got %q, want %q", got, want)
+	}
+	if len(routed) != 2 {
+		t.Errorf("Entries routed to unexpected sinks: %v", routed)
+	}
+
+	// An entry that cannot be routed fails the analysis.
+	a.outputs = []*apb.AnalysisOutput{entryOutput(t, "c++", "d")}
+	err := d.Run(context.Background(), NewSliceQueue(comps("t2")...))
+	if !errors.Is(err, errNoSink) || !strings.Contains(err.Error(), "driver: routing output") {
+		t.Errorf("Expected a routing error wrapping %v; found %v", errNoSink, err)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"time"
+)
+
+// startHeartbeat calls the driver's Heartbeat for cu every HeartbeatInterval
+// until the returned function is called.  Once that function returns, no
+// further heartbeats are delivered.
+func (d *Driver) startHeartbeat(ctx context.Context, cu Compilation) (stop func()) {
+	if d.Heartbeat == nil || d.HeartbeatInterval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(d.HeartbeatInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				// Check again, since select chooses among ready cases at random.
+				select {
+				case <-done:
+					return
+				default:
+				}
+				d.Heartbeat(ctx, cu)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
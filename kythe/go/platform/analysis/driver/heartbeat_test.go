@@ -0,0 +1,64 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/test/testutil"
+)
+
+func TestDriverHeartbeat(t *testing.T) {
+	const (
+		interval = 10 * time.Millisecond
+		latency  = 105 * time.Millisecond
+	)
+	var beats int32
+	d := &Driver{
+		Analyzer: &fakeAnalyzer{latency: latency},
+		Heartbeat: func(ctx context.Context, cu Compilation) {
+			if got, ok := CompilationFromContext(ctx); !ok || got.Unit != cu.Unit {
+				t.Error("Heartbeat context does not carry the compilation")
+			}
+			atomic.AddInt32(&beats, 1)
+		},
+		HeartbeatInterval: interval,
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), NewSliceQueue(comps("t1")...)))
+
+	// Allow generous slack for slow test machines, but at least half of the
+	// expected heartbeats must arrive.
+	got := atomic.LoadInt32(&beats)
+	if want := int32(latency / interval); got < want/2 || got > want {
+		t.Errorf("Heartbeats during analysis: got %d, want about %d", got, want)
+	}
+	time.Sleep(3 * interval)
+	if after := atomic.LoadInt32(&beats); after != got {
+		t.Errorf("Heartbeats continued after the analysis: %d more", after-got)
+	}
+}
+
+func TestDriverHeartbeatDisabled(t *testing.T) {
+	d := &Driver{
+		Analyzer:  &fakeAnalyzer{latency: 20 * time.Millisecond},
+		Heartbeat: func(context.Context, Compilation) { t.Error("Heartbeat called without an interval") },
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), NewSliceQueue(comps("t1")...)))
+}
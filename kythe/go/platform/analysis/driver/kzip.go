@@ -0,0 +1,120 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"io"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/platform/kzip"
+	"kythe.io/kythe/go/platform/vfs"
+
+	"github.com/pkg/errors"
+)
+
+// WithFetcher returns a copy of ctx from which FetcherFromContext reports f.
+// A queue calls it to make the required inputs of a compilation available to
+// the analyzer, by passing the result to its CompilationFunc.
+func WithFetcher(ctx context.Context, f analysis.Fetcher) context.Context {
+	return context.WithValue(ctx, fetcherKey{}, f)
+}
+
+// FetcherFromContext returns the analysis.Fetcher the queue provided for the
+// current compilation, such as a KzipQueue, from which the analyzer may read
+// its required inputs.  It reports false if the queue did not provide one.
+func FetcherFromContext(ctx context.Context) (analysis.Fetcher, bool) {
+	f, ok := ctx.Value(fetcherKey{}).(analysis.Fetcher)
+	return f, ok
+}
+
+// A KzipQueue is a Queue that presents the compilations stored in a .kzip
+// archive.  It also implements the analysis.Fetcher interface to read the
+// required inputs stored in the archive, and provides itself to the analyzer
+// of each compilation through FetcherFromContext.
+type KzipQueue struct {
+	f     io.Closer
+	r     *kzip.Reader
+	units []*kzip.Unit // units waiting to be delivered
+}
+
+// NewKzipQueue opens the .kzip archive at path and returns a KzipQueue over
+// its compilations.  The caller must Close the queue to release the archive;
+// a Driver does so automatically at the end of a run.
+func NewKzipQueue(ctx context.Context, path string) (*KzipQueue, error) {
+	f, err := vfs.Open(ctx, path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "opening kzip file %q", path)
+	}
+	kf, ok := f.(kzip.File)
+	if !ok {
+		f.Close()
+		return nil, errors.Errorf("reader %T does not implement kzip.File", f)
+	}
+	size, err := kf.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, errors.WithMessagef(err, "getting size of kzip file %q", path)
+	}
+	r, err := kzip.NewReader(kf, size)
+	if err != nil {
+		f.Close()
+		return nil, errors.WithMessagef(err, "reading kzip file %q", path)
+	}
+	q := &KzipQueue{f: f, r: r}
+	if err := r.Scan(func(unit *kzip.Unit) error {
+		q.units = append(q.units, unit)
+		return nil
+	}); err != nil {
+		f.Close()
+		return nil, errors.WithMessagef(err, "scanning kzip file %q", path)
+	}
+	return q, nil
+}
+
+// Next implements the Queue interface.  It returns io.EOF once every
+// compilation in the archive has been delivered.  If f reports an error, the
+// queue does not advance.  The revision of each compilation is the first of
+// those recorded for it in the archive's index, if any.
+func (q *KzipQueue) Next(ctx context.Context, f CompilationFunc) error {
+	if len(q.units) == 0 {
+		return io.EOF
+	}
+	unit := q.units[0]
+	cu := Compilation{
+		Unit:       unit.Proto,
+		UnitDigest: unit.Digest,
+	}
+	if revs := unit.Index.GetRevisions(); len(revs) != 0 {
+		cu.Revision = revs[0]
+	}
+	if err := f(WithFetcher(ctx, q), cu); err != nil {
+		return err
+	}
+	q.units = q.units[1:]
+	return nil
+}
+
+// Fetch implements the analysis.Fetcher interface by reading the file with
+// the given digest from the archive.
+func (q *KzipQueue) Fetch(_, digest string) ([]byte, error) { return q.r.ReadAll(digest) }
+
+// Close implements the CloseableQueue interface by closing the archive.
+func (q *KzipQueue) Close() error {
+	q.units = nil
+	return q.f.Close()
+}
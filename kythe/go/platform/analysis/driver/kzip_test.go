@@ -0,0 +1,109 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/platform/kzip"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+// writeKzip writes a .kzip archive to path holding a compilation for each of
+// sigs, each of which requires a file whose contents are its signature and is
+// indexed at revision "rev-" plus its signature.
+func writeKzip(t *testing.T, path string, sigs ...string) {
+	t.Helper()
+	f, err := os.Create(path)
+	testutil.FatalOnErrT(t, "Creating kzip: %v", err)
+	w, err := kzip.NewWriteCloser(f)
+	testutil.FatalOnErrT(t, "Creating kzip writer: %v", err)
+	for _, sig := range sigs {
+		digest, err := w.AddFile(strings.NewReader(sig))
+		testutil.FatalOnErrT(t, "Adding file: %v", err)
+		_, err = w.AddUnit(&apb.CompilationUnit{
+			VName: &spb.VName{Signature: sig},
+			RequiredInput: []*apb.CompilationUnit_FileInput{{
+				Info: &apb.FileInfo{Path: sig + ".cc", Digest: digest},
+			}},
+		}, &apb.IndexedCompilation_Index{Revisions: []string{"rev-" + sig}})
+		testutil.FatalOnErrT(t, "Adding unit: %v", err)
+	}
+	testutil.FatalOnErrT(t, "Closing kzip: %v", w.Close())
+}
+
+func TestKzipQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kzipqueue")
+	testutil.FatalOnErrT(t, "Creating temp dir: %v", err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.kzip")
+	writeKzip(t, path, "t1", "t2", "t3")
+
+	q, err := NewKzipQueue(context.Background(), path)
+	testutil.FatalOnErrT(t, "Opening queue: %v", err)
+
+	// Resolve each required input through the fetcher the queue provides.
+	contents := make(map[string]string)
+	d := &Driver{Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+		fetcher, ok := FetcherFromContext(ctx)
+		if !ok {
+			return errors.New("no fetcher in the analysis context")
+		}
+		if want := "rev-" + req.Compilation.VName.Signature; req.Revision != want {
+			t.Errorf("Revision of %q: got %q, want %q", req.Compilation.VName.Signature, req.Revision, want)
+		}
+		for _, ri := range req.Compilation.RequiredInput {
+			data, err := fetcher.Fetch(ri.Info.Path, ri.Info.Digest)
+			if err != nil {
+				return err
+			}
+			contents[req.Compilation.VName.Signature] = string(data)
+		}
+		return nil
+	})}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), q))
+
+	if len(contents) != 3 {
+		t.Errorf("Expected 3 compilations; found %v", contents)
+	}
+	for sig, data := range contents {
+		if data != sig {
+			t.Errorf("Input of %q: got %q, want %q", sig, data, sig)
+		}
+	}
+	// The driver closed the queue at the end of the run.
+	if err := q.f.Close(); err == nil {
+		t.Error("Queue was not closed by the driver")
+	}
+}
+
+func TestKzipQueueMissing(t *testing.T) {
+	if q, err := NewKzipQueue(context.Background(), "/nonexistent/test.kzip"); err == nil {
+		q.Close()
+		t.Error("Expected an error opening a nonexistent kzip")
+	}
+}
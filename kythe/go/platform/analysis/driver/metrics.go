@@ -0,0 +1,79 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"expvar"
+	"time"
+)
+
+// Metrics receives counters and timings from a Driver as it runs, for export
+// to a monitoring system.  When used with RunConcurrent, its methods may be
+// called concurrently.
+type Metrics interface {
+	// IncrCompilations is called once for each compilation received from the
+	// queue, after it has been processed.
+	IncrCompilations()
+
+	// IncrRetries is called each time the analysis of a compilation is
+	// retried.
+	IncrRetries()
+
+	// IncrFailures is called once for each compilation whose processing
+	// reported an error other than ErrSkip.
+	IncrFailures()
+
+	// ObserveAnalysisDuration is called once for each compilation sent to the
+	// analyzer, with the total time spent analyzing it, including retries.
+	ObserveAnalysisDuration(time.Duration)
+}
+
+// nopMetrics is the Metrics used by a Driver with none specified.
+type nopMetrics struct{}
+
+func (nopMetrics) IncrCompilations()                     {}
+func (nopMetrics) IncrRetries()                          {}
+func (nopMetrics) IncrFailures()                         {}
+func (nopMetrics) ObserveAnalysisDuration(time.Duration) {}
+
+// ExpvarMetrics is a Metrics that publishes its values as an expvar.Map with
+// the keys "compilations", "retries", "failures", "analyses", and
+// "analysis_seconds".  It is safe for concurrent use.
+type ExpvarMetrics struct {
+	m *expvar.Map
+}
+
+// NewExpvarMetrics returns an ExpvarMetrics published under the given name.
+// As with expvar.Publish, it panics if the name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	return &ExpvarMetrics{m: expvar.NewMap(name)}
+}
+
+// IncrCompilations implements the Metrics interface.
+func (e *ExpvarMetrics) IncrCompilations() { e.m.Add("compilations", 1) }
+
+// IncrRetries implements the Metrics interface.
+func (e *ExpvarMetrics) IncrRetries() { e.m.Add("retries", 1) }
+
+// IncrFailures implements the Metrics interface.
+func (e *ExpvarMetrics) IncrFailures() { e.m.Add("failures", 1) }
+
+// ObserveAnalysisDuration implements the Metrics interface.
+func (e *ExpvarMetrics) ObserveAnalysisDuration(d time.Duration) {
+	e.m.Add("analyses", 1)
+	e.m.AddFloat("analysis_seconds", d.Seconds())
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A countMetrics is a Metrics that counts calls to each method.
+type countMetrics struct {
+	mu           sync.Mutex
+	compilations int
+	retries      int
+	failures     int
+	durations    []time.Duration
+}
+
+func (c *countMetrics) IncrCompilations() { c.mu.Lock(); c.compilations++; c.mu.Unlock() }
+func (c *countMetrics) IncrRetries()      { c.mu.Lock(); c.retries++; c.mu.Unlock() }
+func (c *countMetrics) IncrFailures()     { c.mu.Lock(); c.failures++; c.mu.Unlock() }
+
+func (c *countMetrics) ObserveAnalysisDuration(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.durations = append(c.durations, d)
+}
+
+// mixedRun runs a driver reporting to metrics over a queue in which "ok"
+// succeeds, "fail" fails, "retry" succeeds after two retries, and "skip" is
+// skipped during setup.
+func mixedRun(t *testing.T, metrics Metrics) {
+	t.Helper()
+	errFail := errors.New("analysis failed")
+	d := &Driver{
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			switch req.Compilation.GetVName().GetSignature() {
+			case "fail":
+				return errFail
+			case "retry":
+				if AttemptFromContext(ctx) < 3 {
+					return ErrRetry
+				}
+			}
+			return nil
+		}),
+		Context: testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				if cu.Unit.GetVName().GetSignature() == "skip" {
+					return ErrSkip
+				}
+				return nil
+			},
+		},
+		Metrics:         metrics,
+		ContinueOnError: true,
+		Logger:          &testLogger{},
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(comps("ok", "fail", "retry", "skip")...)); !errors.Is(err, errFail) {
+		t.Errorf("Expected error %v; found %v", errFail, err)
+	}
+}
+
+func TestDriverMetrics(t *testing.T) {
+	m := new(countMetrics)
+	mixedRun(t, m)
+	if m.compilations != 4 || m.failures != 1 || m.retries != 2 {
+		t.Errorf("Metrics: got %d compilations, %d failures, %d retries; want 4, 1, 2",
+			m.compilations, m.failures, m.retries)
+	}
+	if len(m.durations) != 3 {
+		t.Errorf("Expected 3 analysis durations; found %v", m.durations)
+	}
+}
+
+var expvarRuns int // the number of runs of TestExpvarMetrics
+
+func TestExpvarMetrics(t *testing.T) {
+	// Published names cannot be reused, so choose a fresh one if the test is
+	// run more than once.
+	expvarRuns++
+	name := fmt.Sprintf("kythe_driver_test_%d", expvarRuns)
+	mixedRun(t, NewExpvarMetrics(name))
+	m := expvar.Get(name).(*expvar.Map)
+	for key, want := range map[string]string{
+		"compilations": "4",
+		"failures":     "1",
+		"retries":      "2",
+		"analyses":     "3",
+	} {
+		if got := m.Get(key); got == nil || got.String() != want {
+			t.Errorf("Value of %q: got %v, want %s", key, got, want)
+		}
+	}
+	if m.Get("analysis_seconds") == nil {
+		t.Error("Missing analysis_seconds")
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	"github.com/pkg/errors"
+)
+
+// An Option configures a Driver constructed by New.
+type Option func(*Driver)
+
+// WithMiddleware wraps the driver's Analyzer with mw, as Chain does.  The
+// analyzers chosen by AnalyzerFor are not wrapped.
+func WithMiddleware(mw ...AnalyzerMiddleware) Option {
+	return func(d *Driver) { d.Analyzer = Chain(d.Analyzer, mw...) }
+}
+
+// WithTimeout sets the timeout for each analysis request, as for
+// AnalysisOptions.Timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(d *Driver) { d.AnalysisOptions.Timeout = timeout }
+}
+
+// WithMaxRetries sets the driver's MaxRetries.
+func WithMaxRetries(n int) Option {
+	return func(d *Driver) { d.MaxRetries = n }
+}
+
+// WithLogger sets the Logger that receives the driver's messages.
+func WithLogger(l Logger) Option {
+	return func(d *Driver) { d.Logger = l }
+}
+
+// WithContext sets the Context whose callbacks the driver invokes.
+func WithContext(c Context) Option {
+	return func(d *Driver) { d.Context = c }
+}
+
+// WithMetrics sets the Metrics the driver reports to.
+func WithMetrics(m Metrics) Option {
+	return func(d *Driver) { d.Metrics = m }
+}
+
+// WithContinueOnError sets the driver's ContinueOnError.
+func WithContinueOnError(continueOnError bool) Option {
+	return func(d *Driver) { d.ContinueOnError = continueOnError }
+}
+
+// WithPollInterval sets how long the driver waits after a queue reports
+// ErrNoMoreNow, as for PollInterval.
+func WithPollInterval(interval time.Duration) Option {
+	return func(d *Driver) { d.PollInterval = interval }
+}
+
+// New returns a Driver that sends compilations to analyzer and passes the
+// outputs to output, configured by options.  Unlike a Driver constructed
+// directly, the result is checked for a usable configuration: New reports an
+// error if analyzer or output is nil, or if an option has an invalid value.
+// The fields of the Driver may still be set directly to configure features
+// for which there is no Option.
+func New(analyzer analysis.CompilationAnalyzer, output analysis.OutputFunc, options ...Option) (*Driver, error) {
+	if analyzer == nil {
+		return nil, errors.New("driver: no analyzer has been specified")
+	} else if output == nil {
+		return nil, errors.New("driver: no output has been specified")
+	}
+	d := &Driver{Analyzer: analyzer, WriteOutput: output}
+	for _, opt := range options {
+		opt(d)
+	}
+	switch {
+	case d.AnalysisOptions.Timeout < 0:
+		return nil, errors.Errorf("driver: invalid timeout: %v", d.AnalysisOptions.Timeout)
+	case d.MaxRetries < 0:
+		return nil, errors.Errorf("driver: invalid maximum retries: %d", d.MaxRetries)
+	case d.PollInterval < 0:
+		return nil, errors.Errorf("driver: invalid poll interval: %v", d.PollInterval)
+	}
+	return d, nil
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestNew(t *testing.T) {
+	a := new(fakeAnalyzer)
+	var written int
+	output := func(context.Context, *apb.AnalysisOutput) error {
+		written++
+		return nil
+	}
+	log := new(testLogger)
+	metrics := new(countMetrics)
+	c := new(testContext)
+	d, err := New(a, output,
+		WithTimeout(time.Minute),
+		WithMaxRetries(3),
+		WithLogger(log),
+		WithContext(c),
+		WithMetrics(metrics),
+		WithContinueOnError(true),
+		WithPollInterval(time.Second),
+	)
+	testutil.FatalOnErrT(t, "New error: %v", err)
+
+	if d.Analyzer != a || d.AnalysisOptions.Timeout != time.Minute || d.MaxRetries != 3 ||
+		d.Logger != log || d.Context != c || d.Metrics != metrics || !d.ContinueOnError || d.PollInterval != time.Second {
+		t.Errorf("New did not apply its options: %+v", d)
+	}
+
+	a.outputs = outs("a", "b")
+	testutil.FatalOnErrT(t, "Run error: %v", d.Run(context.Background(), NewSliceQueue(comps("t1")...)))
+	if written != 2 {
+		t.Errorf("Expected 2 outputs written; found %d", written)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	a := new(fakeAnalyzer)
+	output := func(context.Context, *apb.AnalysisOutput) error { return nil }
+	tests := []struct {
+		desc     string
+		analyzer *fakeAnalyzer
+		output   func(context.Context, *apb.AnalysisOutput) error
+		options  []Option
+	}{
+		{"missing analyzer", nil, output, nil},
+		{"missing output", a, nil, nil},
+		{"negative timeout", a, output, []Option{WithTimeout(-time.Second)}},
+		{"negative retries", a, output, []Option{WithMaxRetries(-1)}},
+		{"negative poll interval", a, output, []Option{WithPollInterval(-time.Second)}},
+	}
+	for _, test := range tests {
+		var err error
+		if test.analyzer == nil {
+			_, err = New(nil, test.output, test.options...)
+		} else {
+			_, err = New(test.analyzer, test.output, test.options...)
+		}
+		if err == nil {
+			t.Errorf("New with %s: expected an error", test.desc)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"sync"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// An outputBuffer holds the outputs of a single compilation until they can be
+// written in queue order.  The analyzer may emit outputs concurrently.
+type outputBuffer struct {
+	ctx context.Context // passed to WriteOutput for the buffered outputs
+
+	mu   sync.Mutex
+	outs []*apb.AnalysisOutput
+}
+
+func (b *outputBuffer) add(out *apb.AnalysisOutput) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.outs = append(b.outs, out)
+}
+
+// reset discards the outputs buffered so far.
+func (b *outputBuffer) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.outs = nil
+}
+
+type outputBufferKey struct{}
+
+func withOutputBuffer(ctx context.Context, b *outputBuffer) context.Context {
+	return context.WithValue(ctx, outputBufferKey{}, b)
+}
+
+// outputBufferFromContext returns the outputBuffer attached to ctx, or nil if
+// outputs are to be written immediately.
+func outputBufferFromContext(ctx context.Context) *outputBuffer {
+	b, _ := ctx.Value(outputBufferKey{}).(*outputBuffer)
+	return b
+}
+
+// A sequencer writes the buffered outputs of compilations in the order the
+// compilations were taken from the queue, as each becomes ready.
+type sequencer struct {
+	mu    sync.Mutex
+	next  int                   // the sequence number of the next compilation to write
+	ready map[int]*outputBuffer // completed compilations awaiting their turn
+	write func(context.Context, *apb.AnalysisOutput) error
+}
+
+func newSequencer(write func(context.Context, *apb.AnalysisOutput) error) *sequencer {
+	return &sequencer{ready: make(map[int]*outputBuffer), write: write}
+}
+
+// complete records that the compilation with sequence number seq has finished
+// with the outputs in b, and writes the outputs of every compilation whose
+// turn has come.  It returns the first error from writing an output.
+func (s *sequencer) complete(seq int, b *outputBuffer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready[seq] = b
+	for {
+		b, ok := s.ready[s.next]
+		if !ok {
+			return nil
+		}
+		delete(s.ready, s.next)
+		s.next++
+		for _, out := range b.outs {
+			if err := s.write(b.ctx, out); err != nil {
+				return err
+			}
+		}
+	}
+}
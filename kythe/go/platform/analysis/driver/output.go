@@ -0,0 +1,216 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	goerrors "errors"
+	"sync"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// An OutputErrorMode determines how a Driver handles an error from its
+// WriteOutput function.
+type OutputErrorMode int
+
+const (
+	// StopOnError returns the error to the analyzer, which typically abandons
+	// the analysis and reports the error in turn.
+	StopOnError OutputErrorMode = iota
+
+	// ContinueAndCollect hides the error from the analyzer, so that it may
+	// continue to emit outputs.  Once the analyzer returns, the errors
+	// collected are reported as the result of the analysis, together with any
+	// error from the analyzer itself.  An ErrFatal is never hidden.
+	ContinueAndCollect
+)
+
+// An outputCollector records the errors reported by an OutputFunc.
+type outputCollector struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+// wrap returns an OutputFunc that calls f, recording and discarding any error.
+func (c *outputCollector) wrap(f analysis.OutputFunc) analysis.OutputFunc {
+	return func(ctx context.Context, out *apb.AnalysisOutput) error {
+		if err := f(ctx, out); goerrors.Is(err, ErrFatal) {
+			return err
+		} else if err != nil {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.errs = append(c.errs, err)
+		}
+		return nil
+	}
+}
+
+// join combines the errors recorded with err, which may be nil.
+func (c *outputCollector) join(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.errs) == 0 {
+		return err
+	}
+	return joinErrors(append(c.errs, err)...)
+}
+
+// An outputSet records the digests of the output values emitted for a
+// compilation.  It is safe for concurrent use.
+type outputSet struct {
+	mu   sync.Mutex
+	seen map[[sha256.Size]byte]bool
+}
+
+// add records value, reporting whether it was not already present.
+func (o *outputSet) add(value []byte) bool {
+	key := sha256.Sum256(value)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.seen[key] {
+		return false
+	} else if o.seen == nil {
+		o.seen = make(map[[sha256.Size]byte]bool)
+	}
+	o.seen[key] = true
+	return true
+}
+
+// BatchOutput returns an OutputFunc that buffers outputs and passes them to
+// flush in batches of n.  Since the OutputFunc cannot tell when an analysis
+// is complete, BatchOutput also returns a function that flushes any buffered
+// outputs immediately; this is typically called from a Driver's
+// FinalizeOutput.  Both functions are safe for concurrent use.
+func BatchOutput(flush func(context.Context, []*apb.AnalysisOutput) error, n int) (analysis.OutputFunc, func(context.Context) error) {
+	b := &batcher{flush: flush, size: n}
+	return b.write, b.flushAll
+}
+
+type batcher struct {
+	flush func(context.Context, []*apb.AnalysisOutput) error
+	size  int
+
+	mu  sync.Mutex
+	buf []*apb.AnalysisOutput
+}
+
+func (b *batcher) write(ctx context.Context, out *apb.AnalysisOutput) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, out)
+	if len(b.buf) < b.size {
+		return nil
+	}
+	return b.flushLocked(ctx)
+}
+
+func (b *batcher) flushAll(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushLocked(ctx)
+}
+
+func (b *batcher) flushLocked(ctx context.Context) error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	batch := b.buf
+	b.buf = nil
+	return b.flush(ctx, batch)
+}
+
+// analyzeAsync sends req to a, passing its outputs to out through an
+// asyncOutput with the given buffer size.  An error from out takes precedence
+// over the analyzer's, which is typically the resulting cancellation.
+func analyzeAsync(ctx context.Context, a analysis.CompilationAnalyzer, req *apb.AnalysisRequest, out analysis.OutputFunc, size int) (err error) {
+	ctx, async := newAsyncOutput(ctx, out, size)
+	defer func() {
+		if werr := async.wait(); werr != nil {
+			err = werr
+		}
+	}()
+	return a.Analyze(ctx, req, async.write)
+}
+
+// An asyncOutput passes outputs to an OutputFunc from a separate goroutine.
+type asyncOutput struct {
+	items  chan asyncItem
+	failed chan struct{} // closed once out reports an error
+	done   chan struct{} // closed once the goroutine exits
+	err    error         // the error from out; valid once failed is closed
+	cancel context.CancelFunc
+}
+
+type asyncItem struct {
+	ctx context.Context
+	out *apb.AnalysisOutput
+}
+
+// newAsyncOutput starts a goroutine passing outputs to out, and returns a
+// context derived from ctx that is cancelled if out reports an error.
+func newAsyncOutput(ctx context.Context, out analysis.OutputFunc, size int) (context.Context, *asyncOutput) {
+	ctx, cancel := context.WithCancel(ctx)
+	a := &asyncOutput{
+		items:  make(chan asyncItem, size),
+		failed: make(chan struct{}),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	go func() {
+		defer close(a.done)
+		for item := range a.items {
+			if a.err != nil {
+				continue // discard whatever was buffered after the failure
+			}
+			if err := out(item.ctx, item.out); err != nil {
+				a.err = err
+				close(a.failed)
+				cancel()
+			}
+		}
+	}()
+	return ctx, a
+}
+
+// write buffers out, blocking while the buffer is full.  Once an error has
+// been reported for an earlier output, write returns that error.
+func (a *asyncOutput) write(ctx context.Context, out *apb.AnalysisOutput) error {
+	select {
+	case <-a.failed:
+		return a.err
+	default:
+	}
+	select {
+	case a.items <- asyncItem{ctx: ctx, out: out}:
+		return nil
+	case <-a.failed:
+		return a.err
+	}
+}
+
+// wait waits for every buffered output to be handled, and returns the error
+// that ended the output, if any.  No further outputs may be written.
+func (a *asyncOutput) wait() error {
+	close(a.items)
+	<-a.done
+	a.cancel()
+	return a.err
+}
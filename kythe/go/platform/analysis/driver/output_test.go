@@ -0,0 +1,604 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// values returns the string values of outs.
+func values(outs []*apb.AnalysisOutput) []string {
+	var vals []string
+	for _, out := range outs {
+		vals = append(vals, string(out.GetValue()))
+	}
+	return vals
+}
+
+func TestBatchOutput(t *testing.T) {
+	var batches [][]string
+	write, flush := BatchOutput(func(_ context.Context, outs []*apb.AnalysisOutput) error {
+		batches = append(batches, values(outs))
+		return nil
+	}, 2)
+
+	a := &fakeAnalyzer{outputs: outs("a", "b", "c", "d", "e")}
+	d := &Driver{
+		Analyzer:    a,
+		WriteOutput: write,
+		Context: testContext{
+			teardown: func(ctx context.Context, _ Compilation) error { return flush(ctx) },
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), NewSliceQueue(comps("t1")...)))
+
+	want := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}
+	if fmt.Sprint(batches) != fmt.Sprint(want) {
+		t.Errorf("Incorrect batches:\n got: %q\nwant: %q", batches, want)
+	}
+
+	// Flushing with nothing buffered does not produce an empty batch.
+	testutil.FatalOnErrT(t, "Flush error: %v", flush(context.Background()))
+	if len(batches) != len(want) {
+		t.Errorf("Unexpected batches after final flush: %q", batches[len(want):])
+	}
+}
+
+func TestBatchOutputError(t *testing.T) {
+	write, flush := BatchOutput(func(context.Context, []*apb.AnalysisOutput) error {
+		return errFromAnalysis
+	}, 2)
+	ctx := context.Background()
+	batch := outs("a", "b")
+	if err := write(ctx, batch[0]); err != nil {
+		t.Errorf("Unexpected error before the batch is full: %v", err)
+	}
+	if err := write(ctx, batch[1]); err != errFromAnalysis {
+		t.Errorf("Expected flush error %v; found %v", errFromAnalysis, err)
+	}
+	// The failed batch is discarded rather than flushed again.
+	testutil.FatalOnErrT(t, "Flush error: %v", flush(ctx))
+}
+
+func TestDriverOnOutput(t *testing.T) {
+	a := &fakeAnalyzer{outputs: outs("a", "b", "c")}
+	var written, observed []string
+	d := &Driver{
+		Analyzer: a,
+		WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+			written = append(written, string(out.Value))
+			return nil
+		},
+		OnOutput: func(_ context.Context, out *apb.AnalysisOutput) {
+			observed = append(observed, string(out.Value))
+		},
+	}
+	cus := comps("t1", "t2")
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), NewSliceQueue(cus...)))
+
+	if n := len(a.outputs) * len(cus); len(observed) != n {
+		t.Errorf("Expected %d observed outputs; found %d", n, len(observed))
+	}
+	if fmt.Sprint(observed) != fmt.Sprint(written) {
+		t.Errorf("Observed outputs %q do not match those written %q", observed, written)
+	}
+}
+
+func TestDriverOutputErrorMode(t *testing.T) {
+	errWrite := errors.New("write failed")
+	tests := []struct {
+		mode    OutputErrorMode
+		written []string
+	}{
+		{StopOnError, []string{"a"}},
+		{ContinueAndCollect, []string{"a", "c", "d", "e"}},
+	}
+	for _, test := range tests {
+		var written []string
+		d := &Driver{
+			Analyzer:        &fakeAnalyzer{outputs: outs("a", "b", "c", "d", "e")},
+			OutputErrorMode: test.mode,
+			WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+				if string(out.Value) == "b" {
+					return errWrite
+				}
+				written = append(written, string(out.Value))
+				return nil
+			},
+		}
+		if err := d.Run(context.Background(), NewSliceQueue(comps("t1")...)); !errors.Is(err, errWrite) {
+			t.Errorf("Mode %v: expected error %v; found %v", test.mode, errWrite, err)
+		}
+		if !equalStrings(written, test.written) {
+			t.Errorf("Mode %v: written outputs: got %q, want %q", test.mode, written, test.written)
+		}
+	}
+}
+
+func TestDriverOutputBoundary(t *testing.T) {
+	var events []string
+	errBoundary := errors.New("boundary failed")
+	d := &Driver{
+		Analyzer: &fakeAnalyzer{outputs: outs("a", "b")},
+		WriteOutput: func(ctx context.Context, out *apb.AnalysisOutput) error {
+			cu, _ := CompilationFromContext(ctx)
+			events = append(events, cu.Unit.GetVName().GetSignature()+":"+string(out.Value))
+			return nil
+		},
+		OutputBoundary: func(_ context.Context, cu Compilation) error {
+			sig := cu.Unit.GetVName().GetSignature()
+			events = append(events, sig+":boundary")
+			if sig == "t3" {
+				return errBoundary
+			}
+			return nil
+		},
+		Context: testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				if cu.Unit.GetVName().GetSignature() == "skip" {
+					return ErrSkip
+				}
+				return nil
+			},
+			teardown: func(_ context.Context, cu Compilation) error {
+				events = append(events, cu.Unit.GetVName().GetSignature()+":teardown")
+				return nil
+			},
+		},
+	}
+	err := d.Run(context.Background(), NewSliceQueue(comps("t1", "skip", "t2", "t3")...))
+	if !errors.Is(err, errBoundary) {
+		t.Errorf("Expected error %v; found %v", errBoundary, err)
+	}
+	want := []string{
+		"t1:a", "t1:b", "t1:boundary", "t1:teardown",
+		"skip:teardown",
+		"t2:a", "t2:b", "t2:boundary", "t2:teardown",
+		"t3:a", "t3:b", "t3:boundary", "t3:teardown",
+	}
+	if !equalStrings(events, want) {
+		t.Errorf("Incorrect events:\n got: %q\nwant: %q", events, want)
+	}
+}
+
+func TestDriverNilOutput(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		var written []string
+		log := new(testLogger)
+		st, err := (&Driver{
+			Analyzer: &fakeAnalyzer{outputs: []*apb.AnalysisOutput{outs("a")[0], nil, outs("b")[0]}},
+			WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+				written = append(written, string(out.Value))
+				return nil
+			},
+			FailOnNilOutput: strict,
+			Logger:          log,
+		}).RunStats(context.Background(), NewSliceQueue(comps("t1")...))
+
+		if strict {
+			if err == nil {
+				t.Error("Strict: expected an error for a nil output")
+			}
+			if want := []string{"a"}; !equalStrings(written, want) {
+				t.Errorf("Strict: written outputs: got %q, want %q", written, want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if want := []string{"a", "b"}; !equalStrings(written, want) {
+			t.Errorf("Written outputs: got %q, want %q", written, want)
+		}
+		if st.Outputs != 2 {
+			t.Errorf("Expected 2 outputs counted; found %d", st.Outputs)
+		}
+		if len(log.messages) != 1 {
+			t.Errorf("Expected a warning for the nil output; found %q", log.messages)
+		}
+	}
+}
+
+func TestDriverFinalizeOutput(t *testing.T) {
+	var flushed []string
+	write, flush := BatchOutput(func(_ context.Context, outs []*apb.AnalysisOutput) error {
+		flushed = append(flushed, values(outs)...)
+		return nil
+	}, 10)
+	errTeardown := errors.New("teardown failed")
+
+	tests := []struct {
+		sig  string
+		fail error
+	}{
+		{"ok", nil},
+		{"failed", errFromAnalysis},
+	}
+	for _, test := range tests {
+		flushed = nil
+		var events []string
+		d := &Driver{
+			Analyzer:    &fakeAnalyzer{outputs: outs("a", "b"), fail: map[string]error{"failed": test.fail}},
+			WriteOutput: write,
+			FinalizeOutput: func(ctx context.Context, _ Compilation) error {
+				events = append(events, "finalize")
+				return flush(ctx)
+			},
+			Context: testContext{
+				teardown: func(context.Context, Compilation) error {
+					events = append(events, "teardown")
+					return errTeardown
+				},
+			},
+		}
+		err := d.Run(context.Background(), NewSliceQueue(comps(test.sig)...))
+		if want := test.fail; want == nil {
+			if !errors.Is(err, errTeardown) {
+				t.Errorf("%s: expected error %v; found %v", test.sig, errTeardown, err)
+			}
+		} else if !errors.Is(err, want) {
+			t.Errorf("%s: expected error %v; found %v", test.sig, want, err)
+		}
+		if want := []string{"a", "b"}; !equalStrings(flushed, want) {
+			t.Errorf("%s: flushed outputs: got %q, want %q", test.sig, flushed, want)
+		}
+		if want := []string{"finalize", "teardown"}; !equalStrings(events, want) {
+			t.Errorf("%s: events: got %q, want %q", test.sig, events, want)
+		}
+	}
+}
+
+func TestDriverFinalizeOutputError(t *testing.T) {
+	errFlush := errors.New("flush failed")
+	d := &Driver{
+		Analyzer:       &fakeAnalyzer{},
+		FinalizeOutput: func(context.Context, Compilation) error { return errFlush },
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(comps("t1")...)); !errors.Is(err, errFlush) {
+		t.Errorf("Expected error %v; found %v", errFlush, err)
+	}
+}
+
+func TestDriverOrderedOutput(t *testing.T) {
+	sigs := []string{"t1", "t2", "t3", "t4", "t5", "t6"}
+	// Earlier compilations take longer, so they finish out of order.
+	latency := map[string]time.Duration{"t1": 40, "t2": 30, "t3": 20, "t4": 10, "t5": 20, "t6": 5}
+
+	var mu sync.Mutex
+	var finished, written []string
+	d := &Driver{
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc) error {
+			sig := req.Compilation.GetVName().GetSignature()
+			for _, v := range []string{"a", "b"} {
+				time.Sleep(latency[sig] * time.Millisecond / 2)
+				if err := f(ctx, &apb.AnalysisOutput{Value: []byte(sig + ":" + v)}); err != nil {
+					return err
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			finished = append(finished, sig)
+			return nil
+		}),
+		OrderedOutput: true,
+		WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+			mu.Lock()
+			defer mu.Unlock()
+			written = append(written, string(out.Value))
+			return nil
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.RunConcurrent(context.Background(), NewSliceQueue(comps(sigs...)...), 3))
+
+	if equalStrings(finished, sigs) {
+		t.Logf("Compilations happened to finish in order: %q", finished)
+	}
+	var want []string
+	for _, sig := range sigs {
+		want = append(want, sig+":a", sig+":b")
+	}
+	if !equalStrings(written, want) {
+		t.Errorf("Written outputs:\n got: %q\nwant: %q", written, want)
+	}
+}
+
+func TestDriverMinOutputsPerCompilation(t *testing.T) {
+	byOutputs := map[string]analysis.CompilationAnalyzer{
+		"none": new(fakeAnalyzer),
+		"one":  &fakeAnalyzer{outputs: outs("a")},
+		"two":  &fakeAnalyzer{outputs: outs("a", "b")},
+	}
+	newDriver := func(fail bool) (*Driver, *testLogger) {
+		log := new(testLogger)
+		return &Driver{
+			AnalyzerFor: func(cu Compilation) analysis.CompilationAnalyzer {
+				return byOutputs[cu.Unit.GetVName().GetSignature()]
+			},
+			MinOutputsPerCompilation: 2,
+			FailOnInsufficientOutput: fail,
+			ContinueOnError:          true,
+			Logger:                   log,
+		}, log
+	}
+	queue := func() Queue { return NewSliceQueue(comps("none", "one", "two")...) }
+
+	// By default, insufficient output is only logged.
+	d, log := newDriver(false)
+	stats, err := d.RunStats(context.Background(), queue())
+	if err != nil {
+		t.Fatalf("Driver error: %v", err)
+	}
+	if stats.Succeeded != 3 || stats.EmptyCompilations != 1 {
+		t.Errorf("Expected 3 successes and 1 empty compilation; found %+v", stats)
+	}
+	if len(log.messages) != 2 || !strings.Contains(log.messages[0], `"none" emitted 0 outputs`) {
+		t.Errorf("Expected warnings for the two compilations with too few outputs; found %q", log.messages)
+	}
+
+	d, _ = newDriver(true)
+	stats, err = d.RunStats(context.Background(), queue())
+	if err == nil || !strings.Contains(err.Error(), "analyzing :one: driver: analysis emitted 1 outputs") {
+		t.Errorf("Expected an insufficient output error; found %v", err)
+	}
+	if stats.Succeeded != 1 || stats.Failed != 2 || stats.EmptyCompilations != 1 {
+		t.Errorf("Expected 1 success, 2 failures, and 1 empty compilation; found %+v", stats)
+	}
+}
+
+// countingAnalyzer emits n outputs, counting those accepted by the OutputFunc,
+// and stops at the first error.
+type countingAnalyzer struct {
+	n        int
+	accepted int32 // updated atomically
+}
+
+func (c *countingAnalyzer) Analyze(ctx context.Context, _ *apb.AnalysisRequest, f analysis.OutputFunc) error {
+	for i := 0; i < c.n; i++ {
+		if err := f(ctx, &apb.AnalysisOutput{Value: []byte(fmt.Sprint(i))}); err != nil {
+			return err
+		}
+		atomic.AddInt32(&c.accepted, 1)
+	}
+	return ctx.Err()
+}
+
+func TestDriverAsyncOutputOrder(t *testing.T) {
+	const n = 50
+	var got []string
+	d := &Driver{
+		Analyzer:          &countingAnalyzer{n: n},
+		AsyncOutputBuffer: 4,
+		WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+			got = append(got, string(out.Value))
+			return nil
+		},
+	}
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("t1", "t2")...))
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	if len(got) != 2*n || stats.Outputs != 2*n {
+		t.Fatalf("Expected %d outputs; wrote %d, counted %d", 2*n, len(got), stats.Outputs)
+	}
+	for i, v := range got {
+		if want := fmt.Sprint(i % n); v != want {
+			t.Fatalf("Output %d: got %q, want %q", i, v, want)
+		}
+	}
+}
+
+func TestDriverAsyncOutputBackpressure(t *testing.T) {
+	const size = 3
+	a := &countingAnalyzer{n: 10}
+	release := make(chan struct{})
+	d := &Driver{
+		Analyzer:          a,
+		AsyncOutputBuffer: size,
+		WriteOutput: func(context.Context, *apb.AnalysisOutput) error {
+			<-release
+			return nil
+		},
+	}
+	done := make(chan error, 1)
+	go func() { done <- d.Run(context.Background(), NewSliceQueue(comps("t1")...)) }()
+
+	// The sink holds the first output, and the buffer the next size, so the
+	// analyzer is blocked on the one after that.
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt32(&a.accepted); got != size+1 {
+		t.Errorf("Outputs accepted before the sink proceeded: got %d, want %d", got, size+1)
+	}
+	close(release)
+	testutil.FatalOnErrT(t, "Driver error: %v", <-done)
+	if got := atomic.LoadInt32(&a.accepted); got != 10 {
+		t.Errorf("Outputs accepted: got %d, want 10", got)
+	}
+}
+
+func TestDriverAsyncOutputError(t *testing.T) {
+	errSink := errors.New("sink failed")
+	a := &countingAnalyzer{n: 1000}
+	var written int
+	d := &Driver{
+		Analyzer:          a,
+		AsyncOutputBuffer: 2,
+		WriteOutput: func(context.Context, *apb.AnalysisOutput) error {
+			if written++; written == 3 {
+				return errSink
+			}
+			return nil
+		},
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(comps("t1")...)); !errors.Is(err, errSink) {
+		t.Errorf("Expected error %v; found %v", errSink, err)
+	}
+	if written != 3 {
+		t.Errorf("Expected no outputs to be written after the error; wrote %d", written)
+	}
+	if got := atomic.LoadInt32(&a.accepted); got >= 1000 {
+		t.Errorf("Analysis was not stopped by the sink error: %d outputs accepted", got)
+	}
+}
+
+func TestDriverFatalOutput(t *testing.T) {
+	for _, mode := range []OutputErrorMode{StopOnError, ContinueAndCollect} {
+		a := &fakeAnalyzer{outputs: outs("a", "b")}
+		var writes int
+		var tornDown []string
+		d := &Driver{
+			Analyzer:        a,
+			ContinueOnError: true,
+			OutputErrorMode: mode,
+			WriteOutput: func(ctx context.Context, out *apb.AnalysisOutput) error {
+				if writes++; writes == 3 {
+					return fmt.Errorf("disk full: %w", ErrFatal)
+				}
+				return nil
+			},
+			Context: testContext{
+				analysisError: func(context.Context, Compilation, error) error { return ErrRetry },
+				teardown: func(_ context.Context, cu Compilation) error {
+					sig := cu.Unit.GetVName().GetSignature()
+					tornDown = append(tornDown, sig)
+					if sig == "t2" {
+						return ErrRetry // not honored once the run has failed
+					}
+					return nil
+				},
+			},
+		}
+		err := d.Run(context.Background(), NewSliceQueue(comps("t1", "t2", "t3")...))
+		if !errors.Is(err, ErrFatal) {
+			t.Errorf("Mode %v: expected error %v; found %v", mode, ErrFatal, err)
+		}
+		if got, want := analyzed(a), []string{"t1", "t2"}; !equalStrings(got, want) {
+			t.Errorf("Mode %v: analyzed %q, want %q", mode, got, want)
+		}
+		if want := []string{"t1", "t2"}; !equalStrings(tornDown, want) {
+			t.Errorf("Mode %v: torn down %q, want %q", mode, tornDown, want)
+		}
+	}
+}
+
+func TestDriverFatalOutputConcurrent(t *testing.T) {
+	var sigs []string
+	for i := 0; i < 100; i++ {
+		sigs = append(sigs, fmt.Sprintf("t%d", i))
+	}
+	a := &fakeAnalyzer{outputs: outs("a")}
+	var writes int32
+	d := &Driver{
+		Analyzer:        a,
+		ContinueOnError: true,
+		WriteOutput: func(context.Context, *apb.AnalysisOutput) error {
+			if atomic.AddInt32(&writes, 1) == 3 {
+				return ErrFatal
+			}
+			return nil
+		},
+	}
+	if err := d.RunConcurrent(context.Background(), NewSliceQueue(comps(sigs...)...), 2); !errors.Is(err, ErrFatal) {
+		t.Errorf("Expected error %v; found %v", ErrFatal, err)
+	}
+	if n := len(analyzed(a)); n >= len(sigs) {
+		t.Errorf("Run continued after a fatal error: %d compilations analyzed", n)
+	}
+}
+
+func TestDriverDedupOutputs(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		a := &fakeAnalyzer{outputs: outs("a", "b", "a", "a", "c", "b")}
+		var written []string
+		d := &Driver{
+			Analyzer:     a,
+			DedupOutputs: dedup,
+			WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+				written = append(written, string(out.Value))
+				return nil
+			},
+		}
+		stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("t1", "t2")...))
+		testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+		want := []string{"a", "b", "a", "a", "c", "b", "a", "b", "a", "a", "c", "b"}
+		wantDups := 0
+		if dedup {
+			// Duplicates are only dropped within each compilation.
+			want, wantDups = []string{"a", "b", "c", "a", "b", "c"}, 6
+		}
+		if !equalStrings(written, want) {
+			t.Errorf("DedupOutputs=%v: written %q, want %q", dedup, written, want)
+		}
+		if stats.DuplicateOutputs != wantDups || stats.Outputs != len(want) {
+			t.Errorf("DedupOutputs=%v: got %d duplicates and %d outputs, want %d and %d",
+				dedup, stats.DuplicateOutputs, stats.Outputs, wantDups, len(want))
+		}
+	}
+}
+
+func TestDriverTransformOutput(t *testing.T) {
+	a := &fakeAnalyzer{outputs: outs("a", "drop", "b")}
+	var written []string
+	d := &Driver{
+		Analyzer: a,
+		TransformOutput: func(ctx context.Context, out *apb.AnalysisOutput) (*apb.AnalysisOutput, error) {
+			if string(out.Value) == "drop" {
+				return nil, nil
+			}
+			cu, _ := CompilationFromContext(ctx)
+			return &apb.AnalysisOutput{Value: []byte(cu.Unit.GetVName().GetSignature() + ":" + string(out.Value))}, nil
+		},
+		WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+			written = append(written, string(out.Value))
+			return nil
+		},
+	}
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("t1", "t2")...))
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	if want := []string{"t1:a", "t1:b", "t2:a", "t2:b"}; !equalStrings(written, want) {
+		t.Errorf("Written outputs: got %q, want %q", written, want)
+	}
+	if stats.Outputs != 6 {
+		t.Errorf("Expected 6 outputs counted; found %d", stats.Outputs)
+	}
+	if got := string(a.outputs[0].Value); got != "a" {
+		t.Errorf("Original output was modified: %q", got)
+	}
+
+	// An error from the transform fails the compilation.
+	errTransform := errors.New("cannot remap corpus")
+	written = nil
+	d.TransformOutput = func(context.Context, *apb.AnalysisOutput) (*apb.AnalysisOutput, error) {
+		return nil, errTransform
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(comps("t1")...)); !errors.Is(err, errTransform) {
+		t.Errorf("Expected error %v; found %v", errTransform, err)
+	}
+	if len(written) != 0 {
+		t.Errorf("Outputs written despite the transform error: %q", written)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	"github.com/pkg/errors"
+)
+
+// A Rewindable is a Queue that can be restarted from the beginning, so that
+// the same compilations may be presented more than once.
+type Rewindable interface {
+	Queue
+
+	// Reset restores the queue to its initial state, so that the next call
+	// to Next presents its first compilation again.
+	Reset() error
+}
+
+// RunPasses runs the driver over every compilation in queue once for each of
+// analyzers in turn, resetting the queue between passes.  In each pass, the
+// analyzer for the pass is used for every compilation, in place of the
+// driver's Analyzer and AnalyzerFor.  Each pass is otherwise a complete run,
+// so callbacks such as Setup and Teardown are called for each compilation in
+// every pass, OnComplete is called at the end of each pass, and a Checkpoint
+// marked in one pass causes compilations to be skipped by the next.
+//
+// The first pass to fail ends the run, and its error is returned.  If queue is
+// a CloseableQueue, it is closed once all the passes are finished.
+func (d *Driver) RunPasses(ctx context.Context, queue Rewindable, analyzers ...analysis.CompilationAnalyzer) (err error) {
+	if len(analyzers) == 0 {
+		return errors.New("no analyzers have been specified")
+	}
+	for i, a := range analyzers {
+		if a == nil {
+			return errors.Errorf("no analyzer has been specified for pass %d", i+1)
+		}
+	}
+	defer closeQueue(queue, &err)
+
+	for i, a := range analyzers {
+		if i > 0 {
+			if err := queue.Reset(); err != nil {
+				return errors.WithMessagef(err, "driver: resetting queue for pass %d", i+1)
+			}
+		}
+		r := d.newRun()
+		r.pass = a
+		stats, err := r.drive(ctx, queue)
+		if err != nil {
+			err = errors.WithMessagef(err, "driver: pass %d", i+1)
+		}
+		d.notifyComplete(ctx, stats, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"kythe.io/kythe/go/test/testutil"
+)
+
+// resettingQueue is a Rewindable that counts its resets and closes.
+type resettingQueue struct {
+	*SliceQueue
+	resets, closed int
+	err            error // returned from Reset
+}
+
+func (q *resettingQueue) Reset() error {
+	q.resets++
+	if q.err != nil {
+		return q.err
+	}
+	return q.SliceQueue.Reset()
+}
+
+func (q *resettingQueue) Close() error {
+	q.closed++
+	return nil
+}
+
+func TestDriverRunPasses(t *testing.T) {
+	collect, verify := new(fakeAnalyzer), new(fakeAnalyzer)
+	var setups int
+	d := &Driver{
+		Analyzer: new(fakeAnalyzer), // not used by the passes
+		Context: testContext{
+			setup: func(context.Context, Compilation) error {
+				setups++
+				return nil
+			},
+		},
+	}
+	q := &resettingQueue{SliceQueue: NewSliceQueue(comps("t1", "t2", "t3")...)}
+	testutil.FatalOnErrT(t, "RunPasses error: %v", d.RunPasses(context.Background(), q, collect, verify))
+
+	want := []string{"t1", "t2", "t3"}
+	if got := analyzed(collect); !equalStrings(got, want) {
+		t.Errorf("First pass analyzed %q, want %q", got, want)
+	}
+	if got := analyzed(verify); !equalStrings(got, want) {
+		t.Errorf("Second pass analyzed %q, want %q", got, want)
+	}
+	if n := len(d.Analyzer.(*fakeAnalyzer).requests); n != 0 {
+		t.Errorf("Driver's own Analyzer received %d requests", n)
+	}
+	if setups != 6 {
+		t.Errorf("Expected Setup to be called once per compilation per pass; found %d calls", setups)
+	}
+	if q.resets != 1 || q.closed != 1 {
+		t.Errorf("Expected 1 reset and 1 close; found %d and %d", q.resets, q.closed)
+	}
+}
+
+func TestDriverRunPassesErrors(t *testing.T) {
+	d := new(Driver)
+	if err := d.RunPasses(context.Background(), NewSliceQueue()); err == nil {
+		t.Error("Expected an error with no analyzers")
+	}
+
+	// A failing pass stops the run.
+	failing := &fakeAnalyzer{fail: map[string]error{"t2": errFromAnalysis}}
+	second := new(fakeAnalyzer)
+	q := &resettingQueue{SliceQueue: NewSliceQueue(comps("t1", "t2")...)}
+	err := d.RunPasses(context.Background(), q, failing, second)
+	if !errors.Is(err, errFromAnalysis) || !strings.Contains(err.Error(), "driver: pass 1") {
+		t.Errorf("Expected pass 1 to fail with %v; found %v", errFromAnalysis, err)
+	}
+	if len(second.requests) != 0 || q.closed != 1 {
+		t.Errorf("Expected the run to end after the failed pass; %d requests, %d closes", len(second.requests), q.closed)
+	}
+
+	errReset := errors.New("cannot rewind")
+	q = &resettingQueue{SliceQueue: NewSliceQueue(comps("t1")...), err: errReset}
+	if err := d.RunPasses(context.Background(), q, new(fakeAnalyzer), second); !errors.Is(err, errReset) {
+		t.Errorf("Expected error %v; found %v", errReset, err)
+	}
+}
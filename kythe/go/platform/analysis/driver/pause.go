@@ -0,0 +1,60 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import "context"
+
+// Pause stops the driver from pulling further compilations from its queue
+// until Resume is called.  Compilations already taken from the queue are
+// still processed; a running Run blocks before pulling the next one.  Pause
+// may be called concurrently with a run, and has no effect if the driver is
+// already paused.
+func (d *Driver) Pause() {
+	d.pauseMu.Lock()
+	defer d.pauseMu.Unlock()
+	if d.resumed == nil {
+		d.resumed = make(chan struct{})
+	}
+}
+
+// Resume allows a paused driver to continue pulling compilations from its
+// queue.  It has no effect if the driver is not paused.
+func (d *Driver) Resume() {
+	d.pauseMu.Lock()
+	defer d.pauseMu.Unlock()
+	if d.resumed != nil {
+		close(d.resumed)
+		d.resumed = nil
+	}
+}
+
+// waitResumed blocks while the driver is paused, returning an error if ctx
+// ends first.
+func (d *Driver) waitResumed(ctx context.Context) error {
+	d.pauseMu.Lock()
+	resumed := d.resumed
+	d.pauseMu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDriverPause(t *testing.T) {
+	setups := make(chan string, 5)
+	teardowns := make(chan string, 5)
+	a := new(fakeAnalyzer)
+	d := &Driver{Analyzer: a}
+	d.Context = testContext{
+		setup: func(_ context.Context, cu Compilation) error {
+			sig := cu.Unit.GetVName().GetSignature()
+			if sig == "t2" {
+				d.Pause() // takes effect once t2 is finished
+			}
+			setups <- sig
+			return nil
+		},
+		teardown: func(_ context.Context, cu Compilation) error {
+			teardowns <- cu.Unit.GetVName().GetSignature()
+			return nil
+		},
+	}
+
+	d.Pause()
+	done := make(chan error, 1)
+	go func() { done <- d.Run(context.Background(), NewSliceQueue(comps("t1", "t2", "t3", "t4")...)) }()
+
+	expectIdle := func(stage string) {
+		t.Helper()
+		select {
+		case sig := <-setups:
+			t.Fatalf("%s: compilation %q was processed while paused", stage, sig)
+		case err := <-done:
+			t.Fatalf("%s: run ended while paused: %v", stage, err)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	expectIdle("before start")
+
+	d.Resume()
+	for _, want := range []string{"t1", "t2"} {
+		if got := <-setups; got != want {
+			t.Fatalf("Processed %q, want %q", got, want)
+		}
+		if got := <-teardowns; got != want {
+			t.Fatalf("Tore down %q, want %q", got, want)
+		}
+	}
+	expectIdle("after t2")
+	if n := len(analyzed(a)); n != 2 {
+		t.Errorf("Expected 2 analyses before pausing; found %d", n)
+	}
+
+	d.Resume()
+	if err := <-done; err != nil {
+		t.Fatalf("Driver error: %v", err)
+	}
+	if got, want := analyzed(a), []string{"t1", "t2", "t3", "t4"}; !equalStrings(got, want) {
+		t.Errorf("Analyzed compilations: got %q, want %q", got, want)
+	}
+}
+
+func TestDriverPauseCancel(t *testing.T) {
+	a := new(fakeAnalyzer)
+	d := &Driver{Analyzer: a}
+	d.Pause()
+	d.Pause() // redundant calls are harmless
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := d.Run(ctx, NewSliceQueue(comps("t1")...)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected error %v; found %v", context.Canceled, err)
+	}
+	if len(a.requests) != 0 {
+		t.Errorf("Expected no analyses while paused; found %d", len(a.requests))
+	}
+	d.Resume()
+	d.Resume()
+}
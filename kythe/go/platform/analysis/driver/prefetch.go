@@ -0,0 +1,89 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	goerrors "errors"
+	"time"
+)
+
+// A prefetched compilation has been dequeued and prepared ahead of its turn.
+type prefetched struct {
+	ctx context.Context
+	cu  Compilation
+	p   prepared
+}
+
+// errStopped is reported by the prefetcher's callback when the run has ended.
+var errStopped = goerrors.New("prefetch stopped")
+
+// runPrefetch processes each compilation from queue in turn, as pull does,
+// while a separate goroutine dequeues and prepares up to r.Prefetch
+// compilations ahead of the one being processed.
+func (r *run) runPrefetch(ctx context.Context, queue Queue) error {
+	pctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The prefetcher blocks sending one prepared compilation while the
+	// channel holds the rest.
+	ready := make(chan prefetched, r.Prefetch-1)
+	stop := make(chan struct{})
+	var qerr error // the error that ended the prefetcher
+	go func() {
+		defer close(ready)
+		qerr = r.pull(pctx, queue, func(ctx context.Context, cu Compilation) error {
+			ctx = r.dequeue(ctx, cu)
+			start := time.Now()
+			item := prefetched{ctx: ctx, cu: cu, p: r.prepare(ctx, cu)}
+			item.p.elapsed = time.Since(start)
+			select {
+			case ready <- item:
+				return nil
+			case <-stop:
+				r.abandon(item)
+				return errStopped
+			}
+		})
+	}()
+
+	for item := range ready {
+		if err := r.processPrepared(item.ctx, item.cu, &item.p); err != nil {
+			// Stop the prefetcher, and tear down whatever it had set up.
+			close(stop)
+			cancel()
+			for item := range ready {
+				r.abandon(item)
+			}
+			return err
+		}
+		r.cursors.finished(item.ctx)
+	}
+	return qerr
+}
+
+// abandon tears down a prefetched compilation that will not be processed.
+func (r *run) abandon(item prefetched) {
+	if !item.p.setUp {
+		return
+	}
+	// The prefetch context may have been cancelled to stop the prefetcher.
+	ctx := detach(item.ctx)
+	if err := r.teardown(ctx, item.p.cu, context.Canceled); err != nil {
+		r.contextWarningf(ctx, "teardown of abandoned compilation %q failed: %v", item.p.sig, err)
+	}
+}
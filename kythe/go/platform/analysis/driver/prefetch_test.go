@@ -0,0 +1,137 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// An eventLog records events from concurrent callbacks.
+type eventLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+// index returns the position of event in the log, or -1.
+func (l *eventLog) index(event string) int {
+	for i, e := range l.events {
+		if e == event {
+			return i
+		}
+	}
+	return -1
+}
+
+// filter returns the events beginning with prefix, in order.
+func (l *eventLog) filter(prefix string) []string {
+	var out []string
+	for _, e := range l.events {
+		if len(e) >= len(prefix) && e[:len(prefix)] == prefix {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// prefetchDriver returns a Driver with the given Prefetch that logs each
+// callback and takes latency for each Setup and analysis.  The analysis of
+// "bad" fails.
+func prefetchDriver(log *eventLog, prefetch int, latency time.Duration) *Driver {
+	return &Driver{
+		Prefetch: prefetch,
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			sig := req.Compilation.GetVName().GetSignature()
+			log.add("analyze+" + sig)
+			time.Sleep(latency)
+			log.add("analyze-" + sig)
+			if sig == "bad" {
+				return errFromAnalysis
+			}
+			return nil
+		}),
+		Context: testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				sig := cu.Unit.GetVName().GetSignature()
+				log.add("setup+" + sig)
+				time.Sleep(latency)
+				log.add("setup-" + sig)
+				return nil
+			},
+			teardown: func(_ context.Context, cu Compilation) error {
+				log.add("teardown " + cu.Unit.GetVName().GetSignature())
+				return nil
+			},
+		},
+	}
+}
+
+func TestDriverPrefetch(t *testing.T) {
+	log := new(eventLog)
+	d := prefetchDriver(log, 2, 10*time.Millisecond)
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), NewSliceQueue(comps("t1", "t2", "t3", "t4")...)))
+
+	// The setup of t2 began before the analysis of t1 finished.
+	if i, j := log.index("setup+t2"), log.index("analyze-t1"); i < 0 || j < 0 || i > j {
+		t.Errorf("Setup did not overlap with analysis: %q", log.events)
+	}
+	// No compilation was set up more than Prefetch ahead of the analysis.
+	if i, j := log.index("setup+t4"), log.index("analyze-t1"); i < j {
+		t.Errorf("Setup ran too far ahead of analysis: %q", log.events)
+	}
+	if got, want := log.filter("analyze+"), []string{"analyze+t1", "analyze+t2", "analyze+t3", "analyze+t4"}; !equalStrings(got, want) {
+		t.Errorf("Analyses out of order: got %q, want %q", got, want)
+	}
+	if got, want := log.filter("teardown"), []string{"teardown t1", "teardown t2", "teardown t3", "teardown t4"}; !equalStrings(got, want) {
+		t.Errorf("Teardowns out of order: got %q, want %q", got, want)
+	}
+}
+
+func TestDriverPrefetchError(t *testing.T) {
+	log := new(eventLog)
+	d := prefetchDriver(log, 2, time.Millisecond)
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(comps("t1", "bad", "t3", "t4", "t5", "t6")...))
+	if !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
+	}
+	if stats.Compilations != 2 {
+		t.Errorf("Expected 2 compilations processed; found %d", stats.Compilations)
+	}
+	// Every compilation that was set up was torn down, but none after the
+	// failure was analyzed.
+	setups, teardowns := log.filter("setup-"), log.filter("teardown")
+	if len(setups) != len(teardowns) || len(setups) < 3 || len(setups) == 6 {
+		t.Errorf("Got %d setups and %d teardowns: %q", len(setups), len(teardowns), log.events)
+	}
+	if got := log.filter("analyze+"); len(got) != 2 {
+		t.Errorf("Expected 2 analyses; found %q", got)
+	}
+}
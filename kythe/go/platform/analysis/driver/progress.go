@@ -0,0 +1,69 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"sync"
+)
+
+// A progressSink forwards the progress of an analysis to OnAnalysisProgress.
+type progressSink struct {
+	mu     sync.Mutex
+	report func(float64) // nil once the analysis has returned
+}
+
+// ReportProgress reports that the analysis ctx was passed to is the given
+// fraction complete, from 0 to 1; values outside that range are clamped.  An
+// analyzer calls it with the context given to its Analyze method, or one
+// derived from it, and the report is passed to the driver's
+// OnAnalysisProgress.  ReportProgress reports false if the report was not
+// delivered, because ctx does not belong to a Driver with OnAnalysisProgress
+// or the analysis has already returned.
+func ReportProgress(ctx context.Context, fraction float64) bool {
+	s, ok := ctx.Value(progressKey{}).(*progressSink)
+	if !ok {
+		return false
+	}
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.report == nil {
+		return false
+	}
+	s.report(fraction)
+	return true
+}
+
+// progress returns a context through which the analysis of cu may report its
+// progress to OnAnalysisProgress, and a function to call once the analysis
+// has returned, after which reports are discarded.
+func (d *Driver) progress(ctx context.Context, cu Compilation) (context.Context, func()) {
+	if d.OnAnalysisProgress == nil {
+		return ctx, func() {}
+	}
+	s := &progressSink{report: func(fraction float64) { d.OnAnalysisProgress(ctx, cu, fraction) }}
+	return context.WithValue(ctx, progressKey{}, s), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.report = nil
+	}
+}
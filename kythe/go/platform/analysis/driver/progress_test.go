@@ -0,0 +1,71 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestDriverOnAnalysisProgress(t *testing.T) {
+	var late context.Context // the context of the last analysis, kept past its return
+	a := analyzerFunc(func(ctx context.Context, _ *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+		for _, fraction := range []float64{0, 0.25, 0.5, 1, 1.5} {
+			if !ReportProgress(ctx, fraction) {
+				t.Errorf("ReportProgress(%v) was not delivered", fraction)
+			}
+		}
+		late = ctx
+		return nil
+	})
+	progress := make(map[string][]float64)
+	d := &Driver{
+		Analyzer: a,
+		OnAnalysisProgress: func(_ context.Context, cu Compilation, fraction float64) {
+			sig := cu.Unit.GetVName().GetSignature()
+			progress[sig] = append(progress[sig], fraction)
+		},
+	}
+	testutil.FatalOnErrT(t, "Run error: %v", d.Run(context.Background(), NewSliceQueue(comps("t1", "t2")...)))
+
+	want := []float64{0, 0.25, 0.5, 1, 1} // clamped to 1
+	for _, sig := range []string{"t1", "t2"} {
+		got := progress[sig]
+		if len(got) != len(want) {
+			t.Errorf("Progress of %s: got %v, want %v", sig, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("Progress of %s: got %v, want %v", sig, got, want)
+				break
+			}
+		}
+	}
+
+	if ReportProgress(late, 1) {
+		t.Error("ReportProgress was delivered after the analysis returned")
+	}
+	if ReportProgress(context.Background(), 1) {
+		t.Error("ReportProgress was delivered outside a Driver")
+	}
+}
@@ -0,0 +1,406 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// A SliceQueue is a Queue that presents a fixed sequence of compilations.
+type SliceQueue struct {
+	units []Compilation
+	next  int // the index of the next unit to deliver
+}
+
+// NewSliceQueue returns a SliceQueue that presents each of cus in order.
+func NewSliceQueue(cus ...Compilation) *SliceQueue { return &SliceQueue{units: cus} }
+
+// Next implements the Queue interface.  It returns io.EOF once every
+// compilation has been delivered.  If f reports an error, the queue does not
+// advance, so the same compilation is presented by the next call.
+func (q *SliceQueue) Next(ctx context.Context, f CompilationFunc) error {
+	if q.next >= len(q.units) {
+		return io.EOF
+	}
+	if err := f(ctx, q.units[q.next]); err != nil {
+		return err
+	}
+	q.next++
+	return nil
+}
+
+// Cursor implements the CheckpointQueue interface.  The cursor records the
+// number of compilations presented so far; see NewSliceQueueFrom.
+func (q *SliceQueue) Cursor() []byte { return []byte(strconv.Itoa(q.next)) }
+
+// NewSliceQueueFrom returns a SliceQueue that presents cus in order, resuming
+// from a cursor previously returned by the Cursor method of a SliceQueue over
+// the same compilations.  An empty cursor starts from the beginning.
+func NewSliceQueueFrom(cursor []byte, cus ...Compilation) (*SliceQueue, error) {
+	q := NewSliceQueue(cus...)
+	if len(cursor) == 0 {
+		return q, nil
+	}
+	next, err := strconv.Atoi(string(cursor))
+	if err != nil || next < 0 || next > len(cus) {
+		return nil, errors.Errorf("invalid cursor %q for %d compilations", cursor, len(cus))
+	}
+	q.next = next
+	return q, nil
+}
+
+// Reset implements the Rewindable interface.  It never fails.
+func (q *SliceQueue) Reset() error {
+	q.next = 0
+	return nil
+}
+
+// NewOrderedQueue returns a SliceQueue that presents cus in the order given by
+// less, which reports whether a should be presented before b.  Compilations
+// that are equal under less keep their original relative order.  The cus
+// slice itself is not modified.
+func NewOrderedQueue(cus []Compilation, less func(a, b Compilation) bool) *SliceQueue {
+	sorted := append([]Compilation(nil), cus...)
+	sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+	return NewSliceQueue(sorted...)
+}
+
+// A RepeatQueue is a Queue that presents the same compilation a fixed number
+// of times, which is useful for tests and benchmarks.
+type RepeatQueue struct {
+	unit Compilation
+	left int // the number of presentations remaining
+}
+
+// NewRepeatQueue returns a RepeatQueue that presents cu n times.
+func NewRepeatQueue(cu Compilation, n int) *RepeatQueue { return &RepeatQueue{unit: cu, left: n} }
+
+// Next implements the Queue interface.  It returns io.EOF once the
+// compilation has been presented n times.  As with a SliceQueue, a
+// presentation for which f reports an error is not counted.
+func (q *RepeatQueue) Next(ctx context.Context, f CompilationFunc) error {
+	if q.left <= 0 {
+		return io.EOF
+	}
+	if err := f(ctx, q.unit); err != nil {
+		return err
+	}
+	q.left--
+	return nil
+}
+
+// NullQueue is a Queue that presents no compilations.
+type NullQueue struct{}
+
+// Next implements the Queue interface.  It always returns io.EOF.
+func (NullQueue) Next(context.Context, CompilationFunc) error { return io.EOF }
+
+// A ChannelQueue is a Queue that presents compilations as they are received
+// from a channel.  The queue is exhausted when the channel is closed.
+type ChannelQueue struct {
+	ch <-chan Compilation
+}
+
+// NewChannelQueue returns a ChannelQueue that receives compilations from ch.
+func NewChannelQueue(ch <-chan Compilation) *ChannelQueue { return &ChannelQueue{ch: ch} }
+
+// Next implements the Queue interface.  It blocks until a compilation is
+// available or ctx ends, and returns io.EOF once the channel is closed.
+func (q *ChannelQueue) Next(ctx context.Context, f CompilationFunc) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case cu, ok := <-q.ch:
+		if !ok {
+			return io.EOF
+		}
+		return f(ctx, cu)
+	}
+}
+
+// A FilterQueue is a Queue that presents only those compilations from an
+// underlying queue that satisfy a predicate.  Other compilations are consumed
+// from the underlying queue and silently discarded.
+type FilterQueue struct {
+	queue Queue
+	keep  func(Compilation) bool
+}
+
+// NewFilterQueue returns a FilterQueue that presents the compilations from q
+// for which keep returns true.
+func NewFilterQueue(q Queue, keep func(Compilation) bool) *FilterQueue {
+	return &FilterQueue{queue: q, keep: keep}
+}
+
+// Next implements the Queue interface.
+func (q *FilterQueue) Next(ctx context.Context, f CompilationFunc) error {
+	for {
+		var kept bool
+		if err := q.queue.Next(ctx, func(ctx context.Context, cu Compilation) error {
+			if !q.keep(cu) {
+				return nil
+			}
+			kept = true
+			return f(ctx, cu)
+		}); err != nil || kept {
+			return err
+		}
+	}
+}
+
+// A MultiQueue is a Queue that presents the compilations from each of a
+// sequence of queues in turn, exhausting each before moving to the next.
+type MultiQueue struct {
+	queues []Queue // the queues not yet exhausted
+}
+
+// NewMultiQueue returns a MultiQueue that concatenates qs in order.
+func NewMultiQueue(qs ...Queue) *MultiQueue { return &MultiQueue{queues: qs} }
+
+// Next implements the Queue interface.  It returns io.EOF once all of the
+// underlying queues are exhausted.  Any other error from an underlying queue
+// is returned immediately.
+func (q *MultiQueue) Next(ctx context.Context, f CompilationFunc) error {
+	for len(q.queues) != 0 {
+		if err := q.queues[0].Next(ctx, f); !isEndOfQueue(err) {
+			return err
+		}
+		q.queues = q.queues[1:]
+	}
+	return io.EOF
+}
+
+// A RoundRobinQueue is a Queue that interleaves the compilations from a
+// collection of queues, taking one from each in turn.  Queues are dropped from
+// the rotation as they are exhausted.
+type RoundRobinQueue struct {
+	queues []Queue // the queues not yet exhausted
+	next   int     // the index in queues of the next queue to consult
+}
+
+// NewRoundRobinQueue returns a RoundRobinQueue that rotates among qs in order.
+func NewRoundRobinQueue(qs ...Queue) *RoundRobinQueue {
+	// Copy qs, since exhausted queues are removed in place.
+	return &RoundRobinQueue{queues: append([]Queue(nil), qs...)}
+}
+
+// Next implements the Queue interface.  It returns io.EOF once all of the
+// underlying queues are exhausted.  A queue that reports ErrNoMoreNow is
+// passed over in favour of the next, and Next reports ErrNoMoreNow only once
+// every queue not yet exhausted has done so.  Any other error from an
+// underlying queue is returned immediately, and the rotation does not
+// advance, so the same queue is consulted again by the next call.
+func (q *RoundRobinQueue) Next(ctx context.Context, f CompilationFunc) error {
+	var idle int // the number of queues that reported ErrNoMoreNow
+	for len(q.queues) != 0 {
+		if idle >= len(q.queues) {
+			return ErrNoMoreNow
+		}
+		i := q.next % len(q.queues)
+		err := q.queues[i].Next(ctx, f)
+		switch {
+		case isNoMoreNow(err):
+			q.next = i + 1
+			idle++
+		case isEndOfQueue(err):
+			q.queues = append(q.queues[:i], q.queues[i+1:]...)
+			q.next = i
+		default:
+			if err == nil {
+				q.next = i + 1
+			}
+			return err
+		}
+	}
+	return io.EOF
+}
+
+// A DedupQueue is a Queue that presents each compilation from an underlying
+// queue at most once, identifying compilations by their unit's VName
+// signature.  Compilations without a signature are always presented.
+//
+// The signature of every compilation presented is retained in memory for the
+// lifetime of the queue, so its size grows with the number of distinct
+// compilations.
+type DedupQueue struct {
+	queue Queue
+	seen  map[string]bool
+}
+
+// NewDedupQueue returns a DedupQueue that filters duplicates from q.
+func NewDedupQueue(q Queue) *DedupQueue {
+	return &DedupQueue{queue: q, seen: make(map[string]bool)}
+}
+
+// Next implements the Queue interface.  A compilation is only recorded as seen
+// if f succeeds, so a compilation that fails may be presented again.
+func (q *DedupQueue) Next(ctx context.Context, f CompilationFunc) error {
+	for {
+		var presented bool
+		if err := q.queue.Next(ctx, func(ctx context.Context, cu Compilation) error {
+			sig := cu.Unit.GetVName().GetSignature()
+			if sig != "" && q.seen[sig] {
+				return nil
+			}
+			presented = true
+			if err := f(ctx, cu); err != nil {
+				return err
+			}
+			if sig != "" {
+				q.seen[sig] = true
+			}
+			return nil
+		}); err != nil || presented {
+			return err
+		}
+	}
+}
+
+// A LimitQueue is a Queue that presents at most a fixed number of
+// compilations from an underlying queue.
+type LimitQueue struct {
+	queue Queue
+	left  int // the number of compilations remaining
+}
+
+// NewLimitQueue returns a LimitQueue that presents at most n compilations from
+// q before reporting io.EOF.
+func NewLimitQueue(q Queue, n int) *LimitQueue { return &LimitQueue{queue: q, left: n} }
+
+// Next implements the Queue interface.  Only compilations for which f succeeds
+// count toward the limit, so a compilation that fails and is presented again
+// is not counted twice.
+func (q *LimitQueue) Next(ctx context.Context, f CompilationFunc) error {
+	if q.left <= 0 {
+		return io.EOF
+	}
+	return q.queue.Next(ctx, func(ctx context.Context, cu Compilation) error {
+		if err := f(ctx, cu); err != nil {
+			return err
+		}
+		q.left--
+		return nil
+	})
+}
+
+// A PriorityQueue is a Queue that presents the compilations from an
+// underlying queue in order of decreasing priority.  Compilations of equal
+// priority are presented in the order they were taken from the underlying
+// queue.
+//
+// Because the highest-priority compilation cannot be known until every
+// compilation has been seen, the first call to Next consumes the whole of
+// the underlying queue, and all of its compilations are buffered in memory.
+// An underlying queue that never reports io.EOF, such as a ChannelQueue that
+// is not closed, will never present any compilations.
+type PriorityQueue struct {
+	queue    Queue
+	priority func(Compilation) int
+	loaded   bool         // whether the underlying queue has been exhausted
+	items    priorityHeap // the compilations not yet presented
+	seq      int          // the number of compilations taken so far
+}
+
+// NewPriorityQueue returns a PriorityQueue that presents the compilations
+// from q, highest priority first, as reported by priority.
+func NewPriorityQueue(q Queue, priority func(Compilation) int) *PriorityQueue {
+	return &PriorityQueue{queue: q, priority: priority}
+}
+
+// Next implements the Queue interface.  An error from the underlying queue
+// while it is being consumed is returned, and consumption resumes with the
+// next call.  As with a SliceQueue, if f reports an error, the same
+// compilation is presented by the next call.  The context passed to f carries
+// the values the underlying queue attached to the compilation, but is
+// cancelled along with ctx.
+func (q *PriorityQueue) Next(ctx context.Context, f CompilationFunc) error {
+	for !q.loaded {
+		err := q.queue.Next(ctx, func(cctx context.Context, cu Compilation) error {
+			heap.Push(&q.items, prioritized{ctx: cctx, cu: cu, priority: q.priority(cu), seq: q.seq})
+			q.seq++
+			return nil
+		})
+		if isEndOfQueue(err) {
+			q.loaded = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(q.items) == 0 {
+		return io.EOF
+	}
+	if err := f(rebase(q.items[0].ctx, ctx), q.items[0].cu); err != nil {
+		return err
+	}
+	heap.Pop(&q.items)
+	return nil
+}
+
+// A prioritized is a compilation buffered by a PriorityQueue.
+type prioritized struct {
+	ctx      context.Context // the context the compilation was received with
+	cu       Compilation
+	priority int
+	seq      int // the order in which the compilation was received
+}
+
+// priorityHeap implements heap.Interface, with the highest priority first.
+type priorityHeap []prioritized
+
+func (h priorityHeap) Len() int      { return len(h) }
+func (h priorityHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h priorityHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h *priorityHeap) Push(x interface{}) { *h = append(*h, x.(prioritized)) }
+
+func (h *priorityHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	old[len(old)-1] = prioritized{} // release the compilation
+	*h = old[:len(old)-1]
+	return last
+}
+
+// A QueueFunc is a Queue that obtains each compilation by calling the
+// function.  The function should return io.EOF when no compilations remain.
+type QueueFunc func(context.Context) (Compilation, error)
+
+// NewFuncQueue returns a Queue that presents the compilations returned by
+// successive calls to next, until it reports an error such as io.EOF.
+func NewFuncQueue(next func(context.Context) (Compilation, error)) QueueFunc {
+	return QueueFunc(next)
+}
+
+// Next implements the Queue interface.
+func (q QueueFunc) Next(ctx context.Context, f CompilationFunc) error {
+	cu, err := q(ctx)
+	if err != nil {
+		return err
+	}
+	return f(ctx, cu)
+}
@@ -0,0 +1,690 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// drain calls q.Next until it reports an error, returning the signatures of
+// the compilations presented and the final error.
+func drain(q Queue) ([]string, error) {
+	var sigs []string
+	for {
+		if err := q.Next(context.Background(), func(_ context.Context, cu Compilation) error {
+			sigs = append(sigs, cu.Unit.GetVName().GetSignature())
+			return nil
+		}); err != nil {
+			return sigs, err
+		}
+	}
+}
+
+func checkDrain(t *testing.T, q Queue, want ...string) {
+	t.Helper()
+	got, err := drain(q)
+	if err != io.EOF {
+		t.Errorf("Expected error %v at end of queue; found %v", io.EOF, err)
+	}
+	if !equalStrings(got, want) {
+		t.Errorf("Incorrect compilations:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, s := range a {
+		if s != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSliceQueue(t *testing.T) {
+	tests := [][]string{
+		nil,
+		{"a"},
+		{"a", "b", "c"},
+	}
+	for _, sigs := range tests {
+		checkDrain(t, NewSliceQueue(comps(sigs...)...), sigs...)
+	}
+}
+
+func TestSliceQueueError(t *testing.T) {
+	q := NewSliceQueue(comps("a", "b")...)
+	bad := errors.New("bad compilation")
+	var seen []string
+	fail := func(_ context.Context, cu Compilation) error {
+		seen = append(seen, cu.Unit.GetVName().GetSignature())
+		return bad
+	}
+	for i := 0; i < 2; i++ {
+		if err := q.Next(context.Background(), fail); err != bad {
+			t.Errorf("Next: expected error %v; found %v", bad, err)
+		}
+	}
+	if want := []string{"a", "a"}; !equalStrings(seen, want) {
+		t.Errorf("Failed compilation was not re-presented: got %q, want %q", seen, want)
+	}
+	checkDrain(t, q, "a", "b")
+}
+
+func TestOrderedQueue(t *testing.T) {
+	cus := comps("b", "c", "a", "b2")
+	cus[0].Revision = "first" // distinguishes the two "b" compilations
+	cus[3].Revision = "second"
+	cus[3].Unit.VName.Signature = "b"
+	bySig := func(a, b Compilation) bool {
+		return a.Unit.GetVName().GetSignature() < b.Unit.GetVName().GetSignature()
+	}
+	q := NewOrderedQueue(cus, bySig)
+
+	var revs []string
+	for {
+		err := q.Next(context.Background(), func(_ context.Context, cu Compilation) error {
+			revs = append(revs, cu.Unit.GetVName().GetSignature()+"@"+cu.Revision)
+			return nil
+		})
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next: unexpected error: %v", err)
+		}
+	}
+	if want := []string{"a@12345", "b@first", "b@second", "c@12345"}; !equalStrings(revs, want) {
+		t.Errorf("Ordered compilations: got %q, want %q", revs, want)
+	}
+	if got := cus[0].Unit.GetVName().GetSignature(); got != "b" {
+		t.Errorf("Input slice was reordered: first element is %q", got)
+	}
+
+	// Reversing the comparator presents the compilations newest-first.
+	reverse := func(a, b Compilation) bool { return bySig(b, a) }
+	checkDrain(t, NewOrderedQueue(comps("a", "c", "b"), reverse), "c", "b", "a")
+}
+
+func TestSliceQueueDriver(t *testing.T) {
+	a := new(fakeAnalyzer)
+	q := NewSliceQueue(comps("a", "b", "c")...)
+	if err := (&Driver{Analyzer: a}).Run(context.Background(), q); err != nil {
+		t.Errorf("Driver error: %v", err) // io.EOF ends the run cleanly
+	}
+	if len(a.requests) != 3 {
+		t.Errorf("Expected 3 AnalysisRequests; found %d", len(a.requests))
+	}
+}
+
+func TestChannelQueue(t *testing.T) {
+	ch := make(chan Compilation)
+	go func() {
+		for _, cu := range comps("a", "b", "c") {
+			ch <- cu
+		}
+		close(ch)
+	}()
+	q := NewChannelQueue(ch)
+	checkDrain(t, q, "a", "b", "c")
+	checkDrain(t, q) // remains exhausted once closed
+}
+
+func TestChannelQueueCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	q := NewChannelQueue(make(chan Compilation)) // never delivers anything
+	if err := q.Next(ctx, func(context.Context, Compilation) error {
+		t.Error("Unexpected compilation from an empty channel")
+		return nil
+	}); err != context.Canceled {
+		t.Errorf("Expected error %v; found %v", context.Canceled, err)
+	}
+}
+
+func TestFilterQueue(t *testing.T) {
+	keepEven := func(cu Compilation) bool {
+		sig := cu.Unit.GetVName().GetSignature()
+		return (sig[len(sig)-1]-'0')%2 == 0
+	}
+	tests := []struct {
+		input, want []string
+	}{
+		{nil, nil},
+		{[]string{"t1", "t3"}, nil},
+		{[]string{"t2"}, []string{"t2"}},
+		{[]string{"t1", "t2", "t3", "t4", "t5"}, []string{"t2", "t4"}},
+	}
+	for _, test := range tests {
+		checkDrain(t, NewFilterQueue(NewSliceQueue(comps(test.input...)...), keepEven), test.want...)
+	}
+}
+
+// A funcQueue implements the Queue interface by calling a function.
+type funcQueue func(context.Context, CompilationFunc) error
+
+func (q funcQueue) Next(ctx context.Context, f CompilationFunc) error { return q(ctx, f) }
+
+func TestRepeatQueue(t *testing.T) {
+	checkDrain(t, NewRepeatQueue(comps("a")[0], 0))
+	checkDrain(t, NewRepeatQueue(comps("a")[0], 3), "a", "a", "a")
+
+	q := NewRepeatQueue(comps("a")[0], 2)
+	bad := errors.New("bad compilation")
+	if err := q.Next(context.Background(), func(context.Context, Compilation) error { return bad }); err != bad {
+		t.Errorf("Expected error %v; found %v", bad, err)
+	}
+	checkDrain(t, q, "a", "a")
+}
+
+func TestNullQueue(t *testing.T) {
+	checkDrain(t, NullQueue{})
+}
+
+func TestMultiQueue(t *testing.T) {
+	checkDrain(t, NewMultiQueue())
+	checkDrain(t, NewMultiQueue(NewSliceQueue(), NewSliceQueue()))
+	checkDrain(t, NewMultiQueue(
+		NewSliceQueue(comps("a", "b")...),
+		NewSliceQueue(),
+		NewSliceQueue(comps("c")...),
+	), "a", "b", "c")
+}
+
+func TestMultiQueueError(t *testing.T) {
+	bad := errors.New("queue failure")
+	q := NewMultiQueue(
+		funcQueue(func(context.Context, CompilationFunc) error { return bad }),
+		funcQueue(func(context.Context, CompilationFunc) error {
+			t.Error("Second queue was consulted after an error from the first")
+			return io.EOF
+		}),
+	)
+	if sigs, err := drain(q); err != bad {
+		t.Errorf("Expected error %v; found %v", bad, err)
+	} else if len(sigs) != 0 {
+		t.Errorf("Unexpected compilations: %q", sigs)
+	}
+}
+
+func TestRoundRobinQueue(t *testing.T) {
+	checkDrain(t, NewRoundRobinQueue())
+	checkDrain(t, NewRoundRobinQueue(
+		NewSliceQueue(comps("a1", "a2", "a3", "a4")...),
+		NewSliceQueue(comps("b1")...),
+		NewSliceQueue(comps("c1", "c2")...),
+	), "a1", "b1", "c1", "a2", "c2", "a3", "a4")
+	checkDrain(t, NewRoundRobinQueue(
+		NewSliceQueue(),
+		NewSliceQueue(comps("b1", "b2")...),
+		NewSliceQueue(comps("c1")...),
+	), "b1", "c1", "b2")
+}
+
+func TestRoundRobinQueueLimit(t *testing.T) {
+	q := NewLimitQueue(NewRoundRobinQueue(
+		NewSliceQueue(comps("a1", "a2", "a3")...),
+		NewSliceQueue(comps("b1", "b2", "b3")...),
+		NewSliceQueue(comps("c1")...),
+	), 5)
+	checkDrain(t, q, "a1", "b1", "c1", "a2", "b2")
+}
+
+func TestRoundRobinQueueError(t *testing.T) {
+	q := NewRoundRobinQueue(
+		NewSliceQueue(comps("a1", "a2")...),
+		NewSliceQueue(comps("b1")...),
+	)
+	bad := errors.New("bad compilation")
+	if err := q.Next(context.Background(), func(context.Context, Compilation) error { return bad }); err != bad {
+		t.Errorf("Expected error %v; found %v", bad, err)
+	}
+	// The failed compilation is presented again before the rotation advances.
+	checkDrain(t, q, "a1", "b1", "a2")
+}
+
+func TestRoundRobinQueueNoMoreNow(t *testing.T) {
+	var ready bool // whether the idle queue has work
+	idle := NewFuncQueue(func(context.Context) (Compilation, error) {
+		if !ready {
+			return Compilation{}, ErrNoMoreNow
+		}
+		ready = false
+		return comps("a1")[0], nil
+	})
+	q := NewRoundRobinQueue(idle, NewSliceQueue(comps("b1", "b2")...))
+	next := func() (string, error) {
+		var sig string
+		err := q.Next(context.Background(), func(_ context.Context, cu Compilation) error {
+			sig = cu.Unit.GetVName().GetSignature()
+			return nil
+		})
+		return sig, err
+	}
+
+	// The idle queue does not hold up the others.
+	for _, want := range []string{"b1", "b2"} {
+		if sig, err := next(); err != nil || sig != want {
+			t.Errorf("Next: got (%q, %v), want (%q, nil)", sig, err, want)
+		}
+	}
+	// Once only the idle queue remains, its state is reported.
+	if sig, err := next(); err != ErrNoMoreNow {
+		t.Errorf("Next: got (%q, %v), want %v", sig, err, ErrNoMoreNow)
+	}
+	ready = true
+	if sig, err := next(); err != nil || sig != "a1" {
+		t.Errorf("Next: got (%q, %v), want (%q, nil)", sig, err, "a1")
+	}
+}
+
+func TestDedupQueue(t *testing.T) {
+	q := NewDedupQueue(NewMultiQueue(
+		NewSliceQueue(comps("a", "b", "a", "c")...),
+		NewSliceQueue(comps("c", "b", "d", "", "")...),
+	))
+	checkDrain(t, q, "a", "b", "c", "d", "", "")
+}
+
+func TestDedupQueueError(t *testing.T) {
+	q := NewDedupQueue(NewSliceQueue(comps("a", "a", "b")...))
+	bad := errors.New("bad compilation")
+	if err := q.Next(context.Background(), func(context.Context, Compilation) error { return bad }); err != bad {
+		t.Errorf("Expected error %v; found %v", bad, err)
+	}
+	// The failed compilation was not recorded as seen.
+	checkDrain(t, q, "a", "b")
+}
+
+func TestLimitQueue(t *testing.T) {
+	var sigs []string
+	for i := 0; i < 100; i++ {
+		sigs = append(sigs, fmt.Sprintf("t%d", i))
+	}
+	checkDrain(t, NewLimitQueue(NewSliceQueue(comps(sigs...)...), 5), sigs[:5]...)
+	checkDrain(t, NewLimitQueue(NewSliceQueue(comps(sigs[:3]...)...), 5), sigs[:3]...)
+	checkDrain(t, NewLimitQueue(NewSliceQueue(comps(sigs...)...), 0))
+}
+
+func TestLimitQueueError(t *testing.T) {
+	q := NewLimitQueue(NewSliceQueue(comps("a", "b", "c")...), 2)
+	bad := errors.New("bad compilation")
+	for i := 0; i < 3; i++ {
+		if err := q.Next(context.Background(), func(context.Context, Compilation) error { return bad }); err != bad {
+			t.Errorf("Expected error %v; found %v", bad, err)
+		}
+	}
+	// Failures do not count toward the limit.
+	checkDrain(t, q, "a", "b")
+}
+
+func TestPriorityQueue(t *testing.T) {
+	priorities := map[string]int{"urgent": 10, "high": 5, "high2": 5, "low": -1}
+	priority := func(cu Compilation) int { return priorities[cu.Unit.GetVName().GetSignature()] }
+
+	q := NewPriorityQueue(NewSliceQueue(comps("a", "high", "low", "urgent", "b", "high2", "c")...), priority)
+	checkDrain(t, q, "urgent", "high", "high2", "a", "b", "c", "low")
+	checkDrain(t, NewPriorityQueue(NullQueue{}, priority))
+
+	// With equal priorities, the underlying order is preserved.
+	var sigs []string
+	for i := 0; i < 50; i++ {
+		sigs = append(sigs, fmt.Sprintf("t%d", i))
+	}
+	checkDrain(t, NewPriorityQueue(NewSliceQueue(comps(sigs...)...), priority), sigs...)
+}
+
+func TestPriorityQueueError(t *testing.T) {
+	bad := errors.New("bad compilation")
+	priority := func(cu Compilation) int { return len(cu.Unit.GetVName().GetSignature()) }
+	q := NewPriorityQueue(NewSliceQueue(comps("a", "ccc", "bb")...), priority)
+	if err := q.Next(context.Background(), func(context.Context, Compilation) error { return bad }); err != bad {
+		t.Errorf("Expected error %v; found %v", bad, err)
+	}
+	// The failed compilation is presented again.
+	checkDrain(t, q, "ccc", "bb", "a")
+
+	// An error from the underlying queue is reported, and loading resumes.
+	var calls int
+	src := NewFuncQueue(func(context.Context) (Compilation, error) {
+		calls++
+		switch calls {
+		case 1:
+			return comps("low")[0], nil
+		case 2:
+			return Compilation{}, bad
+		case 3:
+			return comps("high")[0], nil
+		}
+		return Compilation{}, io.EOF
+	})
+	q = NewPriorityQueue(src, priority)
+	if _, err := drain(q); err != bad {
+		t.Errorf("Expected error %v; found %v", bad, err)
+	}
+	checkDrain(t, q, "high", "low")
+}
+
+func TestPriorityQueueContextValues(t *testing.T) {
+	priority := func(cu Compilation) int { return len(cu.Unit.GetVName().GetSignature()) }
+	q := NewPriorityQueue(originQueue{NewSliceQueue(comps("a", "bb")...)}, priority)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var got []string
+	for {
+		err := q.Next(ctx, func(ctx context.Context, cu Compilation) error {
+			origin, _ := ctx.Value(originKey{}).(string)
+			got = append(got, origin)
+			return nil
+		})
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next: unexpected error: %v", err)
+		}
+	}
+	if want := []string{"origin:bb", "origin:a"}; !equalStrings(got, want) {
+		t.Errorf("Context values: got %q, want %q", got, want)
+	}
+
+	// The context passed to f is cancelled with the one passed to Next, not
+	// the one the compilation was loaded with.
+	q = NewPriorityQueue(originQueue{NewSliceQueue(comps("a")...)}, priority)
+	if err := q.Next(ctx, func(context.Context, Compilation) error { return errors.New("retry") }); err == nil {
+		t.Fatal("Next: expected an error from f")
+	}
+	cancel()
+	if err := q.Next(context.Background(), func(ctx context.Context, _ Compilation) error { return ctx.Err() }); err != nil {
+		t.Errorf("Next: context passed to f ended with the loading context: %v", err)
+	}
+}
+
+func TestFuncQueue(t *testing.T) {
+	n := 3
+	q := NewFuncQueue(func(context.Context) (Compilation, error) {
+		if n == 0 {
+			return Compilation{}, io.EOF
+		}
+		n--
+		return comps(fmt.Sprintf("t%d", n))[0], nil
+	})
+	checkDrain(t, q, "t2", "t1", "t0")
+
+	bad := errors.New("source failure")
+	q = NewFuncQueue(func(context.Context) (Compilation, error) { return Compilation{}, bad })
+	if sigs, err := drain(q); err != bad || len(sigs) != 0 {
+		t.Errorf("Expected error %v and no compilations; found %v, %q", bad, err, sigs)
+	}
+}
+
+// A closingQueue is a CloseableQueue that counts calls to Close.
+type closingQueue struct {
+	Queue
+	closed int
+	err    error
+}
+
+func (q *closingQueue) Close() error {
+	q.closed++
+	return q.err
+}
+
+func TestDriverCloseQueue(t *testing.T) {
+	errClose := errors.New("close failed")
+	tests := []struct {
+		name     string
+		fail     map[string]error
+		closeErr error
+		want     error
+	}{
+		{"Success", nil, nil, nil},
+		{"AnalysisError", map[string]error{"t2": errFromAnalysis}, nil, errFromAnalysis},
+		{"CloseError", nil, errClose, errClose},
+		{"BothErrors", map[string]error{"t2": errFromAnalysis}, errClose, errFromAnalysis},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, concurrent := range []bool{false, true} {
+				q := &closingQueue{Queue: NewSliceQueue(comps("t1", "t2", "t3")...), err: test.closeErr}
+				d := &Driver{Analyzer: &fakeAnalyzer{fail: test.fail}}
+				var err error
+				if concurrent {
+					err = d.RunConcurrent(context.Background(), q, 2)
+				} else {
+					err = d.Run(context.Background(), q)
+				}
+				if !errors.Is(err, test.want) || (test.want == nil && err != nil) {
+					t.Errorf("Concurrent=%v: expected error %v; found %v", concurrent, test.want, err)
+				}
+				if q.closed != 1 {
+					t.Errorf("Concurrent=%v: expected 1 call to Close; found %d", concurrent, q.closed)
+				}
+			}
+		})
+	}
+}
+
+func TestDriverNoMoreNow(t *testing.T) {
+	for _, workers := range []int{0, 2} {
+		// The queue returns ErrNoMoreNow twice before each compilation.
+		sq := NewSliceQueue(comps("t1", "t2")...)
+		var polls int
+		var waitSince time.Time // when ErrNoMoreNow was last returned
+		q := funcQueue(func(ctx context.Context, f CompilationFunc) error {
+			if !waitSince.IsZero() {
+				if d := time.Since(waitSince); d < 5*time.Millisecond {
+					t.Errorf("Workers=%d: queue polled again after %v", workers, d)
+				}
+				waitSince = time.Time{}
+			}
+			if polls++; polls%3 != 0 {
+				waitSince = time.Now()
+				return ErrNoMoreNow
+			}
+			return sq.Next(ctx, f)
+		})
+
+		a := new(fakeAnalyzer)
+		d := &Driver{Analyzer: a, PollInterval: 5 * time.Millisecond}
+		var err error
+		if workers == 0 {
+			err = d.Run(context.Background(), q)
+		} else {
+			err = d.RunConcurrent(context.Background(), q, workers)
+		}
+		if err != nil {
+			t.Errorf("Workers=%d: unexpected error: %v", workers, err)
+		}
+		if len(a.requests) != 2 || polls != 9 {
+			t.Errorf("Workers=%d: got %d analyses after %d polls; want 2 after 9", workers, len(a.requests), polls)
+		}
+	}
+}
+
+func TestDriverNoMoreNowCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := funcQueue(func(context.Context, CompilationFunc) error {
+		cancel()
+		return ErrNoMoreNow
+	})
+	d := &Driver{Analyzer: new(fakeAnalyzer), PollInterval: time.Hour}
+	if err := d.Run(ctx, q); err != context.Canceled {
+		t.Errorf("Expected error %v; found %v", context.Canceled, err)
+	}
+}
+
+// originKey is a context key used by originQueue.
+type originKey struct{}
+
+// originQueue attaches the origin of each compilation to the context it
+// passes to the driver.
+type originQueue struct{ Queue }
+
+func (q originQueue) Next(ctx context.Context, f CompilationFunc) error {
+	return q.Queue.Next(ctx, func(ctx context.Context, cu Compilation) error {
+		return f(context.WithValue(ctx, originKey{}, "origin:"+cu.Unit.GetVName().GetSignature()), cu)
+	})
+}
+
+func TestQueueContextValues(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(*Driver, Queue) error
+	}{
+		{"Run", func(d *Driver, q Queue) error { return d.Run(context.Background(), q) }},
+		{"Prefetch", func(d *Driver, q Queue) error {
+			d.Prefetch = 2
+			return d.Run(context.Background(), q)
+		}},
+		{"RunConcurrent", func(d *Driver, q Queue) error { return d.RunConcurrent(context.Background(), q, 2) }},
+		{"OrderedOutput", func(d *Driver, q Queue) error {
+			d.OrderedOutput = true
+			return d.RunConcurrent(context.Background(), q, 2)
+		}},
+	}
+	for _, test := range tests {
+		var mu sync.Mutex
+		var mismatches []string
+		check := func(hook string, ctx context.Context) {
+			mu.Lock()
+			defer mu.Unlock()
+			cu, ok := CompilationFromContext(ctx)
+			if !ok {
+				mismatches = append(mismatches, hook+": no compilation")
+				return
+			}
+			want := "origin:" + cu.Unit.GetVName().GetSignature()
+			if got, _ := ctx.Value(originKey{}).(string); got != want {
+				mismatches = append(mismatches, fmt.Sprintf("%s: got %q, want %q", hook, got, want))
+			}
+		}
+		d := &Driver{
+			Analyzer: &fakeAnalyzer{outputs: outs("a")},
+			Context: testContext{
+				setup: func(ctx context.Context, _ Compilation) error {
+					check("Setup", ctx)
+					return nil
+				},
+				teardown: func(ctx context.Context, _ Compilation) error {
+					check("Teardown", ctx)
+					return nil
+				},
+			},
+			WriteOutput: func(ctx context.Context, _ *apb.AnalysisOutput) error {
+				check("WriteOutput", ctx)
+				return nil
+			},
+			OnProgress: func(ctx context.Context, _ Compilation, _ int, _ error) { check("OnProgress", ctx) },
+		}
+		if err := test.run(d, originQueue{NewSliceQueue(comps("t1", "t2", "t3")...)}); err != nil {
+			t.Fatalf("%s: driver error: %v", test.name, err)
+		}
+		if len(mismatches) != 0 {
+			t.Errorf("%s: queue context values not propagated:\n%s", test.name, strings.Join(mismatches, "\n"))
+		}
+	}
+}
+
+func TestDriverFailIfEmpty(t *testing.T) {
+	for _, test := range []struct {
+		failIfEmpty bool
+		sigs        []string
+		want        error
+	}{
+		{false, nil, nil},
+		{true, nil, ErrEmptyQueue},
+		{true, []string{"t1"}, nil},
+	} {
+		d := &Driver{Analyzer: new(fakeAnalyzer), FailIfEmpty: test.failIfEmpty}
+		if err := d.Run(context.Background(), NewSliceQueue(comps(test.sigs...)...)); err != test.want {
+			t.Errorf("Run(FailIfEmpty=%v, %q): got error %v, want %v", test.failIfEmpty, test.sigs, err, test.want)
+		}
+		if err := d.RunConcurrent(context.Background(), NewSliceQueue(comps(test.sigs...)...), 2); err != test.want {
+			t.Errorf("RunConcurrent(FailIfEmpty=%v, %q): got error %v, want %v", test.failIfEmpty, test.sigs, err, test.want)
+		}
+	}
+
+	// A run that ends for another reason reports that instead.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d := &Driver{Analyzer: new(fakeAnalyzer), FailIfEmpty: true}
+	if err := d.Run(ctx, NewSliceQueue()); err != context.Canceled {
+		t.Errorf("Run with a cancelled context: got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDriverWrappedEOF(t *testing.T) {
+	wrapped := func(q Queue) Queue {
+		return NewFuncQueue(func(ctx context.Context) (Compilation, error) {
+			var next Compilation
+			err := q.Next(ctx, func(_ context.Context, cu Compilation) error {
+				next = cu
+				return nil
+			})
+			if err != nil {
+				return Compilation{}, fmt.Errorf("reading queue: %w", err)
+			}
+			return next, nil
+		})
+	}
+	a := new(fakeAnalyzer)
+	d := &Driver{Analyzer: a}
+	if err := d.Run(context.Background(), wrapped(NewSliceQueue(comps("t1", "t2")...))); err != nil {
+		t.Errorf("Run with a wrapped io.EOF: unexpected error: %v", err)
+	}
+	if got, want := analyzed(a), []string{"t1", "t2"}; !equalStrings(got, want) {
+		t.Errorf("Analyzed %q, want %q", got, want)
+	}
+	checkDrain(t, NewMultiQueue(wrapped(NewSliceQueue(comps("a")...)), NewSliceQueue(comps("b")...)), "a", "b")
+
+	// A wrapped ErrNoMoreNow is polled again, by the driver, Drain, and a
+	// RoundRobinQueue alike.
+	polling := func() Queue {
+		var polled bool
+		return wrapped(NewFuncQueue(func(context.Context) (Compilation, error) {
+			if !polled {
+				polled = true
+				return Compilation{}, ErrNoMoreNow
+			}
+			return Compilation{}, io.EOF
+		}))
+	}
+	d.PollInterval = time.Millisecond
+	if err := d.Run(context.Background(), NewMultiQueue(polling(), NewSliceQueue(comps("t3")...))); err != nil {
+		t.Errorf("Run with a wrapped ErrNoMoreNow: unexpected error: %v", err)
+	}
+	if err := d.Drain(context.Background(), polling()); err != nil {
+		t.Errorf("Drain with a wrapped ErrNoMoreNow: unexpected error: %v", err)
+	}
+	checkDrain(t, NewRoundRobinQueue(polling(), NewSliceQueue(comps("c")...)), "c")
+
+	// An analysis that fails with io.EOF does not end the run quietly.
+	d.Analyzer = &fakeAnalyzer{fail: map[string]error{"t1": fmt.Errorf("reading input: %w", io.EOF)}}
+	if err := d.Run(context.Background(), NewSliceQueue(comps("t1", "t2")...)); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the analysis error to be reported; found %v", err)
+	}
+}
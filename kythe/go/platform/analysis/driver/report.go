@@ -0,0 +1,51 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"time"
+)
+
+// A Report describes the processing of each compilation during a run, in a
+// form suitable for encoding as JSON.
+type Report struct {
+	Records []Record `json:"compilations"` // in the order processing finished
+	Totals  Stats    `json:"totals"`
+}
+
+// A Record describes the processing of a single compilation.
+type Record struct {
+	Signature string        `json:"signature"`
+	Revision  string        `json:"revision,omitempty"`
+	Duration  time.Duration `json:"duration_ns"`        // total time spent in the analyzer
+	Attempts  int           `json:"attempts"`           // zero if it was never analyzed
+	Outputs   int           `json:"outputs"`            // outputs emitted by the last attempt
+	Cached    bool          `json:"cached,omitempty"`   // served by MaybeServeCached
+	Analyzer  string        `json:"analyzer,omitempty"` // the Identity of the analyzer, if any
+	Error     string        `json:"error,omitempty"`
+}
+
+// RunReport behaves like Run, but additionally returns a Report of the work
+// done.  The Report is populated even if an error is returned.
+func (d *Driver) RunReport(ctx context.Context, queue Queue) (*Report, error) {
+	r := d.newRun()
+	r.report = new(Report)
+	stats, err := r.runQueue(ctx, queue)
+	r.report.Totals = stats
+	return r.report, err
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestDriverRunReport(t *testing.T) {
+	errFail := errors.New("analysis failed")
+	d := &Driver{
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			switch req.Compilation.GetVName().GetSignature() {
+			case "fail":
+				return errFail
+			case "retry":
+				if AttemptFromContext(ctx) == 1 {
+					return ErrRetry
+				}
+			}
+			return nil
+		}),
+		Context: testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				if cu.Unit.GetVName().GetSignature() == "skip" {
+					return ErrSkip
+				}
+				return nil
+			},
+		},
+		ContinueOnError: true,
+		Logger:          &testLogger{},
+	}
+	report, err := d.RunReport(context.Background(), NewSliceQueue(comps("ok", "retry", "fail", "skip")...))
+	if !errors.Is(err, errFail) {
+		t.Errorf("Expected error %v; found %v", errFail, err)
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatalf("Marshaling report: %v", err)
+	}
+	var got struct {
+		Compilations []map[string]interface{} `json:"compilations"`
+		Totals       map[string]interface{}   `json:"totals"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshaling report %s: %v", data, err)
+	}
+
+	want := []struct {
+		sig      string
+		attempts float64
+		err      string
+	}{
+		{"ok", 1, ""},
+		{"retry", 2, ""},
+		{"fail", 1, errFail.Error()},
+		{"skip", 0, ErrSkip.Error()},
+	}
+	if len(got.Compilations) != len(want) {
+		t.Fatalf("Expected %d records; found %s", len(want), data)
+	}
+	for i, w := range want {
+		rec := got.Compilations[i]
+		if rec["signature"] != w.sig || rec["revision"] != "12345" || rec["attempts"] != w.attempts {
+			t.Errorf("Record %d: got %v; want signature %q, revision %q, %v attempts", i, rec, w.sig, "12345", w.attempts)
+		}
+		if e, _ := rec["error"].(string); e != w.err {
+			t.Errorf("Record %d: got error %q; want %q", i, e, w.err)
+		}
+		if d, ok := rec["duration_ns"].(float64); !ok || (w.attempts > 0) != (d > 0) {
+			t.Errorf("Record %d: unexpected duration %v", i, rec["duration_ns"])
+		}
+	}
+	for key, want := range map[string]float64{
+		"compilations": 4,
+		"succeeded":    2,
+		"failed":       1,
+		"skipped":      1,
+		"retries":      1,
+	} {
+		if got.Totals[key] != want {
+			t.Errorf("Total %q: got %v, want %v", key, got.Totals[key], want)
+		}
+	}
+}
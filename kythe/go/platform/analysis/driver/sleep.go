@@ -0,0 +1,52 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"time"
+)
+
+// sleepCtx waits for the given duration, returning early with the error from
+// ctx if it ends before the duration elapses.  All of the driver's one-off
+// delays go through sleepCtx; timeouts are context deadlines instead.  Its
+// timer is stopped, and any pending tick discarded, before it returns, so no
+// timer outlives the call.  A non-positive duration does not wait at all, but
+// still reports whether ctx has ended.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	return waitTimer(ctx, time.NewTimer(d))
+}
+
+// waitTimer waits for t to fire or ctx to end, and stops t if ctx ends first.
+func waitTimer(ctx context.Context, t *time.Timer) error {
+	select {
+	case <-ctx.Done():
+		if !t.Stop() {
+			// The timer fired concurrently with the cancellation.
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSleepCtx(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now()
+	if err := sleepCtx(ctx, 10*time.Millisecond); err != nil {
+		t.Errorf("sleepCtx: unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("sleepCtx returned after %v, before its duration elapsed", elapsed)
+	}
+	if err := sleepCtx(ctx, 0); err != nil {
+		t.Errorf("sleepCtx(0): unexpected error: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := sleepCtx(cancelled, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("sleepCtx(0) with a cancelled context: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSleepCtxCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(5*time.Millisecond, cancel)
+	start := time.Now()
+	if err := sleepCtx(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("sleepCtx: got %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Minute {
+		t.Errorf("sleepCtx did not return promptly on cancellation: %v", elapsed)
+	}
+
+	deadline, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := sleepCtx(deadline, time.Hour); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("sleepCtx: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSleepCtxNoLeak(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 100; i++ {
+		timer := time.NewTimer(time.Hour)
+		if err := waitTimer(ctx, timer); !errors.Is(err, context.Canceled) {
+			t.Fatalf("waitTimer: got %v, want %v", err, context.Canceled)
+		}
+		if timer.Stop() {
+			t.Fatal("waitTimer returned without stopping its timer")
+		}
+	}
+
+	// A timer that fires concurrently with the cancellation is drained.
+	timer := time.NewTimer(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	waitTimer(ctx, timer)
+	select {
+	case <-timer.C:
+		t.Error("waitTimer left a pending tick on its timer")
+	default:
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import "time"
+
+// Stats summarizes the work done by a Driver during a single run.
+type Stats struct {
+	Compilations int `json:"compilations"` // compilations received from the queue
+	Succeeded    int `json:"succeeded"`    // compilations processed without error
+	Failed       int `json:"failed"`       // compilations whose processing reported an error
+	Skipped      int `json:"skipped"`      // compilations abandoned with ErrSkip
+	Unchanged    int `json:"unchanged"`    // skipped compilations that matched their PriorDigest
+	CacheHits    int `json:"cache_hits"`   // compilations served by MaybeServeCached
+	Retries      int `json:"retries"`      // analyses retried at the request of AnalysisError
+	Outputs      int `json:"outputs"`      // outputs emitted by the analyzer
+
+	DuplicateOutputs  int `json:"duplicate_outputs"`  // outputs dropped by DedupOutputs
+	EmptyCompilations int `json:"empty_compilations"` // compilations analyzed without emitting any outputs
+	TeardownTimeouts  int `json:"teardown_timeouts"`  // Teardown calls that exceeded TeardownTimeout
+
+	TotalDuration time.Duration `json:"total_duration_ns"` // wall-clock time spent in the run
+
+	// QueueWaitTotal is the time spent waiting for the queue to deliver
+	// compilations, and ProcessTotal the time spent processing them, from
+	// Setup through Teardown.  When compilations are processed concurrently,
+	// ProcessTotal is summed over all of them, so it may exceed TotalDuration.
+	QueueWaitTotal time.Duration `json:"queue_wait_total_ns"`
+	ProcessTotal   time.Duration `json:"process_total_ns"`
+
+	// Inputs of the compilations sent to the analyzer.  The sizes of inputs are
+	// reported by the driver's InputSize function; inputs whose size is not
+	// known are counted in MissingSizeInputs instead of TotalInputBytes.
+	TotalInputs       int   `json:"total_inputs"`
+	TotalInputBytes   int64 `json:"total_input_bytes"`
+	MissingSizeInputs int   `json:"missing_size_inputs"`
+
+	// FlakyCompilations lists the signatures of the compilations that
+	// succeeded only after their analysis or Teardown was retried, in the
+	// order they finished.  They are also counted in Succeeded.
+	FlakyCompilations []string `json:"flaky_compilations,omitempty"`
+
+	// ErrorsByClass counts the compilations that failed, keyed by the class
+	// reported for each error by the driver's ClassifyError function.  It is
+	// nil if ClassifyError is not set or no compilations failed.
+	ErrorsByClass map[string]int `json:"errors_by_class,omitempty"`
+
+	// CompilationsByAnalyzer counts the compilations sent to each analyzer
+	// that is an Identifier, keyed by its identity.  It is nil if no such
+	// analyzer was used.
+	CompilationsByAnalyzer map[string]int `json:"compilations_by_analyzer,omitempty"`
+
+	// DiagnosticsBySeverity counts the diagnostics passed to the driver's
+	// OnDiagnostic, keyed by their severity.  It is nil if OnDiagnostic is not
+	// set or no diagnostics were emitted.
+	DiagnosticsBySeverity map[string]int `json:"diagnostics_by_severity,omitempty"`
+
+	// PerCorpus breaks down the outcomes of compilations by the corpus of
+	// their unit's VName.  It is nil if no compilations were processed.
+	PerCorpus map[string]CorpusStats `json:"per_corpus,omitempty"`
+}
+
+// CorpusStats summarizes the compilations from a single corpus.
+type CorpusStats struct {
+	Succeeded int `json:"succeeded"` // compilations processed without error
+	Failed    int `json:"failed"`    // compilations whose processing reported an error
+	Retries   int `json:"retries"`   // analyses retried at the request of AnalysisError
+
+	// Revisions lists the distinct revisions of the compilations processed,
+	// in the order they were first seen, so the first and last are the
+	// earliest and latest to appear.  Skipped compilations are not included.
+	Revisions []string `json:"revisions,omitempty"`
+}
+
+// addRevision adds rev to the revisions of cs, if it is not already present.
+func (cs *CorpusStats) addRevision(rev string) {
+	for _, r := range cs.Revisions {
+		if r == rev {
+			return
+		}
+	}
+	cs.Revisions = append(cs.Revisions, rev)
+}
+
+// updateCorpus calls f with the CorpusStats for the given corpus.
+func (s *Stats) updateCorpus(corpus string, f func(*CorpusStats)) {
+	if s.PerCorpus == nil {
+		s.PerCorpus = make(map[string]CorpusStats)
+	}
+	cs := s.PerCorpus[corpus]
+	f(&cs)
+	s.PerCorpus[corpus] = cs
+}
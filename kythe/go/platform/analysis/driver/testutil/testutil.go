@@ -0,0 +1,89 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package testutil provides support for testing programs built on the
+// analysis driver.
+package testutil // import "kythe.io/kythe/go/platform/analysis/driver/testutil"
+
+import (
+	"context"
+	"sync"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	"google.golang.org/protobuf/proto"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A RecordingAnalyzer is an analysis.CompilationAnalyzer that records a copy
+// of each request it receives and replies to every request with the same
+// fixed outputs.  It is safe for concurrent use, so it may be used with
+// Driver.RunConcurrent.  The zero value records requests without emitting
+// outputs.
+type RecordingAnalyzer struct {
+	// Outputs are emitted in order for each request.  Each output function
+	// receives its own copy, so an output may be modified by its recipient.
+	Outputs []*apb.AnalysisOutput
+
+	mu       sync.Mutex
+	requests []*apb.AnalysisRequest
+}
+
+// Analyze implements analysis.CompilationAnalyzer.  It records req, then
+// emits the configured outputs to f, stopping at the first error from f or
+// when ctx ends.
+func (r *RecordingAnalyzer) Analyze(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc) error {
+	r.mu.Lock()
+	r.requests = append(r.requests, proto.Clone(req).(*apb.AnalysisRequest))
+	r.mu.Unlock()
+
+	for _, out := range r.Outputs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(ctx, proto.Clone(out).(*apb.AnalysisOutput)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Requests returns the requests received so far, in the order they arrived.
+func (r *RecordingAnalyzer) Requests() []*apb.AnalysisRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*apb.AnalysisRequest(nil), r.requests...)
+}
+
+// Signatures returns the signatures of the compilation units of the requests
+// received so far, in the order they arrived.
+func (r *RecordingAnalyzer) Signatures() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sigs := make([]string, len(r.requests))
+	for i, req := range r.requests {
+		sigs[i] = req.GetCompilation().GetVName().GetSignature()
+	}
+	return sigs
+}
+
+// Reset discards the requests recorded so far.
+func (r *RecordingAnalyzer) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = nil
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+func request(sig string) *apb.AnalysisRequest {
+	return &apb.AnalysisRequest{
+		Compilation: &apb.CompilationUnit{VName: &spb.VName{Signature: sig}},
+		Revision:    "12345",
+	}
+}
+
+func TestRecordingAnalyzer(t *testing.T) {
+	ctx := context.Background()
+	r := &RecordingAnalyzer{Outputs: []*apb.AnalysisOutput{
+		{Value: []byte("a")},
+		{Value: []byte("b")},
+	}}
+	var got []string
+	collect := func(_ context.Context, out *apb.AnalysisOutput) error {
+		got = append(got, string(out.Value))
+		out.Value = []byte("modified") // must not affect later requests
+		return nil
+	}
+
+	req := request("t1")
+	if err := r.Analyze(ctx, req, collect); err != nil {
+		t.Fatalf("Analyze(t1): unexpected error: %v", err)
+	}
+	req.Revision = "changed" // must not affect the recorded request
+	if err := r.Analyze(ctx, request("t2"), collect); err != nil {
+		t.Fatalf("Analyze(t2): unexpected error: %v", err)
+	}
+
+	if want := []string{"a", "b", "a", "b"}; !equal(got, want) {
+		t.Errorf("Outputs: got %q, want %q", got, want)
+	}
+	if got, want := r.Signatures(), []string{"t1", "t2"}; !equal(got, want) {
+		t.Errorf("Signatures: got %q, want %q", got, want)
+	}
+	reqs := r.Requests()
+	if len(reqs) != 2 || !proto.Equal(reqs[0], request("t1")) || !proto.Equal(reqs[1], request("t2")) {
+		t.Errorf("Requests: got %v, want the requests for t1 and t2", reqs)
+	}
+
+	r.Reset()
+	if got := r.Requests(); len(got) != 0 {
+		t.Errorf("Requests after Reset: got %v, want none", got)
+	}
+}
+
+func TestRecordingAnalyzerErrors(t *testing.T) {
+	r := &RecordingAnalyzer{Outputs: []*apb.AnalysisOutput{
+		{Value: []byte("a")},
+		{Value: []byte("b")},
+	}}
+	errOutput := errors.New("output failed")
+	var calls int
+	err := r.Analyze(context.Background(), request("t1"), func(context.Context, *apb.AnalysisOutput) error {
+		calls++
+		return errOutput
+	})
+	if err != errOutput || calls != 1 {
+		t.Errorf("Analyze: got error %v after %d outputs, want %v after 1", err, calls, errOutput)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.Analyze(ctx, request("t2"), func(context.Context, *apb.AnalysisOutput) error {
+		t.Error("Output emitted after the context ended")
+		return nil
+	}); err != context.Canceled {
+		t.Errorf("Analyze with a cancelled context: got %v, want %v", err, context.Canceled)
+	}
+
+	// Requests are recorded even when their analysis fails.
+	if got, want := r.Signatures(), []string{"t1", "t2"}; !equal(got, want) {
+		t.Errorf("Signatures: got %q, want %q", got, want)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attribute keys recorded on the span for each compilation.
+const (
+	corpusKey    = attribute.Key("kythe.corpus")
+	signatureKey = attribute.Key("kythe.signature")
+	revisionKey  = attribute.Key("kythe.revision")
+)
+
+// startSpan starts a span covering the processing of cu, if the driver has a
+// Tracer.  The returned function ends the span, recording err if non-nil.
+func (d *Driver) startSpan(ctx context.Context, cu Compilation) (context.Context, func(err error)) {
+	if d.Tracer == nil {
+		return ctx, func(error) {}
+	}
+	vname := cu.Unit.GetVName()
+	ctx, span := d.Tracer.Start(ctx, "kythe.analysis", trace.WithAttributes(
+		corpusKey.String(vname.GetCorpus()),
+		signatureKey.String(vname.GetSignature()),
+		revisionKey.String(d.revision(cu)),
+	))
+	return ctx, func(err error) {
+		if err != nil && err != ErrSkip {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestDriverTracer(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+
+	cus := comps("t1", "bad")
+	for _, cu := range cus {
+		cu.Unit.VName.Corpus = "corpus"
+	}
+	cus[1].Revision = "" // supplied by RevisionFunc
+	a := &fakeAnalyzer{fail: map[string]error{"bad": errFromAnalysis}}
+	var spanned int
+	d := &Driver{
+		Analyzer:     a,
+		Tracer:       tp.Tracer("driver_test"),
+		RevisionFunc: func(Compilation) string { return "derived" },
+		Context: testContext{
+			setup: func(ctx context.Context, _ Compilation) error {
+				if trace.SpanFromContext(ctx).SpanContext().IsValid() {
+					spanned++
+				}
+				return nil
+			},
+		},
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(cus...)); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error %v; found %v", errFromAnalysis, err)
+	}
+	if spanned != len(cus) {
+		t.Errorf("Setup saw an active span for %d of %d compilations", spanned, len(cus))
+	}
+
+	spans := exp.GetSpans()
+	if len(spans) != len(cus) {
+		t.Fatalf("Expected %d spans; found %d", len(cus), len(spans))
+	}
+	revs := []string{cus[0].Revision, "derived"}
+	for i, span := range spans {
+		attrs := make(map[attribute.Key]string)
+		for _, kv := range span.Attributes {
+			attrs[kv.Key] = kv.Value.AsString()
+		}
+		sig := cus[i].Unit.GetVName().GetSignature()
+		if attrs[corpusKey] != "corpus" || attrs[signatureKey] != sig || attrs[revisionKey] != revs[i] {
+			t.Errorf("Span %d has incorrect attributes: %v", i, attrs)
+		}
+		want := codes.Unset
+		if sig == "bad" {
+			want = codes.Error
+		}
+		if span.Status.Code != want {
+			t.Errorf("Span %d: got status %v, want %v", i, span.Status.Code, want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"github.com/pkg/errors"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// validateUnit performs basic structural checks on unit, reporting the first
+// problem found.
+func validateUnit(unit *apb.CompilationUnit) error {
+	if unit == nil {
+		return errors.New("missing compilation unit")
+	}
+	v := unit.GetVName()
+	if v == nil {
+		return errors.New("missing unit VName")
+	} else if v.Corpus == "" {
+		return errors.New("missing unit corpus")
+	} else if v.Signature == "" {
+		return errors.New("missing unit signature")
+	}
+
+	paths := make(map[string]bool)
+	for i, ri := range unit.RequiredInput {
+		path := ri.GetInfo().GetPath()
+		if path == "" {
+			return errors.Errorf("required input %d has no path", i)
+		} else if paths[path] {
+			return errors.Errorf("duplicate required input %q", path)
+		}
+		paths[path] = true
+	}
+	return nil
+}
+
+// missingInputs returns the paths of the required inputs of unit for which
+// exists reports false, in order.
+func missingInputs(unit *apb.CompilationUnit, exists func(path string) bool) []string {
+	var missing []string
+	for _, ri := range unit.GetRequiredInput() {
+		if path := ri.GetInfo().GetPath(); !exists(path) {
+			missing = append(missing, path)
+		}
+	}
+	return missing
+}
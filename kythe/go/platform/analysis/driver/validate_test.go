@@ -0,0 +1,207 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+func input(path string) *apb.CompilationUnit_FileInput {
+	return &apb.CompilationUnit_FileInput{Info: &apb.FileInfo{Path: path, Digest: "digest:" + path}}
+}
+
+func TestValidateUnit(t *testing.T) {
+	vname := &spb.VName{Corpus: "corpus", Signature: "sig"}
+	tests := []struct {
+		unit *apb.CompilationUnit
+		want string // error substring; "" for success
+	}{
+		{&apb.CompilationUnit{VName: vname}, ""},
+		{&apb.CompilationUnit{
+			VName:         vname,
+			RequiredInput: []*apb.CompilationUnit_FileInput{input("a.cc"), input("b.h")},
+		}, ""},
+
+		{nil, "missing compilation unit"},
+		{&apb.CompilationUnit{}, "missing unit VName"},
+		{&apb.CompilationUnit{VName: &spb.VName{Signature: "sig"}}, "missing unit corpus"},
+		{&apb.CompilationUnit{VName: &spb.VName{Corpus: "corpus"}}, "missing unit signature"},
+		{&apb.CompilationUnit{
+			VName:         vname,
+			RequiredInput: []*apb.CompilationUnit_FileInput{input("a.cc"), {Info: &apb.FileInfo{}}},
+		}, "required input 1 has no path"},
+		{&apb.CompilationUnit{
+			VName:         vname,
+			RequiredInput: []*apb.CompilationUnit_FileInput{input("a.cc"), input("b.h"), input("a.cc")},
+		}, `duplicate required input "a.cc"`},
+	}
+	for _, test := range tests {
+		err := validateUnit(test.unit)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("validateUnit(%v): unexpected error: %v", test.unit, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("validateUnit(%v): got error %v, want %q", test.unit, err, test.want)
+		}
+	}
+}
+
+func TestDriverValidateUnit(t *testing.T) {
+	valid := comps("t1")
+	valid[0].Unit.VName.Corpus = "corpus"
+	invalid := comps("t2") // no corpus
+
+	a := new(fakeAnalyzer)
+	var setups int
+	d := &Driver{
+		Analyzer:     a,
+		ValidateUnit: true,
+		Context: testContext{
+			setup: func(context.Context, Compilation) error {
+				setups++
+				return nil
+			},
+		},
+	}
+	err := d.Run(context.Background(), NewSliceQueue(append(valid, invalid...)...))
+	if err == nil || !strings.Contains(err.Error(), "missing unit corpus") {
+		t.Errorf("Expected validation error; found %v", err)
+	}
+	if setups != 1 || len(a.requests) != 1 {
+		t.Errorf("Invalid compilation was not rejected before Setup: %d setups, %d requests", setups, len(a.requests))
+	}
+}
+
+func TestDriverRequiredInputExists(t *testing.T) {
+	cus := comps("present", "absent", "none")
+	cus[0].Unit.RequiredInput = []*apb.CompilationUnit_FileInput{input("a.cc"), input("b.h")}
+	cus[1].Unit.RequiredInput = []*apb.CompilationUnit_FileInput{input("a.cc"), input("gone.h"), input("lost.h")}
+	exists := map[string]bool{"a.cc": true, "b.h": true}
+
+	a := new(fakeAnalyzer)
+	var tornDown []string
+	log := new(testLogger)
+	d := &Driver{
+		Analyzer:            a,
+		RequiredInputExists: func(path string) bool { return exists[path] },
+		Logger:              log,
+		Context: testContext{
+			teardown: func(_ context.Context, cu Compilation) error {
+				tornDown = append(tornDown, cu.Unit.GetVName().GetSignature())
+				return nil
+			},
+		},
+	}
+	stats, err := d.RunStats(context.Background(), NewSliceQueue(cus...))
+	if err != nil {
+		t.Fatalf("Driver error: %v", err)
+	}
+	if got, want := analyzed(a), []string{"none", "present"}; !equalStrings(got, want) {
+		t.Errorf("Analyzed compilations: got %q, want %q", got, want)
+	}
+	if want := []string{"present", "absent", "none"}; !equalStrings(tornDown, want) {
+		t.Errorf("Torn down compilations: got %q, want %q", tornDown, want)
+	}
+	if stats.Skipped != 1 {
+		t.Errorf("Expected 1 skipped compilation; found %d", stats.Skipped)
+	}
+	if len(log.messages) != 1 || !strings.Contains(log.messages[0], `["gone.h" "lost.h"]`) {
+		t.Errorf("Expected a warning naming the missing inputs; found %q", log.messages)
+	}
+}
+
+func TestDriverAugmentInputs(t *testing.T) {
+	cus := comps("t1", "t2")
+	for _, cu := range cus {
+		cu.Unit.RequiredInput = []*apb.CompilationUnit_FileInput{input("a.cc")}
+	}
+	errAugment := errors.New("augment failed")
+	a := new(fakeAnalyzer)
+	d := &Driver{
+		Analyzer: a,
+		AugmentInputs: func(_ context.Context, cu Compilation) ([]*apb.CompilationUnit_FileInput, error) {
+			if cu.Unit.GetVName().GetSignature() == "t2" {
+				return nil, errAugment
+			}
+			return []*apb.CompilationUnit_FileInput{input("common.h"), input("extra.h")}, nil
+		},
+	}
+	if err := d.Run(context.Background(), NewSliceQueue(cus...)); !errors.Is(err, errAugment) {
+		t.Errorf("Expected error %v; found %v", errAugment, err)
+	}
+	if len(a.requests) != 1 {
+		t.Fatalf("Expected 1 analysis request; found %d", len(a.requests))
+	}
+
+	var got []string
+	for _, ri := range a.requests[0].Compilation.RequiredInput {
+		got = append(got, ri.GetInfo().GetPath())
+	}
+	if want := []string{"a.cc", "common.h", "extra.h"}; !equalStrings(got, want) {
+		t.Errorf("Required inputs in request: got %q, want %q", got, want)
+	}
+	if n := len(cus[0].Unit.RequiredInput); n != 1 {
+		t.Errorf("Original unit was modified: %d required inputs", n)
+	}
+}
+
+func TestDriverInputStats(t *testing.T) {
+	cus := comps("t1", "t2", "skip")
+	cus[0].Unit.RequiredInput = []*apb.CompilationUnit_FileInput{input("a.cc"), input("b.h"), input("unknown.h")}
+	cus[1].Unit.RequiredInput = []*apb.CompilationUnit_FileInput{input("c.cc")}
+	cus[2].Unit.RequiredInput = []*apb.CompilationUnit_FileInput{input("d.cc")}
+	sizes := map[string]int64{"a.cc": 100, "b.h": 20, "c.cc": 3, "d.cc": 1000}
+
+	for _, withSizes := range []bool{false, true} {
+		d := &Driver{
+			Analyzer: new(fakeAnalyzer),
+			Context: testContext{
+				setup: func(_ context.Context, cu Compilation) error {
+					if cu.Unit.GetVName().GetSignature() == "skip" {
+						return ErrSkip
+					}
+					return nil
+				},
+			},
+		}
+		if withSizes {
+			d.InputSize = func(ri *apb.CompilationUnit_FileInput) (int64, bool) {
+				size, ok := sizes[ri.GetInfo().GetPath()]
+				return size, ok
+			}
+		}
+		stats, err := d.RunStats(context.Background(), NewSliceQueue(cus...))
+		if err != nil {
+			t.Fatalf("Driver error: %v", err)
+		}
+		wantBytes, wantMissing := int64(123), 1
+		if !withSizes {
+			wantBytes, wantMissing = 0, 4
+		}
+		if stats.TotalInputs != 4 || stats.TotalInputBytes != wantBytes || stats.MissingSizeInputs != wantMissing {
+			t.Errorf("InputSize=%v: got %d inputs, %d bytes, %d missing; want 4, %d, %d", withSizes,
+				stats.TotalInputs, stats.TotalInputBytes, stats.MissingSizeInputs, wantBytes, wantMissing)
+		}
+	}
+}
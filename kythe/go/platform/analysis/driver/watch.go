@@ -0,0 +1,148 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A Watcher reports changes to files.  An fsnotify.Watcher, for example, can
+// be adapted to this interface.
+type Watcher interface {
+	// Watch begins reporting changes to the file at path.
+	Watch(path string) error
+
+	// Changes returns a channel that delivers the path of each file that
+	// changes, as given to Watch.  The channel is closed when the watcher
+	// stops.
+	Changes() <-chan string
+
+	// Close stops the watcher and releases its resources.
+	Close() error
+}
+
+// A WatchQueue is a Queue that presents a compilation each time one of its
+// required inputs changes, as reported by a Watcher, so that it can be
+// reanalyzed.  A compilation whose inputs change again before it has been
+// presented is presented only once.  The queue is never exhausted: Next
+// blocks until a change arrives, and reports io.EOF only once the queue has
+// been closed or the watcher stops.
+type WatchQueue struct {
+	watcher Watcher
+	units   []Compilation
+	byPath  map[string][]int // the indices in units of the compilations requiring each path
+
+	pending []int        // the compilations changed but not yet presented, in order
+	queued  map[int]bool // the members of pending
+
+	mu     sync.Mutex
+	closed chan struct{} // closed by Close
+}
+
+// NewWatchQueue returns a WatchQueue that watches the required inputs of each
+// of cus with w, and presents the compilations as their inputs change.  The
+// paths watched are those recorded in the compilations' required inputs.
+// Closing the queue closes w.
+func NewWatchQueue(w Watcher, cus ...Compilation) (*WatchQueue, error) {
+	q := &WatchQueue{
+		watcher: w,
+		units:   cus,
+		byPath:  make(map[string][]int),
+		queued:  make(map[int]bool),
+		closed:  make(chan struct{}),
+	}
+	for i, cu := range cus {
+		for _, ri := range cu.Unit.GetRequiredInput() {
+			path := ri.GetInfo().GetPath()
+			if path == "" {
+				continue
+			}
+			if _, ok := q.byPath[path]; !ok {
+				if err := w.Watch(path); err != nil {
+					return nil, errors.WithMessagef(err, "watching %q", path)
+				}
+			}
+			q.byPath[path] = append(q.byPath[path], i)
+		}
+	}
+	return q, nil
+}
+
+// Next implements the Queue interface.  As with a SliceQueue, if f reports an
+// error, the same compilation is presented by the next call.
+func (q *WatchQueue) Next(ctx context.Context, f CompilationFunc) error {
+	for len(q.pending) == 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.closed:
+			return io.EOF
+		case path, ok := <-q.watcher.Changes():
+			if !ok {
+				return io.EOF
+			}
+			q.changed(path)
+		}
+	}
+	// Take in any other changes already reported, so that they are coalesced
+	// with those pending.
+	for more := true; more; {
+		select {
+		case path, ok := <-q.watcher.Changes():
+			if more = ok; ok {
+				q.changed(path)
+			}
+		default:
+			more = false
+		}
+	}
+	i := q.pending[0]
+	if err := f(ctx, q.units[i]); err != nil {
+		return err
+	}
+	q.pending = q.pending[1:]
+	delete(q.queued, i)
+	return nil
+}
+
+// changed marks the compilations requiring path as pending.
+func (q *WatchQueue) changed(path string) {
+	for _, i := range q.byPath[path] {
+		if !q.queued[i] {
+			q.queued[i] = true
+			q.pending = append(q.pending, i)
+		}
+	}
+}
+
+// Close implements the CloseableQueue interface.  It stops the watcher and
+// causes Next to report io.EOF, and may be called concurrently with Next.
+func (q *WatchQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-q.closed:
+		return nil // already closed
+	default:
+	}
+	close(q.closed)
+	return q.watcher.Close()
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2021 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// fakeWatcher is a Watcher whose changes are sent by the test.
+type fakeWatcher struct {
+	watched []string
+	changes chan string
+	closed  bool
+	err     error // returned from Watch
+}
+
+func newFakeWatcher() *fakeWatcher { return &fakeWatcher{changes: make(chan string, 10)} }
+
+func (w *fakeWatcher) Watch(path string) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.watched = append(w.watched, path)
+	return nil
+}
+
+func (w *fakeWatcher) Changes() <-chan string { return w.changes }
+
+func (w *fakeWatcher) Close() error {
+	w.closed = true
+	return nil
+}
+
+func watchedUnits() []Compilation {
+	cus := comps("lib", "bin")
+	cus[0].Unit.RequiredInput = []*apb.CompilationUnit_FileInput{input("lib.cc"), input("lib.h")}
+	cus[1].Unit.RequiredInput = []*apb.CompilationUnit_FileInput{input("main.cc"), input("lib.h")}
+	return cus
+}
+
+// nextSig returns the signature of the next compilation presented by q.
+func nextSig(q Queue) (string, error) {
+	var sig string
+	err := q.Next(context.Background(), func(_ context.Context, cu Compilation) error {
+		sig = cu.Unit.GetVName().GetSignature()
+		return nil
+	})
+	return sig, err
+}
+
+func TestWatchQueue(t *testing.T) {
+	w := newFakeWatcher()
+	q, err := NewWatchQueue(w, watchedUnits()...)
+	if err != nil {
+		t.Fatalf("NewWatchQueue error: %v", err)
+	}
+	if want := []string{"lib.cc", "lib.h", "main.cc"}; !equalStrings(w.watched, want) {
+		t.Errorf("Watched paths: got %q, want %q", w.watched, want)
+	}
+
+	w.changes <- "main.cc"
+	if sig, err := nextSig(q); err != nil || sig != "bin" {
+		t.Errorf("After main.cc changed: got (%q, %v), want bin", sig, err)
+	}
+
+	// A shared input triggers both compilations, and repeated changes to the
+	// same compilation are coalesced.
+	w.changes <- "lib.h"
+	w.changes <- "lib.cc"
+	var got []string
+	for i := 0; i < 2; i++ {
+		sig, err := nextSig(q)
+		if err != nil {
+			t.Fatalf("Next: unexpected error: %v", err)
+		}
+		got = append(got, sig)
+	}
+	if want := []string{"lib", "bin"}; !equalStrings(got, want) {
+		t.Errorf("After lib.h changed: got %q, want %q", got, want)
+	}
+
+	// Next blocks until a change arrives.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Next(ctx, func(context.Context, Compilation) error {
+		t.Error("Unexpected compilation without a change")
+		return nil
+	}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Next without a change: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if err := q.Close(); err != nil || !w.closed {
+		t.Errorf("Close: error %v, watcher closed %v", err, w.closed)
+	}
+	if _, err := nextSig(q); err != io.EOF {
+		t.Errorf("Next after Close: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestWatchQueueErrors(t *testing.T) {
+	w := newFakeWatcher()
+	w.err = errors.New("too many watches")
+	if _, err := NewWatchQueue(w, watchedUnits()...); !errors.Is(err, w.err) {
+		t.Errorf("NewWatchQueue: got %v, want %v", err, w.err)
+	}
+
+	w = newFakeWatcher()
+	q, err := NewWatchQueue(w, watchedUnits()...)
+	if err != nil {
+		t.Fatalf("NewWatchQueue error: %v", err)
+	}
+	w.changes <- "lib.cc"
+	bad := errors.New("bad compilation")
+	if err := q.Next(context.Background(), func(context.Context, Compilation) error { return bad }); err != bad {
+		t.Errorf("Expected error %v; found %v", bad, err)
+	}
+	// The failed compilation is presented again.
+	if sig, err := nextSig(q); err != nil || sig != "lib" {
+		t.Errorf("After a failure: got (%q, %v), want lib", sig, err)
+	}
+
+	close(w.changes) // the watcher stopped
+	if _, err := nextSig(q); err != io.EOF {
+		t.Errorf("Next after the watcher stopped: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestDriverWatchQueue(t *testing.T) {
+	w := newFakeWatcher()
+	q, err := NewWatchQueue(w, watchedUnits()...)
+	if err != nil {
+		t.Fatalf("NewWatchQueue error: %v", err)
+	}
+	analyzedc := make(chan string, 10)
+	d := &Driver{
+		Analyzer: new(fakeAnalyzer),
+		OnProgress: func(_ context.Context, cu Compilation, _ int, _ error) {
+			analyzedc <- cu.Unit.GetVName().GetSignature()
+		},
+	}
+	done := make(chan error)
+	go func() { done <- d.Run(context.Background(), q) }()
+
+	for _, change := range []struct{ path, sig string }{{"lib.cc", "lib"}, {"main.cc", "bin"}, {"lib.cc", "lib"}} {
+		w.changes <- change.path
+		if sig := <-analyzedc; sig != change.sig {
+			t.Errorf("After %s changed: analyzed %q, want %q", change.path, sig, change.sig)
+		}
+	}
+	q.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Run error: %v", err)
+	}
+}
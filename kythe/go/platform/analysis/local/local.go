@@ -126,6 +126,19 @@ func (q *FileQueue) Next(ctx context.Context, f driver.CompilationFunc) error {
 	})
 }
 
+// Close implements the driver.CloseableQueue interface.  It releases the
+// currently-open input file, if any, and discards any undelivered units.
+func (q *FileQueue) Close() error {
+	q.index = len(q.paths)
+	q.units = nil
+	if q.closer == nil {
+		return nil
+	}
+	err := q.closer.Close()
+	q.closer = nil
+	return err
+}
+
 // Fetch implements the analysis.Fetcher interface by delegating to the
 // currently-active input file. Only files in the current archive will be
 // accessible for a given invocation of Fetch.